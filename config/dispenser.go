@@ -1,9 +1,6 @@
 package config
 
-import (
-	"errors"
-	"fmt"
-)
+import "github.com/mholt/caddy/middleware"
 
 // dispenser is a type that dispenses tokens, similarly to
 // a lexer, except that it can do so with some notion of
@@ -154,6 +151,5 @@ func (d *dispenser) ArgErr() error {
 
 // Err generates a custom parse error with a message of msg.
 func (d *dispenser) Err(msg string) error {
-	msg = fmt.Sprintf("%s:%d - Parse error: %s", d.filename, d.tokens[d.cursor].line, msg)
-	return errors.New(msg)
+	return &middleware.ParseError{File: d.filename, Line: d.tokens[d.cursor].line, Message: msg}
 }
@@ -30,6 +30,41 @@ type Browse struct {
 type BrowseConfig struct {
 	PathScope string
 	Template  *template.Template
+	Hidden    []string // Names of files not to list, e.g. ".git"
+}
+
+// NewConfig returns a configuration for browsing in pathScope with
+// the listing template in templateFile, or the default template if
+// templateFile is empty.
+func NewConfig(pathScope, templateFile string) (BrowseConfig, error) {
+	bc := BrowseConfig{PathScope: pathScope}
+
+	tplText := defaultTemplate
+	if templateFile != "" {
+		tplBytes, err := ioutil.ReadFile(templateFile)
+		if err != nil {
+			return bc, err
+		}
+		tplText = string(tplBytes)
+	}
+
+	// Build the template
+	tpl, err := template.New("listing").Parse(tplText)
+	if err != nil {
+		return bc, err
+	}
+	bc.Template = tpl
+	return bc, nil
+}
+
+// hidden returns whether the file called name is not to be listed.
+func (bc BrowseConfig) hidden(name string) bool {
+	for _, h := range bc.Hidden {
+		if name == h {
+			return true
+		}
+	}
+	return false
 }
 
 // A Listing is used to fill out a template.
@@ -133,6 +168,9 @@ func (b Browse) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
 		var abort bool // we bail early if we find an index file
 		for _, f := range files {
 			name := f.Name()
+			if bc.hidden(name) {
+				continue
+			}
 
 			// Directory is not browseable if it contains index file
 			for _, indexName := range IndexPages {
@@ -212,33 +250,22 @@ func parse(c middleware.Controller) ([]BrowseConfig, error) {
 	}
 
 	for c.Next() {
-		var bc BrowseConfig
-
 		// First argument is directory to allow browsing; default is site root
+		pathScope := "/"
 		if c.NextArg() {
-			bc.PathScope = c.Val()
-		} else {
-			bc.PathScope = "/"
+			pathScope = c.Val()
 		}
 
 		// Second argument would be the template file to use
-		var tplText string
+		var templateFile string
 		if c.NextArg() {
-			tplBytes, err := ioutil.ReadFile(c.Val())
-			if err != nil {
-				return configs, err
-			}
-			tplText = string(tplBytes)
-		} else {
-			tplText = defaultTemplate
+			templateFile = c.Val()
 		}
 
-		// Build the template
-		tpl, err := template.New("listing").Parse(tplText)
+		bc, err := NewConfig(pathScope, templateFile)
 		if err != nil {
 			return configs, err
 		}
-		bc.Template = tpl
 
 		// Save configuration
 		err = appendCfg(bc)
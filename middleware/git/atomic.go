@@ -0,0 +1,141 @@
+package git
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pullAtomic pulls into a copy of Path, made next to it, and
+// then swaps the copy in for Path, so that requests are served
+// from the previous tree until the new one is complete.
+func (r *Repo) pullAtomic() error {
+	staging := r.Path + ".next"
+	os.RemoveAll(staging)
+	if err := r.copyTree(r.Path, staging, ""); err != nil {
+		os.RemoveAll(staging)
+		return err
+	}
+
+	err := r.pullIn(staging)
+	if err == nil {
+		err = r.swapIn(staging)
+	}
+	if err != nil {
+		os.RemoveAll(staging)
+	}
+	return err
+}
+
+// swapIn replaces the tree at Path with the one at staging. Path
+// is a link to the tree, which is replaced with a single rename,
+// so that requests never wait for a swap and each file is served
+// from either tree. The previous tree is removed; files of it
+// being served stay readable until they are closed.
+func (r *Repo) swapIn(staging string) error {
+	if err := r.linkTree(); err != nil {
+		return err
+	}
+	previous := linkTarget(r.Path)
+	r.removeTrees(previous)
+
+	tree := r.newTree()
+	if err := os.Rename(staging, tree); err != nil {
+		return err
+	}
+	if err := r.link(tree); err != nil {
+		// left for the caller to remove
+		os.Rename(tree, staging)
+		return err
+	}
+
+	if err := os.RemoveAll(previous); err != nil {
+		logger().Println(err)
+	}
+	return nil
+}
+
+// linkTree makes Path a link to a tree next to it, if it is not
+// one yet, so that swapIn can replace the tree. A directory at
+// Path is moved there first; prepare does so before Path is served.
+func (r *Repo) linkTree() error {
+	info, err := os.Lstat(r.Path)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+	tree := r.newTree()
+	if err := os.Rename(r.Path, tree); err != nil {
+		return err
+	}
+	if err := r.link(tree); err != nil {
+		os.Rename(tree, r.Path)
+		return err
+	}
+	return nil
+}
+
+// link points Path to tree, replacing the previous link
+// at once, as a rename does.
+func (r *Repo) link(tree string) error {
+	link := r.Path + ".link"
+	os.Remove(link)
+	// relative, so that the trees can be moved along with Path
+	if err := os.Symlink(filepath.Base(tree), link); err != nil {
+		return err
+	}
+	if err := os.Rename(link, r.Path); err != nil {
+		os.Remove(link)
+		return err
+	}
+	return nil
+}
+
+// treePrefix is what the names of the trees Path links to start
+// with after the name of Path.
+const treePrefix = ".tree-"
+
+// newTree returns the path of a new tree next to Path.
+func (r *Repo) newTree() string {
+	return r.Path + treePrefix + strconv.FormatInt(time.Now().UnixNano(), 36)
+}
+
+// removeTrees removes the trees next to Path other than current,
+// e.g. left behind by a crash during a swap.
+func (r *Repo) removeTrees(current string) {
+	fs, err := ioutil.ReadDir(filepath.Dir(r.Path))
+	if err != nil {
+		return
+	}
+	prefix := filepath.Base(r.Path) + treePrefix
+	for _, f := range fs {
+		tree := filepath.Join(filepath.Dir(r.Path), f.Name())
+		if strings.HasPrefix(f.Name(), prefix) && tree != current {
+			os.RemoveAll(tree)
+		}
+	}
+}
+
+// linkTarget returns the path the link at path points to,
+// or path itself if it is not a link.
+func linkTarget(path string) string {
+	target, err := os.Readlink(path)
+	if err != nil {
+		return path
+	}
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(path), target)
+	}
+	return target
+}
+
+// swaps returns whether Path is ever replaced by another tree,
+// and so is a link to the tree it is.
+func (r *Repo) swaps() bool {
+	return r.Atomic || r.RecloneEvery > 0 || r.RecloneAge > 0
+}
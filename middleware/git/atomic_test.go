@@ -0,0 +1,104 @@
+package git
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy/middleware"
+)
+
+// commitFile commits a file called name with content
+// to the origin of repo.
+func commitFile(t *testing.T, repo *Repo, name, content string) {
+	if err := ioutil.WriteFile(filepath.Join(repo.Url, name), []byte(content), 0644); err != nil {
+		t.Fatalf("Could not write %s: %v", name, err)
+	}
+	for _, args := range [][]string{
+		{"-C", repo.Url, "add", name},
+		{"-C", repo.Url, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", content},
+	} {
+		if out, err := exec.Command(gitBinary, args...).CombinedOutput(); err != nil {
+			t.Fatalf("Could not commit: %v: %s", err, out)
+		}
+	}
+}
+
+func TestSwapIn(t *testing.T) {
+	repo := newTestRepo(t)
+	repo.Atomic = true
+	commitFile(t, repo, "index.html", "first")
+	if err := repo.prepare(); err != nil {
+		t.Fatalf("Expected no error preparing, got %v", err)
+	}
+	if err := repo.ForcePull(); err != nil {
+		t.Fatalf("Expected no error pulling, got %v", err)
+	}
+	commitFile(t, repo, "index.html", "second")
+
+	// a request still being served while the repository
+	// is pulled does not hold up the swap
+	var served string
+	g := Git{
+		Repo: repo,
+		Path: "/",
+		Next: middleware.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			f, err := os.Open(filepath.Join(repo.Path, "index.html"))
+			if err != nil {
+				return http.StatusNotFound, err
+			}
+			defer f.Close()
+			pulled := make(chan error, 1)
+			go func() {
+				pulled <- repo.ForcePull()
+			}()
+			select {
+			case err := <-pulled:
+				if err != nil {
+					return http.StatusInternalServerError, err
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("Expected the pull not to wait for the request")
+			}
+			// the file opened before the swap is still readable
+			content, err := ioutil.ReadAll(f)
+			served = string(content)
+			return http.StatusOK, err
+		}),
+	}
+	r := httptest.NewRequest("GET", "/index.html", nil)
+	if status, err := g.ServeHTTP(httptest.NewRecorder(), r); status != http.StatusOK || err != nil {
+		t.Fatalf("Expected status %d, got %d (%v)", http.StatusOK, status, err)
+	}
+	if served != "first" {
+		t.Errorf("Expected the request to be served from the first tree, got '%s'", served)
+	}
+
+	if content, err := ioutil.ReadFile(filepath.Join(repo.Path, "index.html")); string(content) != "second" {
+		t.Errorf("Expected the second tree after swapping, got '%s' (%v)", content, err)
+	}
+	if info, err := os.Lstat(repo.Path); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("Expected %s to be a link, got %v (%v)", repo.Path, info, err)
+	}
+
+	// only the tree linked to is left next to Path
+	fs, err := ioutil.ReadDir(filepath.Dir(repo.Path))
+	if err != nil {
+		t.Fatalf("Could not list %s: %v", filepath.Dir(repo.Path), err)
+	}
+	var trees []string
+	for _, f := range fs {
+		if strings.HasPrefix(f.Name(), filepath.Base(repo.Path)+".") {
+			trees = append(trees, f.Name())
+		}
+	}
+	if len(trees) != 1 || filepath.Join(filepath.Dir(repo.Path), trees[0]) != linkTarget(repo.Path) {
+		t.Errorf("Expected only the tree %s next to Path, got %v", linkTarget(repo.Path), trees)
+	}
+}
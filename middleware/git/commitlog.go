@@ -0,0 +1,87 @@
+package git
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxLogCount is the most commits commitLog looks up,
+// however many are asked for.
+const maxLogCount = 1000
+
+// maxLogOutput is the most output of git log commitLog
+// reads; a lookup which gives more fails instead.
+const maxLogOutput = 1 << 20
+
+var errLogTooLong = errors.New("Output of git log is too long")
+
+// commitLog returns the metadata of at most count commits of
+// the clone at dir, the most recent first, which rev, like HEAD
+// or a range like abc123..HEAD, leads to. Each commit has a
+// field for each of format, which is a placeholder of git log
+// --format like %H, %ct or %s, in that order. If count is 0 or
+// more than maxLogCount, maxLogCount commits are looked up.
+//
+// Features which need to know about commits look them up here,
+// so that no lookup can read an unbounded log of a huge repo.
+func (r *Repo) commitLog(dir, rev string, count int, format ...string) ([][]string, error) {
+	if strings.HasPrefix(rev, "-") {
+		return nil, fmt.Errorf("Invalid revision %v", rev)
+	}
+	if len(format) == 0 {
+		return nil, errors.New("No commit fields to look up")
+	}
+	if count <= 0 || count > maxLogCount {
+		count = maxLogCount
+	}
+
+	// fields are separated by unit separators
+	// and commits by NUL, which -z gives
+	args := []string{"--no-pager", "log", "-z", "--max-count=" + strconv.Itoa(count),
+		"--format=" + strings.Join(format, "%x1f"), rev}
+	output := &cappedBuffer{max: maxLogOutput}
+	cmd := r.command(gitBinary, args, dir, nil)
+	cmd.Stdout = output
+	err := runTimeout(cmd, r.timeout())
+	if output.exceeded {
+		return nil, errLogTooLong
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// only the newline git may put between records is trimmed,
+	// as fields like %b can start or end with whitespace
+	var commits [][]string
+	for _, commit := range strings.Split(output.String(), "\x00") {
+		if commit = strings.TrimPrefix(commit, "\n"); commit != "" {
+			commits = append(commits, strings.Split(commit, "\x1f"))
+		}
+	}
+	return commits, nil
+}
+
+// cappedBuffer is a buffer which takes at most max bytes.
+// Writes past that fail, so that a command writing more
+// gets an error writing, and exceeded is set. The buffer
+// is not embedded, as io.Copy would use its ReadFrom.
+type cappedBuffer struct {
+	buf      bytes.Buffer
+	max      int
+	exceeded bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if b.buf.Len()+len(p) > b.max {
+		b.exceeded = true
+		return 0, errLogTooLong
+	}
+	return b.buf.Write(p)
+}
+
+func (b *cappedBuffer) String() string {
+	return b.buf.String()
+}
@@ -0,0 +1,114 @@
+package git
+
+import (
+	"io"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newTestLogRepo returns a pulled repo whose commits have the
+// subjects first to fourth, and the hashes of those commits,
+// the most recent first.
+func newTestLogRepo(t *testing.T) (*Repo, []string) {
+	repo := newTestRepo(t)
+	for _, subject := range []string{"second", "third", "fourth"} {
+		commit := exec.Command(gitBinary, "-C", repo.Url, "-c", "user.name=test", "-c", "user.email=test@example.com",
+			"commit", "-q", "--allow-empty", "-m", subject)
+		if out, err := commit.CombinedOutput(); err != nil {
+			t.Fatalf("Could not commit: %v: %s", err, out)
+		}
+	}
+	if err := repo.ForcePull(); err != nil {
+		t.Fatalf("Expected no error pulling, got %v", err)
+	}
+	out, err := exec.Command(gitBinary, "-C", repo.Url, "rev-list", "HEAD").Output()
+	if err != nil {
+		t.Fatalf("Could not list commits: %v", err)
+	}
+	return repo, strings.Fields(string(out))
+}
+
+func TestCommitLog(t *testing.T) {
+	repo, hashes := newTestLogRepo(t)
+
+	tests := []struct {
+		rev      string
+		count    int
+		format   []string
+		expected [][]string
+	}{
+		{"HEAD", 1, []string{"%H"}, [][]string{{hashes[0]}}},
+		{"HEAD", 2, []string{"%s", "%H"}, [][]string{{"fourth", hashes[0]}, {"third", hashes[1]}}},
+		// no count is as many as allowed
+		{"HEAD", 0, []string{"%s"}, [][]string{{"fourth"}, {"third"}, {"second"}, {"first"}}},
+		{hashes[2] + "..HEAD", 10, []string{"%s"}, [][]string{{"fourth"}, {"third"}}},
+		{"HEAD~1", 1, []string{"%an", "%s"}, [][]string{{"test", "third"}}},
+		{"HEAD..HEAD", 1, []string{"%H"}, nil},
+	}
+	for i, test := range tests {
+		commits, err := repo.commitLog(repo.Path, test.rev, test.count, test.format...)
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(commits, test.expected) {
+			t.Errorf("Test %d: Expected commits %q, got %q", i, test.expected, commits)
+		}
+	}
+
+	for i, rev := range []string{"--all", "-p", "nonexistent"} {
+		if _, err := repo.commitLog(repo.Path, rev, 1, "%H"); err == nil {
+			t.Errorf("Test %d: Expected an error looking up %s", i, rev)
+		}
+	}
+	if _, err := repo.commitLog(repo.Path, "HEAD", 1); err == nil {
+		t.Error("Expected an error looking up no fields")
+	}
+
+	if commit, err := repo.getMostRecentCommit(); err != nil || commit != hashes[0] {
+		t.Errorf("Expected most recent commit %s, got %s (%v)", hashes[0], commit, err)
+	}
+}
+
+func TestCommitLogWhitespace(t *testing.T) {
+	repo := newTestRepo(t)
+	message := "padded\n\n  body  \n"
+	commit := exec.Command(gitBinary, "-C", repo.Url, "-c", "user.name=test", "-c", "user.email=test@example.com",
+		"commit", "-q", "--allow-empty", "--cleanup=verbatim", "-m", message)
+	if out, err := commit.CombinedOutput(); err != nil {
+		t.Fatalf("Could not commit: %v: %s", err, out)
+	}
+	if err := repo.ForcePull(); err != nil {
+		t.Fatalf("Expected no error pulling, got %v", err)
+	}
+
+	commits, err := repo.commitLog(repo.Path, "HEAD", 2, "%b", "%s")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	expected := [][]string{{"  body  \n", "padded"}, {"", "first"}}
+	if !reflect.DeepEqual(commits, expected) {
+		t.Errorf("Expected commits %q, got %q", expected, commits)
+	}
+}
+
+func TestCappedBuffer(t *testing.T) {
+	b := &cappedBuffer{max: 8}
+	if n, err := b.Write([]byte("12345")); n != 5 || err != nil {
+		t.Errorf("Expected to write 5 bytes, wrote %d (%v)", n, err)
+	}
+	if _, err := b.Write([]byte("6789")); err != errLogTooLong {
+		t.Errorf("Expected error %v writing past the cap, got %v", errLogTooLong, err)
+	}
+	if !b.exceeded || b.String() != "12345" {
+		t.Errorf("Expected to keep 12345 and be exceeded, got %s (%v)", b.String(), b.exceeded)
+	}
+
+	// as the output of commands is copied
+	b = &cappedBuffer{max: 8}
+	if _, err := io.Copy(b, strings.NewReader("123456789")); err != errLogTooLong {
+		t.Errorf("Expected error %v copying past the cap, got %v", errLogTooLong, err)
+	}
+}
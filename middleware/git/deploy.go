@@ -0,0 +1,40 @@
+package git
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// writeDeployFile writes the most recent commit and the time of
+// the last pull to DeployFile, as "<commit> <time>", the time in
+// RFC 3339 format. The file is replaced atomically, so watchers
+// never read it half written.
+func (r *Repo) writeDeployFile() error {
+	r.state.RLock()
+	content := fmt.Sprintf("%s %s\n", r.lastCommit, r.lastPull.UTC().Format(time.RFC3339))
+	r.state.RUnlock()
+
+	// the temporary file must be on the same
+	// file system for the rename to be atomic
+	dir, name := filepath.Split(r.DeployFile)
+	file, err := ioutil.TempFile(dir, "."+name)
+	if err != nil {
+		return err
+	}
+	if _, err = file.WriteString(content); err == nil {
+		err = file.Chmod(0644)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), r.DeployFile)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
@@ -3,31 +3,274 @@
 // Caddyfile Syntax :
 //	git repo path {
 //		repo
+//		fallback_url url...
 //		path
 //		branch
-//		key
+//		refspec refspec
+//		single_branch
+//		depth commits
+//		shallow_since date
+//		protocol_v2
+//		key [host] path
+//		keyscan_types type...
+//		verify commit|tag [keyring]
+//		token_file path [user]
 //		interval
+//		pull_window start end [bypass]
+//		timeout
+//		lock_file [path]
+//		user name [group]
+//		reclone_every pulls
+//		reclone_age seconds
+//		atomic
 //		then command args
+//		then_if condition command args
+//		then_initial command args
+//		then_dir directory
+//		then_retries count [delay]
+//		deploy_file path
+//		persist_dir directory
+//		preview path [max [age]]
+//		preview_mirror directory
+//		preview_subdomain domain [fallback]
+//		hook path secret [max_body]
+//		trigger_file path
+//		background [retry_after]
+//		manual
+//		fail_on_init_error
+//		metrics path
+//		script_dir directory
+//		browse [template]
+//		commit_header [name]
+//		commit_validators [etag] [last_modified]
+//		id name
 //	}
 //	repo 	- git repository
 // 		compulsory. Both ssh (e.g. git@github.com:user/project.git)
 // 		and https(e.g. https://github.com/user/project) are supported.
 //		Can be specified in either config block or top level
 //
+//	fallback_url - mirrors of the repo to pull from if it cannot be
+//		optional. May be given more than once. The URLs are tried in
+//		order, each pull starting with repo again, and the origin of
+//		the clone is set to the one pulled from. Mirrors are pulled from
+//		with the key of the repo, unless key gives one for their host,
+//		and with its token_file, if any.
+//
 // 	path 	- directory to pull into, relative to site root
 //		optional. Defaults to site root.
 //
 // 	branch 	- git branch or tag
 //		optional. Defaults to master
 //
+//	refspec	- ref to fetch and check out instead of pulling branch
+//		optional. E.g. +refs/pull/42/merge:refs/remotes/origin/pr-42 to
+//		serve the merge commit of a pull request. The repo is cloned with
+//		branch, and then the ref is fetched and checked out, detached from
+//		any branch, on every pull. Patterns with * are not supported.
+//
+//	single_branch - only clone and fetch branch, not the other branches
+//		optional. Makes clones of repos with many branches smaller.
+//
+//	depth	- only clone and fetch the last commits of history
+//	shallow_since - only clone and fetch history since date
+//		optional. Makes clones of repos with a long history smaller, while
+//		keeping some for tools which look at the log. date is one git
+//		understands, like 2020-01-31 or 2.weeks.ago; it may not contain
+//		spaces. Only one of them may be given.
+//
+//	protocol_v2 - pull with version 2 of the git wire protocol
+//		optional. Fetches from repos with many branches or tags faster, as
+//		only the refs needed are sent. Remotes which do not support it, and
+//		git before 2.18, fall back to the original protocol. Newer git uses
+//		version 2 by default.
+//
 // 	key 	- path to private ssh key
 //		optional. Required for private repositories. e.g. /home/user/.ssh/id_rsa
+//		Like token_file, it is read on every pull and must not be accessible
+//		by other users.
+//		May be given for other hosts too, like those of submodules, as
+//		key host path; ssh then only offers the key given for a host.
+//
+//	keyscan_types - types of host keys to trust for ssh repos
+//		optional. Defaults to rsa ecdsa ed25519. The host keys of the hosts
+//		pulled from with key are added to ~/.ssh/known_hosts. type may be
+//		rsa, dsa, ecdsa, ed25519, ecdsa-sk or ed25519-sk.
+//
+//	verify - only serve commits signed by a trusted key
+//		optional. With commit, the commit pulled must be signed; with
+//		tag, a tag pointing at it must be, e.g. for a branch which only
+//		gets released commits. keyring is the GnuPG home directory with
+//		the trusted public keys, and defaults to that of the user git
+//		runs as. A commit which cannot be verified is not checked out;
+//		the previous one keeps being served, and the pull fails. A
+//		first clone which cannot be verified is removed. Preview
+//		branches are not verified. Cannot be used with preview_mirror.
+//
+//	token_file - file with a token to pull a private https repo with
+//		optional. Read on every pull, so a rotated token, e.g. in a mounted
+//		secret, is used without a restart. Sent as the password of user
+//		(default x-access-token). Must not be writable by other users.
 //
 // 	interval- interval between git pulls in seconds
-//		optional. Defaults to 3600 (1 Hour).
+//		optional. Defaults to 3600 (1 Hour). Intervals shorter than 60 seconds
+//		or longer than 604800 (1 week) are brought within those limits.
+//
+//	pull_window - time of day to pull within, e.g. 01:00 05:00
+//		optional. Outside of it, no pulls are done after the initial one,
+//		and pulls triggered by hook or trigger_file are done once it opens,
+//		unless bypass is given. Times are local, as hh:mm; a window which
+//		ends before it starts wraps around midnight.
+//
+//	timeout	- seconds git commands and then may run for before being killed
+//		optional. Defaults to 1800 (30 minutes), the package's DefaultTimeout.
+//		Commands that run longer fail like other failed pulls.
+//
+//	lock_file - file to lock while pulling, for path shared by processes
+//		optional. Defaults to path.lock, next to path. Where several caddy
+//		processes serve the same path, e.g. on NFS, only the one holding
+//		the lock pulls; the others skip the pull and serve the content as
+//		it is. Not supported on Windows.
+//
+//	user	- OS user, and optionally group, to run git and then as
+//		optional. Defaults to the user caddy runs as. Switching users
+//		usually requires running as root, which is checked at startup.
+//		path and key must be accessible by the user; HOME is set to the
+//		home directory of the user.
+//
+//	reclone_every - clone afresh instead of pulling every so many pulls
+//	reclone_age - clone afresh instead of pulling once the clone is this old
+//		optional. The repo is cloned next to path, into path.reclone, which
+//		is then swapped in for path. Then is executed after each fresh clone.
+//
+//	atomic	- pull into a copy of path and swap it in when complete
+//		optional. Requests are served from the previous tree until the pull
+//		is done, instead of from files being updated. The swap waits for
+//		requests being served from path, and requests wait for the swap.
+//		Then is executed after the swap. Needs room for a second copy of
+//		path, and cannot be used with preview_mirror or with previews
+//		inside path.
 //
 //	then	- command to execute after successful pull
 //		optional. If set, will execute only when there are new changes.
+//		May be given more than once; each further command is executed
+//		only if the one before it succeeded.
+//
+//	then_if	- command to execute after then, if condition holds
+//		optional. condition is success, failure or always, or match
+//		pattern to execute command only if the output of the command
+//		executed last matches the regular expression pattern. Commands
+//		are considered in order, each against the one executed last
+//		before it, and the deploy fails if any command executed fails.
+//
+//	then_initial - command to execute once after cloning
+//		optional. For setup which the clone needs, like installing
+//		dependencies, and which then does not repeat on every pull.
+//		Executed before then after the first clone, and after each
+//		fresh clone with reclone_every or reclone_age, but not for a
+//		clone already in path at startup. If it fails, it is executed
+//		again after the next pull, and then is not executed until it
+//		succeeds.
+//
+//	then_dir - directory to execute the then command in, relative to path
+//		optional. Defaults to path. Must exist after the pull.
+//
+//	then_retries - times to retry then if it fails
+//		optional. Defaults to 0, no retries. The first retry is after delay
+//		seconds (default 5), and the delay doubles with each further retry.
+//		Each command of then and then_if is retried on its own. Retries of
+//		git pulls are not affected.
+//
+//	deploy_file - file to write the commit and time to after each deploy
+//		optional. Written after a pull with new changes and a successful
+//		run of then, as "<commit> <time>" with the time in RFC 3339 format.
+//		The file is replaced atomically, so tools watching it, e.g. with
+//		inotify, never read it half written.
+//
+//	persist_dir - directory to keep a copy of path in, e.g. on disk
+//		optional. For path on a tmpfs, so that it need not be cloned
+//		afresh after a reboot. path is copied into directory after each
+//		deploy, and restored from it at startup if it has not been
+//		cloned into. Preview clones are not copied. Cannot be used with
+//		preview_mirror.
+//
+//	preview	- serve other branches of the repo at path/<branch>/
+//		optional. Branches are cloned into <root>/path/<branch> when first
+//		requested. At most max clones (default 10) are kept; clones not
+//		requested within age seconds (default 1 day) are removed.
+//
+//	preview_mirror - check preview branches out of a bare mirror
+//		optional. The repo is mirrored into directory, which should not
+//		be inside the site root, and branches are checked out of it as
+//		worktrees, which take less space than a clone per branch. Pulls
+//		update the mirror and fast-forward the worktrees.
+//
+//	preview_subdomain - serve branches at subdomains of domain as well
+//		optional. Requires preview and preview_mirror. A request for
+//		v1.docs.example.com with domain docs.example.com is served from
+//		the branch v1, like a request for path/v1/. Subdomains which do
+//		not name a branch are served from the fallback branch if given,
+//		or get a 404 response otherwise.
+//
+//	hook	- webhook which triggers a pull when POSTed to
+//		optional. GitHub requests must be signed with secret
+//		(X-Hub-Signature-256) and GitLab requests must carry it
+//		(X-Gitlab-Token); other requests are rejected. Request bodies over
+//		max_body bytes (default 1048576, 1 MiB) get a 413 response.
+//
+//	trigger_file - file which triggers a pull when changed
+//		optional. A pull is done whenever the modification time of the
+//		file changes, e.g. when CI touches it, without an HTTP endpoint.
+//		Changes are checked for every second; a burst of changes within
+//		2 seconds of each other causes a single pull.
+//
+//	background - do the initial pull in the background
+//		optional. Until it succeeds, requests for path get a 503 response
+//		with Retry-After set to retry_after seconds (default 10).
+//
+//	manual	- only pull when triggered by hook or trigger_file
+//		optional. For content put in path by another process, e.g. when
+//		the machine is provisioned: path must already have a clone of the
+//		repo at startup, which is served as it is. There is no initial
+//		pull and no pull every interval. Requires hook or trigger_file,
+//		and cannot be used with background.
+//
+//	fail_on_init_error - refuse to start if the initial clone fails
+//		optional. Startup always fails if the initial pull does, unless
+//		background is set. With background, the repo is then cloned before
+//		startup completes if it has not been cloned into path yet.
+//
+//	metrics	- path to serve pull metrics at in the Prometheus text format
+//		optional. Reports pulls, failed pulls, the time of the last
+//		successful pull, the age of the pulled commit and how long the
+//		last pull and run of the then command took.
+//
+//	script_dir - directory for the temporary scripts used to pull with key
+//		optional. Defaults to the system temporary directory. It is created
+//		with mode 0700 if missing and must not be accessible by other users.
+//
+//	browse	- serve listings of the directories pulled, like the browse directive
+//		optional. Lists directories under path without an index file, with
+//		the template file if given. The .git directory is not served.
+//
+//	commit_header - response header to expose the pulled commit in
+//		optional. Defaults to X-Git-Commit if name is omitted. It is set
+//		on responses to requests for path.
+//
+//	commit_validators - derive cache validators from the pulled commit
+//		optional. Defaults to both if none are given. With etag, the ETag
+//		of successful responses for path is the commit; with last_modified,
+//		their Last-Modified time is the time of the commit, instead of that
+//		of the file, which changes with each checkout. Conditional requests
+//		with the current ones get 304 Not Modified, so clients only fetch
+//		files again after a deploy.
+//
+//	id	- identifies the repo in the commit header, as id@commit
+//		optional. If several repos are configured, defaults to the name
+//		of the repo, e.g. myproject for github.com/user/myproject.
+//
+// repo, branch, key, then and then_if may refer to environment variables as
+// {env.NAME}; it is an error if a variable is not set.
 //
 // Examples :
 //
@@ -61,6 +304,15 @@
 //
 //	root /var/www/html/myphpsite
 //
+// Two repos feeding one site; responses for /docs carry the commit
+// of the docs repo, e.g. X-Git-Commit: docs@<commit>.
+//	git github.com/user/site {
+//		commit_header
+//	}
+//	git github.com/user/docs docs {
+//		commit_header
+//	}
+//
 // A pull is first attempted after initialization. Afterwards, a pull is attempted
 // after request to server and if time taken since last successful pull is higher than interval.
 //
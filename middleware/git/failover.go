@@ -0,0 +1,89 @@
+package git
+
+import (
+	"os"
+	"strings"
+)
+
+// urls returns the URLs r may be pulled from, in
+// the order they are tried: Url, then FallbackUrls.
+func (r *Repo) urls() []string {
+	return append([]string{r.Url}, r.FallbackUrls...)
+}
+
+// remoteUrl returns the URL r is being pulled from.
+func (r *Repo) remoteUrl() string {
+	if r.remote == "" {
+		return r.Url
+	}
+	return r.remote
+}
+
+// failover runs pull, which pulls from remoteUrl, with each of the
+// URLs of r in turn until it succeeds, and returns the error of the
+// last URL if none does. Each pull starts with Url again, so that r
+// goes back to it once it is up.
+func (r *Repo) failover(pull func() error) error {
+	if len(r.FallbackUrls) == 0 {
+		return pull()
+	}
+	var err error
+	for i, url := range r.urls() {
+		if i > 0 {
+			logger().Printf("Pulling from %v failed, trying %v: %v\n", r.remoteUrl(), url, err)
+		}
+		if err = r.setRemote(url); err == nil {
+			err = pull()
+		}
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// setRemote makes url the URL r is pulled from, and the
+// origin of its clone or mirror if there is one already.
+func (r *Repo) setRemote(url string) error {
+	r.remote = url
+	dir := r.Path
+	if r.mirror != nil {
+		// shared with the preview worktrees
+		r.mirror.mu.Lock()
+		defer r.mirror.mu.Unlock()
+		dir = r.mirror.dir
+	}
+	if _, err := os.Stat(dir); err != nil || !r.pulled && r.mirror == nil {
+		// cloned from url
+		return nil
+	}
+	if current, err := r.runCmdOutput(gitBinary, []string{"config", "--get", "remote.origin.url"}, dir); err == nil && current == url {
+		return nil
+	}
+	return r.runCmd(gitBinary, []string{"remote", "set-url", "origin", url}, dir)
+}
+
+// fallbackHosts returns the hosts of FallbackUrls. They are pulled
+// from with KeyPath, unless HostKeys has a key for them.
+func (r *Repo) fallbackHosts() []string {
+	var hosts []string
+	for _, url := range r.FallbackUrls {
+		// sanitized to https://host/path or git@host:path
+		host := strings.TrimPrefix(strings.TrimPrefix(url, "https://"), "git@")
+		if i := strings.IndexAny(host, "/:"); i >= 0 {
+			host = host[:i]
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts
+}
+
+// isUrl returns whether url is one of the URLs of r.
+func (r *Repo) isUrl(url string) bool {
+	for _, u := range r.urls() {
+		if u == url {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,32 @@
+//go:build !windows
+// +build !windows
+
+package git
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive lock on the file called name,
+// creating it if needed, so that other processes locking it
+// know a pull is in progress. It does not wait for the lock,
+// but returns errLocked if another process holds it. The
+// returned function releases the lock.
+func lockFile(name string) (func(), error) {
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, errLocked
+		}
+		return nil, err
+	}
+	return func() {
+		syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		file.Close()
+	}, nil
+}
@@ -0,0 +1,9 @@
+package git
+
+import "errors"
+
+// lockFile is not supported on Windows, where
+// repos cannot be configured with a lock file.
+func lockFile(name string) (func(), error) {
+	return nil, errors.New("Lock files are not supported on Windows")
+}
@@ -3,15 +3,20 @@ package git
 import (
 	"fmt"
 	"log"
+	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/mholt/caddy/middleware"
+	"github.com/mholt/caddy/middleware/browse"
 )
 
 // Logger is used to log errors; if nil, the default log.Logger is used.
@@ -19,40 +24,174 @@ var Logger *log.Logger
 
 // New creates a new instance of git middleware.
 func New(c middleware.Controller) (middleware.Middleware, error) {
-	repo, err := parse(c)
+	repos, err := parse(c, false)
 	if err != nil {
 		return nil, err
 	}
 
+	gits := make([]Git, len(repos))
+	for i, repo := range repos {
+		startup(c, repo)
+
+		// URL path at which the repository is served
+		path := "/"
+		if rel, err := filepath.Rel(c.Root(), repo.Path); err == nil && rel != "." {
+			path += filepath.ToSlash(rel)
+		}
+		gits[i] = Git{Repo: repo, Path: path}
+
+		if repo.Browse {
+			bc, err := browse.NewConfig(path, repo.BrowseTemplate)
+			if err != nil {
+				return nil, err
+			}
+			bc.Hidden = []string{".git"}
+			gits[i].browse = &browse.Browse{Root: c.Root(), Configs: []browse.BrowseConfig{bc}}
+		}
+	}
+
+	// Repositories served at longer paths are chained closer to
+	// the site, so their commit header wins for requests under them.
+	sort.Stable(byPathLength(gits))
+
+	return func(next middleware.Handler) middleware.Handler {
+		for _, g := range gits {
+			g.Next = next
+			if g.browse != nil {
+				b := *g.browse
+				b.Next = next
+				g.Next = b
+			}
+			next = g
+		}
+		return next
+	}, nil
+}
+
+// startup registers the initial pull of repo and
+// the routine which keeps it pulled afterwards.
+func startup(c middleware.Controller, repo *Repo) {
 	c.Startup(func() error {
+		if repo.ManualOnly {
+			// the clone in path is served as it is until a trigger
+			go repo.schedule()
+			if repo.TriggerFile != "" {
+				go repo.watchTrigger()
+			}
+			return nil
+		}
+
+		// Without a checkout to serve yet, FailOnInitError
+		// needs the initial pull to be done right away.
+		background := repo.Background && (!repo.FailOnInitError || repo.Pulled())
+
 		// Startup functions are blocking; start
 		// service routine in background
 		go func() {
-			for {
-				time.Sleep(repo.Interval)
-
-				err := repo.Pull()
-				if err != nil {
-					if Logger == nil {
-						log.Println(err)
-					} else {
-						Logger.Println(err)
-					}
+			if background {
+				if err := repo.Pull(); err != nil {
+					logger().Println(err)
 				}
 			}
+			repo.schedule()
 		}()
 
+		if repo.TriggerFile != "" {
+			go repo.watchTrigger()
+		}
+
+		if background {
+			return nil
+		}
+
 		// Do a pull right away to return error
 		return repo.Pull()
 	})
+}
+
+// byPathLength sorts Git handlers by the length of their
+// path, longest first.
+type byPathLength []Git
 
-	return nil, err
+func (g byPathLength) Len() int           { return len(g) }
+func (g byPathLength) Swap(i, j int)      { g[i], g[j] = g[j], g[i] }
+func (g byPathLength) Less(i, j int) bool { return len(g[i].Path) > len(g[j].Path) }
+
+// Git is middleware that serves requests related to
+// the git repository it keeps pulled.
+type Git struct {
+	Next middleware.Handler
+	Repo *Repo
+	Path string // URL path the repository is served at
+
+	browse *browse.Browse // lists the pulled files if Repo.Browse
 }
 
-func parse(c middleware.Controller) (*Repo, error) {
-	repo := &Repo{Branch: "master", Interval: DefaultInterval, Path: c.Root()}
+// ServeHTTP implements the middleware.Handler interface.
+func (g Git) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	if g.Repo.HookUrl != "" && r.URL.Path == g.Repo.HookUrl {
+		return g.serveHook(w, r)
+	}
+	if g.Repo.MetricsUrl != "" && r.URL.Path == g.Repo.MetricsUrl {
+		return g.serveMetrics(w, r)
+	}
+	if g.Repo.CommitHeader != "" && middleware.Path(r.URL.Path).Matches(g.Path) {
+		if commit := g.Repo.commitId(); commit != "" {
+			w.Header().Set(g.Repo.CommitHeader, commit)
+		}
+	}
+	if g.Repo.Background && !g.Repo.Pulled() && middleware.Path(r.URL.Path).Matches(g.Path) {
+		// the initial pull is still in progress
+		w.Header().Set("Retry-After", strconv.Itoa(g.Repo.RetryAfter))
+		return http.StatusServiceUnavailable, nil
+	}
+	if (g.Repo.CommitETag || g.Repo.CommitModTime) && middleware.Path(r.URL.Path).Matches(g.Path) {
+		var ok bool
+		if w, ok = g.serveValidated(w, r); !ok {
+			return http.StatusNotModified, nil
+		}
+	}
+	if g.Repo.Browse && middleware.Path(r.URL.Path).Matches(path.Join(g.Path, ".git")) {
+		// keep the repository internals out of the listings
+		return http.StatusNotFound, nil
+	}
+	if p := g.Repo.Previews; p != nil && p.Domain != "" {
+		if ok, status, err := p.serveSubdomain(r); ok {
+			if status >= 400 {
+				return status, err
+			}
+			return g.Next.ServeHTTP(w, r)
+		}
+	}
+	if p := g.Repo.Previews; p != nil && middleware.Path(r.URL.Path).Matches(p.Path) {
+		if status, err := p.serve(r.URL.Path); status >= 400 {
+			return status, err
+		}
+	}
+	return g.Next.ServeHTTP(w, r)
+}
+
+// Validate parses and validates the git configuration of c like New,
+// without any side effects: git is not looked for, nothing is cloned,
+// created or looked up, and no startup functions are registered.
+// Errors are returned as a *middleware.ParseError.
+func Validate(c middleware.Controller) error {
+	if _, err := parse(c, true); err != nil {
+		if _, ok := err.(*middleware.ParseError); !ok {
+			err = c.Err(err.Error())
+		}
+		return err
+	}
+	return nil
+}
+
+// parse parses the repos configured in c. With dryRun, they
+// are only validated and not prepared for pulling.
+func parse(c middleware.Controller, dryRun bool) ([]*Repo, error) {
+	var repos []*Repo
 
 	for c.Next() {
+		repo := &Repo{Branch: "master", Interval: DefaultInterval, Path: c.Root()}
 		args := c.RemainingArgs()
 
 		switch len(args) {
@@ -63,6 +202,9 @@ func parse(c middleware.Controller) (*Repo, error) {
 			repo.Url = args[0]
 		}
 
+		var previewMirror string
+		var previewSubdomain []string
+		var useLockFile bool
 		for c.NextBlock() {
 			switch c.Val() {
 			case "repo":
@@ -75,64 +217,615 @@ func parse(c middleware.Controller) (*Repo, error) {
 					return nil, c.ArgErr()
 				}
 				repo.Path = filepath.Clean(c.Root() + string(filepath.Separator) + c.Val())
+			case "fallback_url":
+				urls := c.RemainingArgs()
+				if len(urls) == 0 {
+					return nil, c.ArgErr()
+				}
+				repo.FallbackUrls = append(repo.FallbackUrls, urls...)
 			case "branch":
 				if !c.NextArg() {
 					return nil, c.ArgErr()
 				}
 				repo.Branch = c.Val()
-			case "key":
+			case "refspec":
 				if !c.NextArg() {
 					return nil, c.ArgErr()
 				}
-				repo.KeyPath = c.Val()
+				if err := checkRefspec(c.Val()); err != nil {
+					return nil, c.Err(err.Error())
+				}
+				repo.Refspec = c.Val()
+			case "keyscan_types":
+				types := c.RemainingArgs()
+				if len(types) == 0 {
+					return nil, c.ArgErr()
+				}
+				for _, t := range types {
+					if !keyscanTypes[t] {
+						return nil, c.Err("Invalid keyscan type " + t)
+					}
+				}
+				repo.KeyscanTypes = strings.Join(types, ",")
+			case "verify":
+				args := c.RemainingArgs()
+				if len(args) == 0 || len(args) > 2 {
+					return nil, c.ArgErr()
+				}
+				if args[0] != VerifyCommit && args[0] != VerifyTag {
+					return nil, c.Err("Invalid signature to verify " + args[0] + ", expected commit or tag")
+				}
+				repo.Verify = args[0]
+				if len(args) > 1 {
+					keyring, err := filepath.Abs(args[1])
+					if err != nil {
+						return nil, c.Err(err.Error())
+					}
+					repo.VerifyKeyring = keyring
+				}
+			case "key":
+				args := c.RemainingArgs()
+				switch len(args) {
+				case 1:
+					repo.KeyPath = args[0]
+				case 2:
+					if repo.HostKeys == nil {
+						repo.HostKeys = make(map[string]string)
+					}
+					repo.HostKeys[args[0]] = args[1]
+				default:
+					return nil, c.ArgErr()
+				}
+			case "token_file":
+				args := c.RemainingArgs()
+				if len(args) == 0 || len(args) > 2 {
+					return nil, c.ArgErr()
+				}
+				repo.TokenFile = args[0]
+				if len(args) > 1 {
+					repo.TokenUser = args[1]
+				}
 			case "interval":
 				if !c.NextArg() {
 					return nil, c.ArgErr()
 				}
-				t, _ := strconv.Atoi(c.Val())
-				if t > 0 {
-					repo.Interval = time.Duration(t) * time.Second
+				t, err := strconv.Atoi(c.Val())
+				if err != nil || t < 1 {
+					return nil, c.Err("Invalid interval " + c.Val())
+				}
+				repo.Interval = checkInterval(time.Duration(t) * time.Second)
+			case "timeout":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				t, err := strconv.Atoi(c.Val())
+				if err != nil || t < 1 {
+					return nil, c.Err("Invalid timeout " + c.Val())
+				}
+				repo.Timeout = time.Duration(t) * time.Second
+			case "pull_window":
+				// pull_window start end [bypass]
+				args := c.RemainingArgs()
+				if len(args) < 2 || len(args) > 3 || (len(args) == 3 && args[2] != "bypass") {
+					return nil, c.ArgErr()
+				}
+				start, err := parseClock(args[0])
+				if err != nil {
+					return nil, c.Err(err.Error())
+				}
+				end, err := parseClock(args[1])
+				if err != nil {
+					return nil, c.Err(err.Error())
+				}
+				if start == end {
+					return nil, c.Err("pull_window must not be empty")
+				}
+				repo.Window = &PullWindow{Start: start, End: end, Bypass: len(args) == 3}
+			case "atomic":
+				repo.Atomic = true
+			case "reclone_every":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				n, err := strconv.Atoi(c.Val())
+				if err != nil || n < 1 {
+					return nil, c.Err("Invalid number of pulls " + c.Val())
 				}
+				repo.RecloneEvery = n
+			case "reclone_age":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				t, err := strconv.Atoi(c.Val())
+				if err != nil || t < 1 {
+					return nil, c.Err("Invalid reclone age " + c.Val())
+				}
+				repo.RecloneAge = time.Duration(t) * time.Second
 			case "then":
 				thenArgs := c.RemainingArgs()
 				if len(thenArgs) == 0 {
 					return nil, c.ArgErr()
 				}
-				repo.Then = strings.Join(thenArgs, " ")
+				if repo.Then == "" {
+					repo.Then = strings.Join(thenArgs, " ")
+				} else {
+					// further commands run if the one before succeeded
+					repo.ThenSteps = append(repo.ThenSteps, ThenStep{
+						Command: strings.Join(thenArgs, " "),
+						When:    ThenOnSuccess,
+					})
+				}
+			case "then_initial":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return nil, c.ArgErr()
+				}
+				repo.ThenInitial = strings.Join(args, " ")
+			case "then_if":
+				// then_if success|failure|always command args
+				// then_if match pattern command args
+				args := c.RemainingArgs()
+				if len(args) < 2 {
+					return nil, c.ArgErr()
+				}
+				if repo.Then == "" {
+					return nil, c.Err("then_if must follow then")
+				}
+				step := ThenStep{When: args[0]}
+				switch args[0] {
+				case ThenOnSuccess, ThenOnFailure, ThenAlways:
+					args = args[1:]
+				case "match":
+					if len(args) < 3 {
+						return nil, c.ArgErr()
+					}
+					re, err := regexp.Compile(args[1])
+					if err != nil {
+						return nil, c.Err("Invalid then_if pattern " + args[1] + ": " + err.Error())
+					}
+					step.Match = re
+					args = args[2:]
+				default:
+					return nil, c.Err("Invalid then_if condition " + args[0])
+				}
+				step.Command = strings.Join(args, " ")
+				repo.ThenSteps = append(repo.ThenSteps, step)
+			case "lock_file":
+				useLockFile = true
+				if c.NextArg() {
+					repo.LockFile = filepath.Clean(c.Val())
+				}
+			case "persist_dir":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				dir, err := filepath.Abs(c.Val())
+				if err != nil {
+					return nil, c.Err(err.Error())
+				}
+				repo.PersistDir = dir
+			case "then_dir":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				dir := filepath.Clean(c.Val())
+				if filepath.IsAbs(dir) || strings.HasPrefix(dir, "..") {
+					return nil, c.Err("then_dir must be a directory inside the repository path")
+				}
+				repo.ThenDir = dir
+			case "then_retries":
+				// then_retries count [delay]
+				args := c.RemainingArgs()
+				if len(args) == 0 || len(args) > 2 {
+					return nil, c.ArgErr()
+				}
+				n, err := strconv.Atoi(args[0])
+				if err != nil || n < 0 {
+					return nil, c.Err("Invalid then_retries count " + args[0])
+				}
+				repo.ThenRetries = n
+				repo.ThenRetryDelay = DefaultThenRetryDelay
+				if len(args) > 1 {
+					t, err := strconv.Atoi(args[1])
+					if err != nil || t < 0 {
+						return nil, c.Err("Invalid then_retries delay " + args[1])
+					}
+					repo.ThenRetryDelay = time.Duration(t) * time.Second
+				}
+			case "preview":
+				args := c.RemainingArgs()
+				if len(args) == 0 || len(args) > 3 {
+					return nil, c.ArgErr()
+				}
+				previews := &Previews{
+					Path:   "/" + strings.Trim(args[0], "/"),
+					Max:    DefaultPreviewMax,
+					MaxAge: DefaultInterval * 24,
+					repo:   repo,
+				}
+				previews.Dir = filepath.Join(c.Root(), filepath.FromSlash(previews.Path))
+				if len(args) > 1 {
+					n, err := strconv.Atoi(args[1])
+					if err != nil || n < 1 {
+						return nil, c.Err("Invalid number of preview clones " + args[1])
+					}
+					previews.Max = n
+				}
+				if len(args) > 2 {
+					t, err := strconv.Atoi(args[2])
+					if err != nil || t < 0 {
+						return nil, c.Err("Invalid preview age " + args[2])
+					}
+					previews.MaxAge = time.Duration(t) * time.Second
+				}
+				repo.Previews = previews
+			case "preview_mirror":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				previewMirror = filepath.Clean(c.Val())
+			case "preview_subdomain":
+				// preview_subdomain domain [fallback]
+				previewSubdomain = c.RemainingArgs()
+				if len(previewSubdomain) == 0 || len(previewSubdomain) > 2 {
+					return nil, c.ArgErr()
+				}
+			case "background":
+				repo.Background = true
+				repo.RetryAfter = DefaultRetryAfter
+				if c.NextArg() {
+					t, err := strconv.Atoi(c.Val())
+					if err != nil || t < 0 {
+						return nil, c.Err("Invalid retry after seconds " + c.Val())
+					}
+					repo.RetryAfter = t
+				}
+			case "deploy_file":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				repo.DeployFile = filepath.Clean(c.Val())
+			case "metrics":
+				if !c.Args(&repo.MetricsUrl) {
+					return nil, c.ArgErr()
+				}
+			case "script_dir":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				repo.ScriptDir = filepath.Clean(c.Val())
+			case "hook":
+				if !c.Args(&repo.HookUrl, &repo.HookSecret) {
+					return nil, c.ArgErr()
+				}
+				if c.NextArg() {
+					maxBody, err := strconv.ParseInt(c.Val(), 10, 64)
+					if err != nil || maxBody < 1 {
+						return nil, c.Err("Invalid hook max_body " + c.Val())
+					}
+					repo.HookMaxBody = maxBody
+				}
+			case "trigger_file":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				repo.TriggerFile = filepath.Clean(c.Val())
+			case "user":
+				args := c.RemainingArgs()
+				if len(args) == 0 || len(args) > 2 {
+					return nil, c.ArgErr()
+				}
+				repo.User = args[0]
+				if len(args) > 1 {
+					repo.Group = args[1]
+				}
+			case "protocol_v2":
+				repo.ProtocolV2 = true
+			case "single_branch":
+				repo.SingleBranch = true
+			case "depth":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				n, err := strconv.Atoi(c.Val())
+				if err != nil || n < 1 {
+					return nil, c.Err("Invalid depth " + c.Val())
+				}
+				repo.Depth = n
+			case "shallow_since":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				// the date ends up in a shell script for ssh pulls
+				if !shallowSinceDate.MatchString(c.Val()) {
+					return nil, c.Err("Invalid shallow_since date " + c.Val())
+				}
+				repo.ShallowSince = c.Val()
+			case "manual":
+				repo.ManualOnly = true
+			case "fail_on_init_error":
+				repo.FailOnInitError = true
+			case "browse":
+				repo.Browse = true
+				if c.NextArg() {
+					repo.BrowseTemplate = c.Val()
+				}
+			case "commit_header":
+				repo.CommitHeader = DefaultCommitHeader
+				if c.NextArg() {
+					repo.CommitHeader = c.Val()
+				}
+			case "commit_validators":
+				// commit_validators [etag] [last_modified]
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					args = []string{"etag", "last_modified"}
+				}
+				for _, arg := range args {
+					switch arg {
+					case "etag":
+						repo.CommitETag = true
+					case "last_modified":
+						repo.CommitModTime = true
+					default:
+						return nil, c.Err("Invalid commit_validators " + arg + ", expected etag or last_modified")
+					}
+				}
+			case "id":
+				if !c.Args(&repo.Id) {
+					return nil, c.ArgErr()
+				}
+			}
+		}
+
+		if useLockFile {
+			if runtime.GOOS == "windows" {
+				return nil, c.Err("lock_file is not supported on Windows")
+			}
+			if repo.LockFile == "" {
+				// next to path, so it is neither served
+				// nor in the way of cloning into path
+				repo.LockFile = repo.Path + ".lock"
+			}
+		}
+
+		if previewMirror != "" {
+			if repo.Previews == nil {
+				return nil, c.Err("preview_mirror requires preview")
+			}
+			repo.Previews.Mirror = previewMirror
+		}
+		if len(previewSubdomain) > 0 {
+			// branches are checked out on demand for any
+			// subdomain, so keep them cheap
+			if repo.Previews == nil || repo.Previews.Mirror == "" {
+				return nil, c.Err("preview_subdomain requires preview and preview_mirror")
+			}
+			repo.Previews.Domain = strings.Trim(previewSubdomain[0], ".")
+			if len(previewSubdomain) > 1 {
+				if !previewBranchName.MatchString(previewSubdomain[1]) {
+					return nil, c.Err("Invalid preview_subdomain fallback branch " + previewSubdomain[1])
+				}
+				repo.Previews.Fallback = previewSubdomain[1]
+			}
+		}
+
+		if repo.ManualOnly && repo.HookUrl == "" && repo.TriggerFile == "" {
+			return nil, c.Err("manual requires hook or trigger_file to pull with")
+		}
+		if repo.ManualOnly && repo.Background {
+			return nil, c.Err("manual and background cannot be used together")
+		}
+		if repo.Depth > 0 && repo.ShallowSince != "" {
+			return nil, c.Err("depth and shallow_since cannot be used together")
+		}
+		if repo.Atomic {
+			// the copy pulled into is a clone, not a worktree,
+			// and preview clones inside path are not copied
+			if repo.Previews != nil && (repo.Previews.Mirror != "" || within(repo.Previews.Dir, repo.Path)) {
+				return nil, c.Err("atomic cannot be used with preview_mirror or previews inside path")
+			}
+		}
+		if repo.Verify != "" && repo.Previews != nil && repo.Previews.Mirror != "" {
+			// path is a worktree, which is not pulled into
+			return nil, c.Err("verify cannot be used with preview_mirror")
+		}
+		if repo.PersistDir != "" {
+			// worktrees depend on the mirror they are checked out of
+			if repo.Previews != nil && repo.Previews.Mirror != "" {
+				return nil, c.Err("persist_dir cannot be used with preview_mirror")
+			}
+			if within(repo.PersistDir, repo.Path) || within(repo.Path, repo.PersistDir) {
+				return nil, c.Err("persist_dir must be outside of the repository path")
 			}
 		}
+
+		if err := prepareRepo(c, repo, dryRun); err != nil {
+			return nil, err
+		}
+		repos = append(repos, repo)
+	}
+
+	if len(repos) == 0 {
+		return nil, c.ArgErr()
+	}
+
+	// with several repositories, the commit header
+	// needs to tell which one the commit is from
+	if len(repos) > 1 {
+		for _, repo := range repos {
+			if repo.Id == "" {
+				repo.Id = strings.TrimSuffix(path.Base(repo.Url), ".git")
+			}
+		}
+	}
+
+	return repos, nil
+}
+
+// prepareRepo validates the configuration of repo and prepares
+// it for the initial pull, unless only validating with dryRun.
+func prepareRepo(c middleware.Controller, repo *Repo, dryRun bool) error {
+	// expand environment variables, so the same
+	// config can be used in different environments
+	for _, field := range []*string{&repo.Url, &repo.Branch, &repo.KeyPath, &repo.TokenFile, &repo.Then, &repo.ThenInitial} {
+		var err error
+		if *field, err = expandEnv(*field); err != nil {
+			return c.Err(err.Error())
+		}
+	}
+	for i := range repo.ThenSteps {
+		var err error
+		if repo.ThenSteps[i].Command, err = expandEnv(repo.ThenSteps[i].Command); err != nil {
+			return c.Err(err.Error())
+		}
+	}
+	for host, key := range repo.HostKeys {
+		var err error
+		if repo.HostKeys[host], err = expandEnv(key); err != nil {
+			return c.Err(err.Error())
+		}
+	}
+	for i := range repo.FallbackUrls {
+		var err error
+		if repo.FallbackUrls[i], err = expandEnv(repo.FallbackUrls[i]); err != nil {
+			return c.Err(err.Error())
+		}
 	}
 
 	// if repo is not specified, return error
 	if repo.Url == "" {
-		return nil, c.ArgErr()
+		return c.ArgErr()
 	}
 
 	// if private key is not specified, convert repository url to https
 	// to avoid ssh authentication
 	// else validate git url
 	// Note: private key support not yet available on Windows
-	var err error
-	if repo.KeyPath == "" {
-		repo.Url, repo.Host, err = sanitizeHttp(repo.Url)
-	} else {
-		repo.Url, repo.Host, err = sanitizeGit(repo.Url)
+	sanitize := sanitizeHttp
+	if repo.KeyPath != "" || len(repo.HostKeys) > 0 {
+		sanitize = sanitizeGit
 		// TODO add Windows support for private repos
 		if runtime.GOOS == "windows" {
-			return nil, fmt.Errorf("Private repository not yet supported on Windows")
+			return fmt.Errorf("Private repository not yet supported on Windows")
+		}
+	}
+	var err error
+	if repo.Url, repo.Host, err = sanitize(repo.Url); err != nil {
+		return err
+	}
+	for i, url := range repo.FallbackUrls {
+		if repo.FallbackUrls[i], _, err = sanitize(url); err != nil {
+			return err
 		}
 	}
 
-	if err != nil {
-		return nil, err
+	if repo.TokenFile != "" {
+		if repo.KeyPath != "" || len(repo.HostKeys) > 0 {
+			return c.Err("A repo is either pulled with a key or a token_file")
+		}
+	}
+
+	// the key given for the host of the repo is its key
+	if key, ok := repo.HostKeys[repo.Host]; ok {
+		repo.KeyPath = key
+	}
+	if repo.KeyPath == "" && len(repo.HostKeys) > 0 {
+		return fmt.Errorf("No key given for %v", repo.Host)
+	}
+
+	if repo.User != "" && runtime.GOOS == "windows" {
+		return fmt.Errorf("Running git as another user is not supported on Windows")
+	}
+
+	// everything else depends on the machine
+	// caddy runs on, or changes it
+	if dryRun {
+		return nil
+	}
+
+	if repo.TokenFile != "" {
+		if err = checkSecretFile(repo.TokenFile, 0022); err != nil {
+			return err
+		}
+	}
+
+	if repo.User != "" {
+		if repo.runAs, err = lookupUser(repo.User, repo.Group); err != nil {
+			return c.Err(err.Error())
+		}
+	}
+
+	if repo.ScriptDir != "" {
+		if err = prepareScriptDir(repo.ScriptDir); err != nil {
+			return err
+		}
+		if repo.runAs != nil {
+			// the user needs to be able to run the scripts in it
+			if err = os.Chown(repo.ScriptDir, int(repo.runAs.uid), int(repo.runAs.gid)); err != nil {
+				return err
+			}
+		}
 	}
 
 	// validate git availability in PATH
 	if err = initGit(); err != nil {
-		return nil, err
+		return err
 	}
 
-	return repo, repo.prepare()
+	// fail at startup if the user cannot be switched to
+	if repo.runAs != nil {
+		if err = repo.checkUser(); err != nil {
+			return err
+		}
+	}
+
+	if err = repo.prepare(); err != nil {
+		return err
+	}
+	if repo.ManualOnly {
+		// there is no initial pull to clone
+		if !repo.Pulled() {
+			return fmt.Errorf("No clone of %v in %v, which manual needs", repo.Url, repo.Path)
+		}
+		// served until the first pull, which then compares to it
+		commit, err := repo.getMostRecentCommit()
+		if err != nil {
+			return err
+		}
+		repo.state.Lock()
+		repo.lastCommit = commit
+		repo.state.Unlock()
+	}
+	return nil
+}
+
+// shallowSinceDate matches the dates shallow_since accepts, like
+// 2020-01-31, 2020-01-31T12:00:00+01:00 or 2.weeks.ago.
+var shallowSinceDate = regexp.MustCompile(`^[0-9A-Za-z.:+-]+$`)
+
+// keyscanTypes are the host key types ssh-keyscan can ask for.
+var keyscanTypes = map[string]bool{
+	"dsa":        true,
+	"ecdsa":      true,
+	"ecdsa-sk":   true,
+	"ed25519":    true,
+	"ed25519-sk": true,
+	"rsa":        true,
+}
+
+// within returns whether the directory dir is, or is inside, parent.
+func within(dir, parent string) bool {
+	// relative paths are relative to the working directory
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	if parent, err = filepath.Abs(parent); err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(parent, dir)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
 }
 
 // sanitizeHttp cleans up repository url and converts to https format
@@ -173,6 +866,57 @@ func sanitizeGit(repoUrl string) (string, string, error) {
 	return repoUrl, host, nil
 }
 
+// envPlaceholder matches {env.NAME} placeholders.
+var envPlaceholder = regexp.MustCompile(`\{env\.([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces {env.NAME} placeholders in s with the value of
+// the environment variable NAME. It fails if a variable is not set.
+func expandEnv(s string) (string, error) {
+	var err error
+	s = envPlaceholder.ReplaceAllStringFunc(s, func(placeholder string) string {
+		name := envPlaceholder.FindStringSubmatch(placeholder)[1]
+		value, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = fmt.Errorf("Environment variable %v is not set", name)
+		}
+		return value
+	})
+	return s, err
+}
+
+// prepareScriptDir creates dir for temporary scripts if it does
+// not exist, and makes sure it is private to the current user.
+func prepareScriptDir(dir string) error {
+	if err := os.MkdirAll(dir, os.FileMode(0700)); err != nil {
+		return err
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("Script directory %v is not a directory", dir)
+	}
+	if fi.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("Script directory %v must not be accessible by other users (mode %v)", dir, fi.Mode().Perm())
+	}
+	return nil
+}
+
+// checkInterval returns interval, brought within MinInterval
+// and MaxInterval with a warning if it is outside them.
+func checkInterval(interval time.Duration) time.Duration {
+	if interval < MinInterval {
+		logger().Printf("Interval %v is too short, pulling every %v instead.\n", interval, MinInterval)
+		return MinInterval
+	}
+	if interval > MaxInterval {
+		logger().Printf("Interval %v is too long, pulling every %v instead.\n", interval, MaxInterval)
+		return MaxInterval
+	}
+	return interval
+}
+
 // logger is an helper function to retrieve the available logger
 func logger() *log.Logger {
 	if Logger == nil {
@@ -2,45 +2,173 @@ package git
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
-
-	"github.com/mholt/caddy/middleware"
 )
 
 // DefaultInterval is the minimum interval to delay before
 // requesting another git pull
 const DefaultInterval time.Duration = time.Hour * 1
 
+// MinInterval and MaxInterval are the shortest and longest intervals
+// that may be configured; shorter intervals would hammer the remote,
+// and longer ones are more likely typos than meant to stop pulling.
+const (
+	MinInterval = time.Minute
+	MaxInterval = time.Hour * 24 * 7
+)
+
+// DefaultCommitHeader is the response header the pulled
+// commit is exposed in if commit_header has no name.
+const DefaultCommitHeader = "X-Git-Commit"
+
+// DefaultRetryAfter is the default number of seconds clients are
+// asked to wait for when requesting content before the initial pull.
+const DefaultRetryAfter = 10
+
+// DefaultHookMaxBody is the largest webhook request body, in bytes,
+// read for repos without a limit of their own. Larger requests are
+// rejected with 413 Request Entity Too Large.
+const DefaultHookMaxBody = 1 << 20
+
+// DefaultThenRetryDelay is how long to wait before the first retry
+// of a failed then command if then_retries gives no delay. The delay
+// doubles with each further retry.
+const DefaultThenRetryDelay = 5 * time.Second
+
+// DefaultKeyscanTypes are the types of host keys asked for with
+// ssh-keyscan for repos without types of their own. DSA keys are
+// not, as current servers no longer offer them.
+const DefaultKeyscanTypes = "rsa,ecdsa,ed25519"
+
+// DefaultTimeout is how long git commands and the then command
+// may run for repos without a timeout before they are killed, so
+// that a hanging pull does not block its repo forever. It may be
+// changed before the repos are set up; zero disables it.
+var DefaultTimeout = 30 * time.Minute
+
 // Number of retries if git pull fails
 const numRetries = 3
 
 // gitBinary holds the absolute path to git executable
 var gitBinary string
 
+// errLocked is returned by lockFile if
+// another process holds the lock.
+var errLocked = errors.New("locked by another process")
+
 // initMutex prevents parallel attempt to validate
 // git availability in PATH
 var initMutex sync.Mutex = sync.Mutex{}
 
+// pathLocks serializes pulls into the same directory, even by
+// different repos, so that they do not run git on the same working
+// tree at once. Pulls into other directories are not held up.
+var pathLocks = struct {
+	sync.Mutex
+	m map[string]*sync.Mutex
+}{m: make(map[string]*sync.Mutex)}
+
+// pathLock returns the lock for pulls into dir.
+func pathLock(dir string) *sync.Mutex {
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	pathLocks.Lock()
+	defer pathLocks.Unlock()
+	mu, ok := pathLocks.m[dir]
+	if !ok {
+		mu = new(sync.Mutex)
+		pathLocks.m[dir] = mu
+	}
+	return mu
+}
+
 // Repo is the structure that holds required information
 // of a git repository.
 type Repo struct {
-	Url        string        // Repository URL
-	Path       string        // Directory to pull to
-	Host       string        // Git domain host e.g. github.com
-	Branch     string        // Git branch
-	KeyPath    string        // Path to private ssh key
-	Interval   time.Duration // Interval between pulls
-	Then       string        // Command to execute after successful git pull
-	pulled     bool          // true if there was a successful pull
-	lastPull   time.Time     // time of the last successful pull
-	lastCommit string        // hash for the most recent commit
+	Url             string            // Repository URL
+	FallbackUrls    []string          // URLs of mirrors to pull from if Url fails, in order
+	Path            string            // Directory to pull to
+	Host            string            // Git domain host e.g. github.com
+	Branch          string            // Git branch
+	Refspec         string            // Refspec to fetch and check out after pulling Branch, if any
+	SingleBranch    bool              // Clone and fetch only Branch
+	Depth           int               // Commits of history to clone and fetch, or 0 for all
+	ShallowSince    string            // Date to clone and fetch history since, instead of Depth
+	ProtocolV2      bool              // Ask the remote for git wire protocol version 2
+	KeyPath         string            // Path to private ssh key
+	TokenFile       string            // File with a token for https repositories
+	TokenUser       string            // User name to send the token with
+	HostKeys        map[string]string // Paths to private ssh keys for other hosts, by host
+	KeyscanTypes    string            // Host key types to ask for, comma separated; DefaultKeyscanTypes if empty
+	Verify          string            // Signature to verify before serving a commit, VerifyCommit or VerifyTag, if any
+	VerifyKeyring   string            // GnuPG home directory with the keys trusted to sign, if not the user's
+	Interval        time.Duration     // Interval between pulls
+	LockFile        string            // File locked while pulling, shared with other processes
+	Timeout         time.Duration     // Time commands may run for; DefaultTimeout if zero
+	User            string            // OS user to run commands as, if not the current one
+	Group           string            // OS group to run commands as, if not that of User
+	Then            string            // Command to execute after successful git pull
+	ThenInitial     string            // Command to execute once after cloning, before Then
+	ThenSteps       []ThenStep        // Commands to execute after Then, on conditions
+	ThenDir         string            // Directory to execute Then in, relative to Path
+	ThenRetries     int               // Times to retry Then if it fails
+	ThenRetryDelay  time.Duration     // Delay before the first retry of Then, doubled for each next
+	DeployFile      string            // File to write the commit to after each deploy
+	PersistDir      string            // Disk copy of Path, synced after deploys and restored from
+	Previews        *Previews         // Branches cloned on demand for preview, if enabled
+	HookUrl         string            // URL path which triggers a pull when requested
+	HookSecret      string            // Secret used to verify webhook requests
+	HookMaxBody     int64             // Largest webhook request body; DefaultHookMaxBody if zero
+	TriggerFile     string            // File which triggers a pull when changed
+	Background      bool              // Do the initial pull in the background
+	ManualOnly      bool              // Only pull when triggered, into a clone already in Path
+	FailOnInitError bool              // Fail startup if the initial clone fails, even in Background
+	RetryAfter      int               // Seconds to ask clients to wait until pulled
+	MetricsUrl      string            // URL path to serve pull metrics at
+	ScriptDir       string            // Private directory for temporary ssh scripts
+	RecloneEvery    int               // Clone afresh instead of pulling every so many pulls
+	RecloneAge      time.Duration     // Clone afresh instead of pulling when the clone is this old
+	Atomic          bool              // Pull into a copy of Path and swap it in when complete
+	Window          *PullWindow       // Time of day to pull within, if limited
+	Browse          bool              // Serve listings of the directories pulled
+	BrowseTemplate  string            // Template file for the listings, if not the default
+	CommitHeader    string            // Response header to expose the pulled commit in
+	CommitETag      bool              // Derive the ETag of responses from the pulled commit
+	CommitModTime   bool              // Derive the Last-Modified time of responses from the pulled commit
+	Id              string            // Identifies the repository in the commit header
+	runAs           *osUser           // resolved User and Group
+	mirror          *mirror           // bare mirror Path is a worktree of, if any
+	remote          string            // URL being pulled from, Url or one of FallbackUrls
+	pulled          bool              // true if there was a successful pull
+	lastClone       time.Time         // time the repository was last cloned
+	pullsSinceClone int               // successful pulls since then
+	lastPull        time.Time         // time of the last successful pull
+	lastCommit      string            // hash for the most recent commit
+	initialDue      bool              // ThenInitial is yet to succeed for the clone
 	sync.Mutex
+
+	// state guards pulled, lastPull, lastCommit and the fields
+	// below, so they can be read without waiting for a pull to finish.
+	state            sync.RWMutex
+	lastCommitTime   time.Time     // commit time of the most recent commit
+	lastPullDuration time.Duration // how long the last successful pull took
+	lastThenDuration time.Duration // how long the last run of Then took
+	deferred         bool          // a pull was triggered outside of Window
+
+	pulls        int64 // number of pulls attempted; access atomically
+	pullFailures int64 // number of pulls that failed; access atomically
 }
 
 // Pull attempts a git clone.
@@ -52,103 +180,411 @@ func (r *Repo) Pull() error {
 	if time.Since(r.lastPull) <= r.Interval {
 		return nil
 	}
+	return r.update()
+}
+
+// ForcePull is like Pull, but pulls even if the
+// interval since the last pull has not passed yet.
+// Outside of Window, unless it is bypassed, the
+// pull is deferred until the window opens.
+func (r *Repo) ForcePull() error {
+	if r.Window != nil && !r.Window.Bypass && !r.inWindow(time.Now()) {
+		r.deferPull()
+		return nil
+	}
+	r.Lock()
+	defer r.Unlock()
+	return r.update()
+}
+
+// update pulls the repository and executes the post pull
+// command if there are new changes. r must be locked.
+func (r *Repo) update() error {
+	pathMu := pathLock(r.Path)
+	pathMu.Lock()
+	defer pathMu.Unlock()
+
+	// other processes pulling into a shared
+	// path are left to it, and pulled after
+	if r.LockFile != "" {
+		unlock, err := lockFile(r.LockFile)
+		if err == errLocked {
+			logger().Printf("%v is being pulled by another process, skipping pull.\n", r.Path)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
 
 	// keep last commit hash for comparison later
 	lastCommit := r.lastCommit
+	cloned := !r.Pulled()
+
+	// a fresh clone needs the post pull command
+	// to run again, even without new changes
+	recloned := r.recloneDue()
 
 	var err error
 	// Attempt to pull at most numRetries times
 	for i := 0; i < numRetries; i++ {
-		if err = r.pull(); err == nil {
+		if recloned {
+			err = r.failover(r.reclone)
+		} else {
+			err = r.failover(r.pull)
+		}
+		if err == nil {
 			break
 		}
 		logger().Println(err)
 	}
 
+	atomic.AddInt64(&r.pulls, 1)
 	if err != nil {
+		atomic.AddInt64(&r.pullFailures, 1)
 		return err
 	}
 
+	r.pullsSinceClone++
+	if (cloned || recloned) && r.ThenInitial != "" {
+		r.initialDue = true
+	}
+
 	// check if there are new changes,
 	// then execute post pull command
-	if r.lastCommit == lastCommit {
+	if r.lastCommit == lastCommit && !recloned && !r.initialDue {
 		logger().Println("No new changes.")
 		return nil
 	}
-	return r.postPullCommand()
+	if r.initialDue {
+		if err = r.initialCommand(); err != nil {
+			return err
+		}
+		r.initialDue = false
+	}
+	if err = r.postPullCommand(); err != nil {
+		return err
+	}
+	if r.DeployFile != "" {
+		if err = r.writeDeployFile(); err != nil {
+			return err
+		}
+	}
+	if r.PersistDir != "" {
+		return r.persist()
+	}
+	return nil
 }
 
 // Pull performs git clone, or git pull if repository exists
 func (r *Repo) pull() error {
-	params := []string{"clone", "-b", r.Branch, r.Url, r.Path}
-	if r.pulled {
-		params = []string{"pull", "origin", r.Branch}
+	start := time.Now()
+	if r.mirror != nil {
+		if err := r.pullWorktree(); err != nil {
+			return err
+		}
+	} else if r.pulled && r.Atomic {
+		if err := r.pullAtomic(); err != nil {
+			return err
+		}
+	} else if r.pulled {
+		if err := r.pullIn(r.Path); err != nil {
+			return err
+		}
+	} else {
+		if err := r.runGit(r.cloneParams(r.Path), ""); err != nil {
+			return err
+		}
+		// with a refspec, Branch is only cloned
+		if r.Refspec != "" {
+			if err := r.fetchRefspec(r.Path); err != nil {
+				return err
+			}
+		}
+		if r.Verify != "" {
+			if err := r.verifyClone(r.Path); err != nil {
+				return err
+			}
+		}
+	}
+	took := time.Since(start)
+	logger().Printf("%v pulled in %v.\n", r.Url, took)
+	if !r.pulled {
+		r.lastClone = time.Now()
+	}
+	return r.pullSucceeded(took)
+}
+
+// cloneParams returns the git parameters
+// to clone the repository into dir.
+func (r *Repo) cloneParams(dir string) []string {
+	params := []string{"clone", "-b", r.Branch}
+	if r.SingleBranch {
+		params = append(params, "--single-branch")
 	}
+	params = append(params, r.shallowParams()...)
+	return append(params, r.remoteUrl(), dir)
+}
 
-	// if key is specified, pull using ssh key
-	if r.KeyPath != "" {
-		return r.pullWithKey(params)
+// pullIn pulls the latest changes into the clone at dir,
+// and verifies them if Verify is set.
+func (r *Repo) pullIn(dir string) error {
+	if r.Verify == "" {
+		return r.fetchIn(dir)
 	}
+	previous, err := r.runCmdOutput(gitBinary, []string{"rev-parse", "HEAD"}, dir)
+	if err != nil {
+		return err
+	}
+	if err := r.fetchIn(dir); err != nil {
+		return err
+	}
+	return r.verifyPull(dir, previous)
+}
 
-	dir := ""
-	if r.pulled {
-		dir = r.Path
+// fetchIn fetches the latest changes into
+// the clone at dir and checks them out.
+func (r *Repo) fetchIn(dir string) error {
+	if r.Refspec != "" {
+		return r.fetchRefspec(dir)
+	}
+	shallow := r.shallowParams()
+	if shallow == nil {
+		return r.runGit([]string{"pull", "origin", r.Branch}, dir)
 	}
+	// shallow history may have nothing in common with what
+	// is fetched to merge it with, so just move to that
+	params := append(append([]string{"fetch"}, shallow...), "origin", r.Branch)
+	if err := r.runGit(params, dir); err != nil {
+		return err
+	}
+	return r.runCmd(gitBinary, []string{"reset", "--hard", "FETCH_HEAD"}, dir)
+}
 
-	var err error
-	if err = runCmd(gitBinary, params, dir); err == nil {
-		r.pulled = true
-		r.lastPull = time.Now()
-		logger().Printf("%v pulled.\n", r.Url)
-		r.lastCommit, err = r.getMostRecentCommit()
+// shallowParams returns the git parameters which limit
+// the history cloned or fetched, if it is limited.
+func (r *Repo) shallowParams() []string {
+	if r.Depth > 0 {
+		return []string{"--depth", strconv.Itoa(r.Depth)}
 	}
-	return err
+	if r.ShallowSince != "" {
+		return []string{"--shallow-since=" + r.ShallowSince}
+	}
+	return nil
+}
+
+// reclone clones the repository afresh next to Path and then
+// swaps the clone in for Path, so the tree is pristine again.
+func (r *Repo) reclone() error {
+	staging := r.Path + ".reclone"
+	os.RemoveAll(staging)
+	// whatever fails, the clone is not left behind
+	swapped := false
+	defer func() {
+		if !swapped {
+			os.RemoveAll(staging)
+		}
+	}()
+
+	start := time.Now()
+	if err := r.runGit(r.cloneParams(staging), ""); err != nil {
+		return err
+	}
+	if r.Refspec != "" {
+		if err := r.fetchRefspec(staging); err != nil {
+			return err
+		}
+	}
+	if r.Verify != "" {
+		if err := r.verifyClone(staging); err != nil {
+			return err
+		}
+	}
+
+	// preview clones may be inside the old tree
+	if r.Previews != nil {
+		r.Previews.evictAll()
+	}
+	if err := r.swapIn(staging); err != nil {
+		return err
+	}
+	swapped = true
+
+	took := time.Since(start)
+	logger().Printf("%v cloned afresh in %v.\n", r.Url, took)
+	r.lastClone = time.Now()
+	r.pullsSinceClone = 0
+	return r.pullSucceeded(took)
+}
+
+// recloneDue returns whether the repository is
+// to be cloned afresh instead of pulled.
+func (r *Repo) recloneDue() bool {
+	if !r.pulled {
+		return false
+	}
+	return (r.RecloneEvery > 0 && r.pullsSinceClone >= r.RecloneEvery) ||
+		(r.RecloneAge > 0 && time.Since(r.lastClone) >= r.RecloneAge)
 }
 
-// pullWithKey is used for private repositories and requires an ssh key.
+// runGit runs git with params in dir, authenticating
+// with the key or token of the repository if any.
+func (r *Repo) runGit(params []string, dir string) error {
+	// git before 2.18 ignores the setting, and remotes which do
+	// not speak version 2 answer with the original protocol
+	if r.ProtocolV2 {
+		params = append([]string{"-c", "protocol.version=2"}, params...)
+	}
+
+	// if key is specified, pull using ssh key
+	if r.KeyPath != "" {
+		return r.runGitWithKey(params, dir)
+	}
+
+	// the token is read on every pull so that it can be rotated
+	var env []string
+	if r.TokenFile != "" {
+		var err error
+		if env, err = r.tokenEnv(); err != nil {
+			return err
+		}
+	}
+	return r.runCmdEnv(gitBinary, params, dir, env)
+}
+
+// runGitWithKey is used for private repositories and requires an ssh key.
 // Note: currently only limited to Linux and OSX.
-func (r *Repo) pullWithKey(params []string) error {
-	var gitSsh, script *os.File
+func (r *Repo) runGitWithKey(params []string, dir string) error {
+	var gitSsh, sshConfig, script *os.File
 	// ensure temporary files deleted after usage
 	defer func() {
 		if gitSsh != nil {
 			os.Remove(gitSsh.Name())
 		}
+		if sshConfig != nil {
+			os.Remove(sshConfig.Name())
+		}
 		if script != nil {
 			os.Remove(script.Name())
 		}
 	}()
 
+	// the key may have been rotated since the last pull;
+	// ssh refuses keys other users can access anyway
+	if err := checkSecretFile(r.KeyPath, 0077); err != nil {
+		return err
+	}
+
 	var err error
 	// write git.sh script to temp file
-	gitSsh, err = writeScriptFile(gitWrapperScript(gitBinary))
+	gitSsh, err = writeScriptFile(r.ScriptDir, gitWrapperScript(gitBinary))
 	if err != nil {
 		return err
 	}
 
+	// with keys for several hosts, ssh picks the key by host
+	// from a config file instead of being given a single one
+	sshArgs := "-i " + r.KeyPath
+	if len(r.HostKeys) > 0 {
+		sshConfig, err = writeTempFile(r.ScriptDir, sshConfigFile(r))
+		if err != nil {
+			return err
+		}
+		sshArgs = "-F " + sshConfig.Name()
+	}
+
 	// write git clone bash script to file
-	script, err = writeScriptFile(bashScript(gitSsh.Name(), r, params))
+	script, err = writeScriptFile(r.ScriptDir, bashScript(gitSsh.Name(), sshArgs, r, params))
 	if err != nil {
 		return err
 	}
 
-	dir := ""
-	if r.pulled {
-		dir = r.Path
+	// the user the script runs as needs to be able to run the
+	// scripts; the key must be readable by the user already
+	if err = r.chown(gitSsh, sshConfig, script); err != nil {
+		return err
 	}
 
-	if err = runCmd(script.Name(), nil, dir); err == nil {
-		r.pulled = true
-		r.lastPull = time.Now()
-		logger().Printf("%v pulled.\n", r.Url)
-		r.lastCommit, err = r.getMostRecentCommit()
+	return r.runCmd(script.Name(), nil, dir)
+}
+
+// pullSucceeded records a successful pull which took
+// the given time, along with the most recent commit.
+func (r *Repo) pullSucceeded(took time.Duration) error {
+	commit, err := r.getMostRecentCommit()
+	var commitTime time.Time
+	if err == nil {
+		commitTime, err = r.getMostRecentCommitTime()
 	}
+	r.state.Lock()
+	r.pulled = true
+	r.lastPull = time.Now()
+	r.lastPullDuration = took
+	r.lastCommit = commit
+	r.lastCommitTime = commitTime
+	r.state.Unlock()
 	return err
 }
 
+// Pulled reports whether there was a successful pull.
+// Like LastCommit and LastPull, it is safe to call
+// from any goroutine, also during a pull.
+func (r *Repo) Pulled() bool {
+	r.state.RLock()
+	defer r.state.RUnlock()
+	return r.pulled
+}
+
+// LastCommit returns the hash of the most recent commit
+// pulled, or "" if it is not known yet.
+func (r *Repo) LastCommit() string {
+	r.state.RLock()
+	defer r.state.RUnlock()
+	return r.lastCommit
+}
+
+// LastPull returns the time of the last successful pull,
+// or the zero time if there was none.
+func (r *Repo) LastPull() time.Time {
+	r.state.RLock()
+	defer r.state.RUnlock()
+	return r.lastPull
+}
+
+// commitId returns the most recent commit as exposed in
+// CommitHeader, prefixed with Id and '@' if Id is set.
+// It returns "" if the commit is not known yet.
+func (r *Repo) commitId() string {
+	commit := r.LastCommit()
+	if commit == "" || r.Id == "" {
+		return commit
+	}
+	return r.Id + "@" + commit
+}
+
 // prepare prepares for a git pull
 // and validates the configured directory
 func (r *Repo) prepare() error {
+	if err := r.preparePath(); err != nil {
+		return err
+	}
+	if r.swaps() {
+		// before it is served, so that it can be swapped later
+		return r.linkTree()
+	}
+	return nil
+}
+
+// preparePath makes sure Path is a directory to clone into,
+// or a clone of the repository.
+func (r *Repo) preparePath() error {
+	if r.PersistDir != "" {
+		if err := r.restore(); err != nil {
+			return err
+		}
+	}
+
 	// check if directory exists or is empty
 	// if not, create directory
 	fs, err := ioutil.ReadDir(r.Path)
@@ -165,11 +601,25 @@ func (r *Repo) prepare() error {
 		}
 	}
 
+	// a worktree has a .git file pointing to the repository
+	if !isGit && r.mirror != nil {
+		for _, f := range fs {
+			if !f.IsDir() && f.Name() == ".git" {
+				isGit = true
+				break
+			}
+		}
+	}
+
 	if isGit {
 		// check if same repository
 		var repoUrl string
-		if repoUrl, err = r.getRepoUrl(); err == nil && repoUrl == r.Url {
+		if repoUrl, err = r.getRepoUrl(); err == nil && r.isUrl(repoUrl) {
+			// its age is unknown, so count from now
+			r.lastClone = time.Now()
+			r.state.Lock()
 			r.pulled = true
+			r.state.Unlock()
 			return nil
 		}
 		if err != nil {
@@ -183,12 +633,25 @@ func (r *Repo) prepare() error {
 // getMostRecentCommit gets the hash of the most recent commit to the
 // repository. Useful for checking if changes occur.
 func (r *Repo) getMostRecentCommit() (string, error) {
-	command := gitBinary + ` --no-pager log -n 1 --pretty=format:"%H"`
-	c, args, err := middleware.SplitCommandAndArgs(command)
-	if err != nil {
+	commits, err := r.commitLog(r.Path, "HEAD", 1, "%H")
+	if err != nil || len(commits) == 0 {
 		return "", err
 	}
-	return runCmdOutput(c, args, r.Path)
+	return commits[0][0], nil
+}
+
+// getMostRecentCommitTime gets the commit time of the
+// most recent commit to the repository.
+func (r *Repo) getMostRecentCommitTime() (time.Time, error) {
+	commits, err := r.commitLog(r.Path, "HEAD", 1, "%ct")
+	if err != nil || len(commits) == 0 {
+		return time.Time{}, err
+	}
+	sec, err := strconv.ParseInt(commits[0][0], 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(sec, 0), nil
 }
 
 // getRepoUrl retrieves remote origin url for the git repository at path
@@ -198,26 +661,70 @@ func (r *Repo) getRepoUrl() (string, error) {
 		return "", err
 	}
 	args := []string{"config", "--get", "remote.origin.url"}
-	return runCmdOutput(gitBinary, args, r.Path)
+	return r.runCmdOutput(gitBinary, args, r.Path)
 }
 
-// postPullCommand executes r.Then.
-// It is trigged after successful git pull
+// postPullCommand executes r.Then, followed by those of
+// r.ThenSteps whose conditions hold. It is trigged after
+// successful git pull, and returns the first error of a
+// command run.
 func (r *Repo) postPullCommand() error {
 	if r.Then == "" {
 		return nil
 	}
-	c, args, err := middleware.SplitCommandAndArgs(r.Then)
+
+	dir, err := r.thenDir(r.Then)
 	if err != nil {
 		return err
 	}
 
-	if err = runCmd(c, args, r.Path); err == nil {
-		logger().Printf("Command %v successful.\n", r.Then)
+	output, total, err := r.runThen(r.Then, dir)
+	firstErr := err
+	for _, step := range r.ThenSteps {
+		if !step.runs(output, err) {
+			logger().Printf("Skipping command %v.\n", step.Command)
+			continue
+		}
+		var took time.Duration
+		output, took, err = r.runThen(step.Command, dir)
+		total += took
+		if firstErr == nil {
+			firstErr = err
+		}
 	}
+
+	r.state.Lock()
+	r.lastThenDuration = total
+	r.state.Unlock()
+	return firstErr
+}
+
+// initialCommand executes r.ThenInitial after a clone. Until
+// it succeeds, it is executed again after every pull.
+func (r *Repo) initialCommand() error {
+	dir, err := r.thenDir(r.ThenInitial)
+	if err != nil {
+		return err
+	}
+	_, _, err = r.runThen(r.ThenInitial, dir)
 	return err
 }
 
+// thenDir returns the directory to run command in,
+// which is ThenDir in Path if set, or else Path.
+func (r *Repo) thenDir(command string) (string, error) {
+	if r.ThenDir == "" {
+		return r.Path, nil
+	}
+	dir := filepath.Join(r.Path, r.ThenDir)
+	if fi, err := os.Stat(dir); err != nil {
+		return "", fmt.Errorf("Cannot run %v in %v: %v", command, dir, err)
+	} else if !fi.IsDir() {
+		return "", fmt.Errorf("Cannot run %v in %v: not a directory", command, dir)
+	}
+	return dir, nil
+}
+
 // initGit validates git installation and locates the git executable
 // binary in PATH
 func initGit() error {
@@ -238,38 +745,96 @@ func initGit() error {
 
 }
 
+// timeout returns how long commands for r may run.
+func (r *Repo) timeout() time.Duration {
+	if r.Timeout > 0 {
+		return r.Timeout
+	}
+	return DefaultTimeout
+}
+
 // runCmd is a helper function to run commands.
 // It runs command with args from directory at dir.
-// The executed process outputs to os.Stderr
-func runCmd(command string, args []string, dir string) error {
-	cmd := exec.Command(command, args...)
+// The executed process outputs to os.Stderr.
+// It runs as the user of r, if any, and is killed
+// if it runs for longer than the timeout of r.
+func (r *Repo) runCmd(command string, args []string, dir string) error {
+	return r.runCmdEnv(command, args, dir, nil)
+}
+
+// runCmdEnv is like runCmd, but runs command with
+// the environment env, or the current one if nil.
+func (r *Repo) runCmdEnv(command string, args []string, dir string, env []string) error {
+	cmd := r.command(command, args, dir, env)
 	cmd.Stderr = os.Stderr
 	cmd.Stdout = os.Stderr
-	cmd.Dir = dir
-	if err := cmd.Start(); err != nil {
-		return err
-	}
-	return cmd.Wait()
+	return runTimeout(cmd, r.timeout())
 }
 
 // runCmdOutput is a helper function to run commands and return output.
-// It runs command with args from directory at dir.
+// It runs command with args from directory at dir like runCmd.
 // If successful, returns output and nil error
-func runCmdOutput(command string, args []string, dir string) (string, error) {
+func (r *Repo) runCmdOutput(command string, args []string, dir string) (string, error) {
+	var output bytes.Buffer
+	cmd := r.command(command, args, dir, nil)
+	cmd.Stdout = &output
+	if err := runTimeout(cmd, r.timeout()); err != nil {
+		return "", err
+	}
+	return string(bytes.TrimSpace(output.Bytes())), nil
+}
+
+// command returns the command to run command with args from
+// directory at dir, with the environment env, or the current
+// one if nil, as the user of r, if any.
+func (r *Repo) command(command string, args []string, dir string, env []string) *exec.Cmd {
 	cmd := exec.Command(command, args...)
 	cmd.Dir = dir
-	var err error
-	if output, err := cmd.Output(); err == nil {
-		return string(bytes.TrimSpace(output)), nil
+	cmd.Env = env
+	if r.runAs != nil {
+		// git reads its config from the home directory
+		if cmd.Env == nil {
+			cmd.Env = os.Environ()
+		}
+		cmd.Env = append(cmd.Env, "HOME="+r.runAs.home)
+		setCredential(cmd, r.runAs)
+	}
+	return cmd
+}
+
+// runTimeout starts cmd in a process group of its own and waits
+// for it to finish. If it takes longer than timeout, the whole
+// group is killed, so that processes it started, like ssh, do
+// not linger, and an error saying so is returned.
+func runTimeout(cmd *exec.Cmd, timeout time.Duration) error {
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	if timeout <= 0 {
+		return cmd.Wait()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		killProcessGroup(cmd)
+		<-done
+		return fmt.Errorf("%v timed out after %v and was killed", cmd.Path, timeout)
 	}
-	return "", err
 }
 
-// writeScriptFile writes content to a temporary file.
+// writeScriptFile writes content to a temporary file in dir,
+// or in the default directory for temporary files if dir is empty.
 // It changes the temporary file mode to executable and
 // closes it to prepare it for execution.
-func writeScriptFile(content []byte) (file *os.File, err error) {
-	if file, err = ioutil.TempFile("", "caddy"); err != nil {
+func writeScriptFile(dir string, content []byte) (file *os.File, err error) {
+	if file, err = ioutil.TempFile(dir, "caddy"); err != nil {
 		return nil, err
 	}
 	if _, err = file.Write(content); err != nil {
@@ -281,6 +846,19 @@ func writeScriptFile(content []byte) (file *os.File, err error) {
 	return file, file.Close()
 }
 
+// writeTempFile writes content to a temporary file in dir, or in
+// the default directory for temporary files if dir is empty, which
+// only the current user can read. It closes the file.
+func writeTempFile(dir string, content []byte) (file *os.File, err error) {
+	if file, err = ioutil.TempFile(dir, "caddy"); err != nil {
+		return nil, err
+	}
+	if _, err = file.Write(content); err != nil {
+		return nil, err
+	}
+	return file, file.Close()
+}
+
 // gitWrapperScript forms content for git.sh script
 var gitWrapperScript = func(gitBinary string) []byte {
 	return []byte(fmt.Sprintf(`#!/bin/bash
@@ -292,18 +870,29 @@ if [ $# -eq 0 ]; then
     echo "Git wrapper script that can specify an ssh-key file
 Usage:
     git.sh -i ssh-key-file git-command
+    git.sh -F ssh-config-file git-command
     "
     exit 1
 fi
 
 # remove temporary file on exit
-trap 'rm -f /tmp/.git_ssh.$$' 0
+trap 'rm -f ${TMPDIR:-/tmp}/.git_ssh.$$' 0
 
+# only offer the given key, not those of ssh-agent or ~/.ssh,
+# so that the host does not authenticate us as another user
 if [ "$1" = "-i" ]; then
     SSH_KEY=$2; shift; shift
-    echo "ssh -i $SSH_KEY \$@" > /tmp/.git_ssh.$$
-    chmod +x /tmp/.git_ssh.$$
-    export GIT_SSH=/tmp/.git_ssh.$$
+    echo "ssh -i \"$SSH_KEY\" -o IdentitiesOnly=yes \$@" > ${TMPDIR:-/tmp}/.git_ssh.$$
+    chmod +x ${TMPDIR:-/tmp}/.git_ssh.$$
+    export GIT_SSH=${TMPDIR:-/tmp}/.git_ssh.$$
+fi
+
+# or pick the key by host from an ssh config file
+if [ "$1" = "-F" ]; then
+    SSH_CONFIG=$2; shift; shift
+    echo "ssh -F \"$SSH_CONFIG\" \$@" > ${TMPDIR:-/tmp}/.git_ssh.$$
+    chmod +x ${TMPDIR:-/tmp}/.git_ssh.$$
+    export GIT_SSH=${TMPDIR:-/tmp}/.git_ssh.$$
 fi
 
 # in case the git command is repeated
@@ -315,14 +904,68 @@ fi
 `, gitBinary))
 }
 
-// bashScript forms content of bash script to clone or update a repo using ssh
-var bashScript = func(gitShPath string, repo *Repo, params []string) []byte {
+// sshConfigFile forms content of an ssh config file which
+// selects the key for each host the repo can be pulled from.
+func sshConfigFile(repo *Repo) []byte {
+	keys := map[string]string{repo.Host: repo.KeyPath}
+	for _, host := range repo.fallbackHosts() {
+		keys[host] = repo.KeyPath
+	}
+	for host, key := range repo.HostKeys {
+		keys[host] = key
+	}
+	hosts := make([]string, 0, len(keys))
+	for host := range keys {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	var buf bytes.Buffer
+	for _, host := range hosts {
+		fmt.Fprintf(&buf, "Host %v\n\tIdentityFile \"%v\"\n\tIdentitiesOnly yes\n", host, keys[host])
+	}
+	return buf.Bytes()
+}
+
+// bashScript forms content of bash script to clone or update a repo using ssh.
+// sshArgs tell git.sh which key to use.
+var bashScript = func(gitShPath string, sshArgs string, repo *Repo, params []string) []byte {
+	// git.sh keeps its own temporary file next to the scripts
+	tmpDir := ""
+	if repo.ScriptDir != "" {
+		tmpDir = fmt.Sprintf("export TMPDIR=\"%v\";\n", repo.ScriptDir)
+	}
+	keyTypes := repo.KeyscanTypes
+	if keyTypes == "" {
+		keyTypes = DefaultKeyscanTypes
+	}
 	return []byte(fmt.Sprintf(`#!/bin/bash
 
-mkdir -p ~/.ssh;
+%vmkdir -p ~/.ssh;
 touch ~/.ssh/known_hosts;
-ssh-keyscan -t rsa,dsa %v 2>&1 | sort -u - ~/.ssh/known_hosts > ~/.ssh/tmp_hosts;
+ssh-keyscan -t %v %v 2>&1 | sort -u - ~/.ssh/known_hosts > ~/.ssh/tmp_hosts;
 cat ~/.ssh/tmp_hosts >> ~/.ssh/known_hosts;
-%v -i %v %v;
-`, repo.Host, gitShPath, repo.KeyPath, strings.Join(params, " ")))
+%v %v %v;
+`, tmpDir, keyTypes, strings.Join(repo.hosts(), " "), gitShPath, sshArgs, strings.Join(params, " ")))
+}
+
+// hosts returns the hosts the repo can be pulled from,
+// which is its own and those there are keys for.
+func (r *Repo) hosts() []string {
+	hosts := []string{r.Host}
+	seen := map[string]bool{r.Host: true}
+	for _, host := range r.fallbackHosts() {
+		if !seen[host] {
+			seen[host] = true
+			hosts = append(hosts, host)
+		}
+	}
+	for host := range r.HostKeys {
+		if !seen[host] {
+			seen[host] = true
+			hosts = append(hosts, host)
+		}
+	}
+	sort.Strings(hosts[1:])
+	return hosts
 }
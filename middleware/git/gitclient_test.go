@@ -0,0 +1,206 @@
+package git
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// quiet silences Logger once, before the first pull; pulls
+// started by webhooks may still log after their test ended.
+var quiet sync.Once
+
+// newTestRepo creates a git repository with a commit in a
+// temporary directory, and returns a Repo to pull it into
+// another one.
+func newTestRepo(t *testing.T) *Repo {
+	if err := initGit(); err != nil {
+		t.Skip("git is not installed")
+	}
+	quiet.Do(func() {
+		Logger = log.New(ioutil.Discard, "", 0)
+	})
+
+	dir := t.TempDir()
+	origin := filepath.Join(dir, "origin")
+	for _, args := range [][]string{
+		{"init", "-q", "-b", "master", origin},
+		{"-C", origin, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "--allow-empty", "-m", "first"},
+	} {
+		if out, err := exec.Command(gitBinary, args...).CombinedOutput(); err != nil {
+			t.Fatalf("Could not create repository: %v: %s", err, out)
+		}
+	}
+	return &Repo{Url: origin, Branch: "master", Path: filepath.Join(dir, "site")}
+}
+
+func TestAccessors(t *testing.T) {
+	repo := newTestRepo(t)
+	if repo.Pulled() || repo.LastCommit() != "" || !repo.LastPull().IsZero() {
+		t.Fatal("Expected no pull to be recorded before pulling")
+	}
+
+	before := time.Now()
+	if err := repo.ForcePull(); err != nil {
+		t.Fatalf("Expected no error pulling, got %v", err)
+	}
+	head, err := exec.Command(gitBinary, "-C", repo.Url, "rev-parse", "HEAD").Output()
+	if err != nil {
+		t.Fatalf("Could not get commit: %v", err)
+	}
+	if !repo.Pulled() {
+		t.Error("Expected Pulled after pulling")
+	}
+	if commit := repo.LastCommit(); commit+"\n" != string(head) {
+		t.Errorf("Expected last commit %s, got %s", head, commit)
+	}
+	if repo.LastPull().Before(before) {
+		t.Errorf("Expected last pull after %v, got %v", before, repo.LastPull())
+	}
+}
+
+// TestAccessorsRace reads the state of a repo while it is being
+// pulled. Run it with -race to check that the accessors do not race
+// with the pulls.
+func TestAccessorsRace(t *testing.T) {
+	repo := newTestRepo(t)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				repo.Pulled()
+				repo.LastCommit()
+				repo.LastPull()
+				repo.commitId()
+			}
+		}()
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := repo.ForcePull(); err != nil {
+			t.Errorf("Pull %d: Expected no error, got %v", i, err)
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	if _, err := os.Stat(filepath.Join(repo.Path, ".git")); err != nil {
+		t.Errorf("Expected repository to be cloned: %v", err)
+	}
+}
+
+func TestVerifyUnsigned(t *testing.T) {
+	repo := newTestRepo(t)
+	if err := repo.ForcePull(); err != nil {
+		t.Fatalf("Expected no error pulling, got %v", err)
+	}
+	first := repo.LastCommit()
+
+	commit := exec.Command(gitBinary, "-C", repo.Url, "-c", "user.name=test", "-c", "user.email=test@example.com",
+		"commit", "-q", "--allow-empty", "-m", "unsigned")
+	if out, err := commit.CombinedOutput(); err != nil {
+		t.Fatalf("Could not commit: %v: %s", err, out)
+	}
+
+	repo.Verify = VerifyCommit
+	if err := repo.ForcePull(); err == nil {
+		t.Error("Expected an error pulling an unsigned commit")
+	}
+	head, err := exec.Command(gitBinary, "-C", repo.Path, "rev-parse", "HEAD").Output()
+	if err != nil {
+		t.Fatalf("Could not get commit: %v", err)
+	}
+	if string(head) != first+"\n" {
+		t.Errorf("Expected to keep commit %s, got %s", first, head)
+	}
+
+	// a first clone which cannot be verified is not kept
+	clone := &Repo{Url: repo.Url, Branch: "master", Path: repo.Path + "2", Verify: VerifyCommit}
+	if err := clone.ForcePull(); err == nil {
+		t.Error("Expected an error cloning an unsigned commit")
+	}
+	if _, err := os.Stat(clone.Path); !os.IsNotExist(err) {
+		t.Errorf("Expected the clone to be removed, got %v", err)
+	}
+}
+
+func TestRecloneCleanup(t *testing.T) {
+	repo := newTestRepo(t)
+	if err := repo.ForcePull(); err != nil {
+		t.Fatalf("Expected no error pulling, got %v", err)
+	}
+
+	// the unsigned commit fails verification
+	repo.Verify = VerifyCommit
+	if err := repo.reclone(); err == nil {
+		t.Error("Expected an error recloning an unsigned commit")
+	}
+	if _, err := os.Stat(repo.Path + ".reclone"); !os.IsNotExist(err) {
+		t.Errorf("Expected the clone to be removed, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(repo.Path, ".git")); err != nil {
+		t.Errorf("Expected the repository to be kept: %v", err)
+	}
+
+	repo.Verify = ""
+	if err := repo.reclone(); err != nil {
+		t.Errorf("Expected no error recloning, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(repo.Path, ".git")); err != nil {
+		t.Errorf("Expected the clone to be swapped in: %v", err)
+	}
+}
+
+func TestThenInitial(t *testing.T) {
+	repo := newTestRepo(t)
+	// fails if executed a second time
+	repo.ThenInitial = "mkdir setup"
+
+	for i := 0; i < 2; i++ {
+		commit := exec.Command(gitBinary, "-C", repo.Url, "-c", "user.name=test", "-c", "user.email=test@example.com",
+			"commit", "-q", "--allow-empty", "-m", "change")
+		if out, err := commit.CombinedOutput(); err != nil {
+			t.Fatalf("Could not commit: %v: %s", err, out)
+		}
+		if err := repo.ForcePull(); err != nil {
+			t.Errorf("Pull %d: Expected no error, got %v", i, err)
+		}
+	}
+	if fi, err := os.Stat(filepath.Join(repo.Path, "setup")); err != nil || !fi.IsDir() {
+		t.Errorf("Expected the initial command to be executed, got %v", err)
+	}
+}
+
+func TestFallbackUrls(t *testing.T) {
+	repo := newTestRepo(t)
+	origin := repo.Url
+	repo.Url = filepath.Join(filepath.Dir(origin), "down")
+	repo.FallbackUrls = []string{origin}
+
+	for i := 0; i < 2; i++ {
+		if err := repo.ForcePull(); err != nil {
+			t.Fatalf("Pull %d: Expected no error, got %v", i, err)
+		}
+		remote, err := exec.Command(gitBinary, "-C", repo.Path, "config", "--get", "remote.origin.url").Output()
+		if err != nil {
+			t.Fatalf("Could not get remote: %v", err)
+		}
+		if string(remote) != origin+"\n" {
+			t.Errorf("Pull %d: Expected remote %s, got %s", i, origin, remote)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package git
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// labelEscaper escapes label values for the Prometheus text format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// serveMetrics writes the pull metrics of the repository
+// in the Prometheus text exposition format.
+func (g Git) serveMetrics(w http.ResponseWriter, r *http.Request) (int, error) {
+	repo := g.Repo
+
+	repo.state.RLock()
+	lastPull, commitTime := repo.lastPull, repo.lastCommitTime
+	pullDuration, thenDuration := repo.lastPullDuration, repo.lastThenDuration
+	repo.state.RUnlock()
+
+	label := fmt.Sprintf(`{repo="%s",path="%s"}`, labelEscaper.Replace(repo.Url), labelEscaper.Replace(repo.Path))
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintf(w, "# HELP caddy_git_pulls_total Number of git pulls attempted.\n")
+	fmt.Fprintf(w, "# TYPE caddy_git_pulls_total counter\n")
+	fmt.Fprintf(w, "caddy_git_pulls_total%s %d\n", label, atomic.LoadInt64(&repo.pulls))
+	fmt.Fprintf(w, "# HELP caddy_git_pull_failures_total Number of git pulls that failed.\n")
+	fmt.Fprintf(w, "# TYPE caddy_git_pull_failures_total counter\n")
+	fmt.Fprintf(w, "caddy_git_pull_failures_total%s %d\n", label, atomic.LoadInt64(&repo.pullFailures))
+	if !lastPull.IsZero() {
+		fmt.Fprintf(w, "# HELP caddy_git_last_pull_timestamp_seconds Time of the last successful git pull.\n")
+		fmt.Fprintf(w, "# TYPE caddy_git_last_pull_timestamp_seconds gauge\n")
+		fmt.Fprintf(w, "caddy_git_last_pull_timestamp_seconds%s %d\n", label, lastPull.Unix())
+	}
+	if !commitTime.IsZero() {
+		fmt.Fprintf(w, "# HELP caddy_git_commit_age_seconds Age of the commit currently pulled.\n")
+		fmt.Fprintf(w, "# TYPE caddy_git_commit_age_seconds gauge\n")
+		fmt.Fprintf(w, "caddy_git_commit_age_seconds%s %d\n", label, int64(time.Since(commitTime).Seconds()))
+	}
+	if pullDuration > 0 {
+		fmt.Fprintf(w, "# HELP caddy_git_pull_duration_seconds Time the last successful git pull took.\n")
+		fmt.Fprintf(w, "# TYPE caddy_git_pull_duration_seconds gauge\n")
+		fmt.Fprintf(w, "caddy_git_pull_duration_seconds%s %g\n", label, pullDuration.Seconds())
+	}
+	if thenDuration > 0 {
+		fmt.Fprintf(w, "# HELP caddy_git_then_duration_seconds Time the last run of the then command took.\n")
+		fmt.Fprintf(w, "# TYPE caddy_git_then_duration_seconds gauge\n")
+		fmt.Fprintf(w, "caddy_git_then_duration_seconds%s %g\n", label, thenDuration.Seconds())
+	}
+	return http.StatusOK, nil
+}
@@ -0,0 +1,49 @@
+package git
+
+import (
+	"os"
+	"sync"
+)
+
+// mirror is a bare mirror of a repository which
+// branches are checked out of as worktrees.
+type mirror struct {
+	dir string
+	mu  *sync.Mutex // serializes the use of the mirror by its worktrees
+}
+
+// pullWorktree updates the mirror of r, creating it if needed,
+// and then checks Branch out into Path as a worktree of the
+// mirror, or fast-forwards the worktree if it already exists.
+func (r *Repo) pullWorktree() error {
+	r.mirror.mu.Lock()
+	defer r.mirror.mu.Unlock()
+
+	if _, err := os.Stat(r.mirror.dir); os.IsNotExist(err) {
+		if err := r.runGit([]string{"clone", "--mirror", r.remoteUrl(), r.mirror.dir}, ""); err != nil {
+			return err
+		}
+	} else if err := r.runGit([]string{"fetch", "--prune", "origin"}, r.mirror.dir); err != nil {
+		return err
+	}
+
+	// the worktree needs no network access
+	if !r.pulled {
+		// git creates the directory of the worktree itself
+		os.Remove(r.Path)
+		params := []string{"worktree", "add", "--detach", r.Path, r.Branch}
+		return r.runCmd(gitBinary, params, r.mirror.dir)
+	}
+	params := []string{"merge", "--ff-only", "refs/heads/" + r.Branch}
+	return r.runCmd(gitBinary, params, r.Path)
+}
+
+// pruneWorktrees makes the mirror of r forget
+// the worktrees which have been removed.
+func (r *Repo) pruneWorktrees() {
+	r.mirror.mu.Lock()
+	defer r.mirror.mu.Unlock()
+	if err := r.runCmd(gitBinary, []string{"worktree", "prune"}, r.mirror.dir); err != nil {
+		logger().Println(err)
+	}
+}
@@ -0,0 +1,139 @@
+package git
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// restore copies PersistDir into Path if Path has not been
+// cloned into yet, e.g. because it is on a tmpfs and the
+// machine was rebooted, so that the first pull does not need
+// to clone the whole repository again.
+func (r *Repo) restore() error {
+	if _, err := os.Stat(filepath.Join(r.Path, ".git")); err == nil {
+		return nil
+	}
+	if _, err := os.Stat(filepath.Join(r.PersistDir, ".git")); err != nil {
+		return nil
+	}
+	if fs, err := ioutil.ReadDir(r.Path); err == nil && len(fs) > 0 {
+		// prepare reports that path is not empty
+		return nil
+	}
+
+	start := time.Now()
+	os.RemoveAll(r.Path)
+	if err := os.MkdirAll(filepath.Dir(r.Path), os.FileMode(0755)); err != nil {
+		return err
+	}
+	if err := r.copyTree(r.PersistDir, r.Path, ""); err != nil {
+		os.RemoveAll(r.Path)
+		return err
+	}
+	logger().Printf("%v restored from %v in %v.\n", r.Path, r.PersistDir, time.Since(start))
+	return nil
+}
+
+// persist copies Path to PersistDir. The copy is made next to
+// PersistDir and then swapped in for it, so a crash while
+// copying leaves the previous copy intact. Preview clones
+// inside Path are not copied.
+func (r *Repo) persist() error {
+	staging, old := r.PersistDir+".sync", r.PersistDir+".old"
+	os.RemoveAll(staging)
+	os.RemoveAll(old)
+
+	skip := ""
+	if r.Previews != nil {
+		skip = r.Previews.Dir
+	}
+	start := time.Now()
+	if err := r.copyTree(r.Path, staging, skip); err != nil {
+		os.RemoveAll(staging)
+		return err
+	}
+	if err := os.Rename(r.PersistDir, old); err != nil && !os.IsNotExist(err) {
+		os.RemoveAll(staging)
+		return err
+	}
+	if err := os.Rename(staging, r.PersistDir); err != nil {
+		os.Rename(old, r.PersistDir)
+		os.RemoveAll(staging)
+		return err
+	}
+	if err := os.RemoveAll(old); err != nil {
+		logger().Println(err)
+	}
+	logger().Printf("%v synced to %v in %v.\n", r.Path, r.PersistDir, time.Since(start))
+	return nil
+}
+
+// copyTree copies the directory src to dst, which must not exist,
+// keeping modes and symbolic links, but leaving out the directory
+// skip, if given. The copy is owned by the user of r, if any.
+func (r *Repo) copyTree(src, dst, skip string) error {
+	// src may be a link to the tree, like Path when it swaps
+	if tree := linkTarget(src); tree != src {
+		if skip != "" && within(skip, src) {
+			rel, _ := filepath.Rel(src, skip)
+			skip = filepath.Join(tree, rel)
+		}
+		src = tree
+	}
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if skip != "" && path == skip {
+			return filepath.SkipDir
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch mode := info.Mode(); {
+		case mode.IsDir():
+			err = os.Mkdir(target, mode.Perm())
+		case mode&os.ModeSymlink != 0:
+			var link string
+			if link, err = os.Readlink(path); err == nil {
+				err = os.Symlink(link, target)
+			}
+		case mode.IsRegular():
+			err = copyFile(path, target, mode.Perm())
+		default:
+			// sockets, devices and the like are not content
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if r.runAs != nil {
+			return os.Lchown(target, int(r.runAs.uid), int(r.runAs.gid))
+		}
+		return nil
+	})
+}
+
+// copyFile copies the regular file src to dst with mode perm.
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
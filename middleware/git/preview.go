@@ -0,0 +1,362 @@
+package git
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultPreviewMax is the default maximum number
+// of preview branches kept cloned at a time.
+const DefaultPreviewMax = 10
+
+// previewMissAge is how long a branch which does not exist
+// is remembered, so that requests for it are answered without
+// asking the remote again.
+const previewMissAge = time.Minute
+
+// maxPreviewMisses is the most branches which do not
+// exist which are remembered at a time.
+const maxPreviewMisses = 1000
+
+// previewBranchName matches the branch names that may be
+// requested for a preview. It is deliberately strict since
+// the name comes from the request URL.
+var previewBranchName = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._-]*$`)
+
+// Previews clones branches of a repository on demand, each into
+// its own subdirectory of Dir, so they can be served at
+// <Path>/<branch>/ for previewing. If Mirror is set, the branches
+// are checked out as worktrees of a single bare mirror of the
+// repository instead, which takes less space than full clones.
+//
+// If Domain is set, a branch is also served for requests to the
+// subdomain of Domain named like it, e.g. v1.docs.example.com for
+// the branch v1 of docs.example.com, with Fallback served instead
+// for subdomains which do not name a branch, if it is set.
+type Previews struct {
+	Path     string        // URL path under which previews are served
+	Dir      string        // Directory which holds the preview clones
+	Max      int           // Maximum number of preview clones kept
+	MaxAge   time.Duration // Clones not requested for this long are pruned
+	Mirror   string        // Bare mirror to check branches out of, if any
+	Domain   string        // Domain whose subdomains name branches, if any
+	Fallback string        // Branch served for subdomains naming no branch
+
+	repo     *Repo // repository the previews are cloned from
+	clones   map[string]*previewClone
+	misses   map[string]time.Time // branches found not to exist, and when
+	mirrorMu sync.Mutex           // serializes the use of Mirror
+	sync.Mutex
+}
+
+// previewClone is a single branch cloned for preview.
+// It is in the clones of Previews from the first request for
+// its branch on, and ready once the branch is cloned, or
+// could not be, as err then tells.
+type previewClone struct {
+	repo     *Repo
+	lastUsed time.Time
+	ready    chan struct{}
+	err      error
+}
+
+// isReady returns whether c is ready.
+func (c *previewClone) isReady() bool {
+	select {
+	case <-c.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+var errNoBranch = errors.New("No such branch")
+
+// serve makes sure the branch requested by urlPath is cloned and
+// reasonably up to date. It returns a status code >= 400 if the
+// preview cannot be served.
+func (p *Previews) serve(urlPath string) (int, error) {
+	branch := strings.TrimPrefix(strings.TrimPrefix(urlPath, p.Path), "/")
+	if i := strings.Index(branch, "/"); i >= 0 {
+		branch = branch[:i]
+	}
+	if branch == "" {
+		return 0, nil
+	}
+	return p.serveBranch(branch)
+}
+
+// serveSubdomain serves the branch named by the subdomain of Domain
+// that r is for, or Fallback if there is no such branch, by changing
+// the path of r to that of the branch under Path. It returns false
+// if r is not for a subdomain of Domain.
+func (p *Previews) serveSubdomain(r *http.Request) (bool, int, error) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	suffix := "." + strings.ToLower(p.Domain)
+	if !strings.HasSuffix(host, suffix) {
+		return false, 0, nil
+	}
+	branch := strings.TrimSuffix(host, suffix)
+
+	status, err := http.StatusNotFound, error(nil)
+	if !strings.Contains(branch, ".") {
+		status, err = p.serveBranch(branch)
+	}
+	if status == http.StatusNotFound && p.Fallback != "" && p.Fallback != branch {
+		branch = p.Fallback
+		status, err = p.serveBranch(branch)
+	}
+	if status >= 400 {
+		return true, status, err
+	}
+	r.URL.Path = p.Path + "/" + branch + r.URL.Path
+	return true, 0, nil
+}
+
+// serveBranch makes sure branch is cloned and reasonably up to
+// date. It returns a status code >= 400 if it cannot be served.
+func (p *Previews) serveBranch(branch string) (int, error) {
+	if !previewBranchName.MatchString(branch) {
+		return http.StatusNotFound, nil
+	}
+
+	clone, created := p.clone(branch)
+	if clone == nil {
+		return http.StatusNotFound, nil
+	}
+	if created {
+		// the first request for branch sets it up,
+		// without keeping others from their previews
+		clone.err = p.setup(branch, clone)
+		close(clone.ready)
+	} else {
+		<-clone.ready
+	}
+	if clone.err == errNoBranch {
+		return http.StatusNotFound, nil
+	}
+	if clone.err != nil {
+		return http.StatusNotFound, clone.err
+	}
+	if created {
+		return 0, nil
+	}
+
+	if err := clone.repo.Pull(); err != nil {
+		p.remove(branch, clone)
+		return http.StatusNotFound, err
+	}
+	return 0, nil
+}
+
+// clone returns the preview clone of branch, and whether it
+// was just added, in which case it is to be set up. It returns
+// nil if branch was found not to exist a short while ago.
+func (p *Previews) clone(branch string) (*previewClone, bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.clones == nil {
+		p.clones = make(map[string]*previewClone)
+	}
+	p.prune()
+
+	if clone, ok := p.clones[branch]; ok {
+		clone.lastUsed = time.Now()
+		return clone, false
+	}
+	if missed, ok := p.misses[branch]; ok {
+		if time.Since(missed) < previewMissAge {
+			return nil, false
+		}
+		delete(p.misses, branch)
+	}
+
+	clone := &previewClone{repo: p.newRepo(branch), lastUsed: time.Now(), ready: make(chan struct{})}
+	p.clones[branch] = clone
+	return clone, true
+}
+
+// setup clones branch into the new clone, if the branch exists.
+// Only once it is cloned, the least recently used clones are
+// evicted to make room for it, so that requests for branches
+// which cannot be cloned do not evict any.
+func (p *Previews) setup(branch string, clone *previewClone) error {
+	exists, err := clone.repo.hasBranch(branch)
+	if err == nil && !exists {
+		p.missed(branch, clone)
+		return errNoBranch
+	}
+	// if the remote cannot be asked, the pull tells
+	if err := clone.repo.prepare(); err != nil {
+		p.drop(branch, clone)
+		return err
+	}
+	if err := clone.repo.Pull(); err != nil {
+		p.remove(branch, clone)
+		return err
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	for {
+		var oldest string
+		count := 0
+		for b, c := range p.clones {
+			if !c.isReady() {
+				continue
+			}
+			count++
+			if oldest == "" || c.lastUsed.Before(p.clones[oldest].lastUsed) {
+				oldest = b
+			}
+		}
+		// the new clone is not ready yet, so it counts extra
+		if count == 0 || count+1 <= p.Max {
+			return nil
+		}
+		p.evict(oldest)
+	}
+}
+
+// missed removes the new clone of branch, which does not exist,
+// and remembers that it does not for a while.
+func (p *Previews) missed(branch string, clone *previewClone) {
+	p.drop(branch, clone)
+	p.Lock()
+	defer p.Unlock()
+	if p.misses == nil {
+		p.misses = make(map[string]time.Time)
+	}
+	if len(p.misses) >= maxPreviewMisses {
+		for b, missed := range p.misses {
+			if time.Since(missed) >= previewMissAge {
+				delete(p.misses, b)
+			}
+		}
+	}
+	if len(p.misses) < maxPreviewMisses {
+		p.misses[branch] = time.Now()
+	}
+}
+
+// drop forgets the clone of branch, if it is still the
+// given clone, without deleting anything from disk.
+func (p *Previews) drop(branch string, clone *previewClone) {
+	p.Lock()
+	defer p.Unlock()
+	if p.clones[branch] == clone {
+		delete(p.clones, branch)
+	}
+}
+
+// newRepo returns the repo to clone branch into for a preview.
+func (p *Previews) newRepo(branch string) *Repo {
+	repo := &Repo{
+		Url:          p.repo.Url,
+		FallbackUrls: p.repo.FallbackUrls,
+		Host:         p.repo.Host,
+		Branch:       branch,
+		SingleBranch: p.repo.SingleBranch,
+		Depth:        p.repo.Depth,
+		ShallowSince: p.repo.ShallowSince,
+		ProtocolV2:   p.repo.ProtocolV2,
+		KeyPath:      p.repo.KeyPath,
+		HostKeys:     p.repo.HostKeys,
+		KeyscanTypes: p.repo.KeyscanTypes,
+		TokenFile:    p.repo.TokenFile,
+		TokenUser:    p.repo.TokenUser,
+		ScriptDir:    p.repo.ScriptDir,
+		Path:         filepath.Join(p.Dir, branch),
+		Interval:     p.repo.Interval,
+		Timeout:      p.repo.Timeout,
+		User:         p.repo.User,
+		Group:        p.repo.Group,
+		runAs:        p.repo.runAs,
+	}
+	if p.Mirror != "" {
+		repo.mirror = &mirror{dir: p.Mirror, mu: &p.mirrorMu}
+	}
+	return repo
+}
+
+// hasBranch returns whether the remote of r has branch. It
+// returns an error if the remote cannot be asked.
+func (r *Repo) hasBranch(branch string) (bool, error) {
+	params := []string{"ls-remote", "--exit-code", "--heads", r.remoteUrl(), "refs/heads/" + branch}
+	err := r.runGit(params, "")
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 2 {
+		// what --exit-code exits with if there is no such ref
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Prune removes preview clones which have not been
+// requested within MaxAge.
+func (p *Previews) Prune() {
+	p.Lock()
+	defer p.Unlock()
+	p.prune()
+}
+
+// prune is like Prune but expects p to be locked.
+func (p *Previews) prune() {
+	if p.MaxAge <= 0 {
+		return
+	}
+	for branch, clone := range p.clones {
+		if clone.isReady() && time.Since(clone.lastUsed) > p.MaxAge {
+			p.evict(branch)
+		}
+	}
+}
+
+// evictAll deletes all preview clones from disk.
+func (p *Previews) evictAll() {
+	p.Lock()
+	defer p.Unlock()
+	for branch := range p.clones {
+		p.evict(branch)
+	}
+}
+
+// remove evicts the preview clone of branch if it is
+// still the given clone.
+func (p *Previews) remove(branch string, clone *previewClone) {
+	p.Lock()
+	defer p.Unlock()
+	if p.clones[branch] == clone {
+		p.evict(branch)
+	}
+}
+
+// evict deletes the preview clone of branch from disk.
+// It expects p to be locked.
+func (p *Previews) evict(branch string) {
+	clone := p.clones[branch]
+	delete(p.clones, branch)
+
+	// wait for any pull in progress to finish
+	clone.repo.Lock()
+	defer clone.repo.Unlock()
+	if err := os.RemoveAll(clone.repo.Path); err != nil {
+		logger().Println(err)
+	}
+	if clone.repo.mirror != nil {
+		clone.repo.pruneWorktrees()
+	}
+}
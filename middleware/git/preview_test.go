@@ -0,0 +1,47 @@
+package git
+
+import (
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestPreviewBranches(t *testing.T) {
+	repo := newTestRepo(t)
+	p := &Previews{Path: "/preview", Dir: filepath.Join(filepath.Dir(repo.Path), "previews"), Max: 1, repo: repo}
+
+	if status, err := p.serveBranch("master"); status != 0 || err != nil {
+		t.Fatalf("Expected master to be served, got %d and %v", status, err)
+	}
+	master := filepath.Join(p.Dir, "master")
+
+	// a branch which does not exist evicts nothing, and is remembered
+	if status, _ := p.serveBranch("missing"); status != http.StatusNotFound {
+		t.Errorf("Expected status %d for a missing branch, got %d", http.StatusNotFound, status)
+	}
+	if _, err := os.Stat(filepath.Join(master, ".git")); err != nil {
+		t.Errorf("Expected the clone of master to be kept: %v", err)
+	}
+	if _, ok := p.misses["missing"]; !ok {
+		t.Error("Expected the missing branch to be remembered")
+	}
+	if _, err := os.Stat(filepath.Join(p.Dir, "missing")); !os.IsNotExist(err) {
+		t.Errorf("Expected no clone of the missing branch, got %v", err)
+	}
+
+	// once another branch is cloned, there is no more room for master
+	if out, err := exec.Command(gitBinary, "-C", repo.Url, "branch", "other").CombinedOutput(); err != nil {
+		t.Fatalf("Could not create branch: %v: %s", err, out)
+	}
+	if status, err := p.serveBranch("other"); status != 0 || err != nil {
+		t.Fatalf("Expected other to be served, got %d and %v", status, err)
+	}
+	if _, err := os.Stat(filepath.Join(p.Dir, "other", ".git")); err != nil {
+		t.Errorf("Expected other to be cloned: %v", err)
+	}
+	if _, err := os.Stat(master); !os.IsNotExist(err) {
+		t.Errorf("Expected the clone of master to be evicted, got %v", err)
+	}
+}
@@ -0,0 +1,35 @@
+//go:build !windows
+// +build !windows
+
+package git
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup makes cmd start a new process group, which
+// the processes it starts join.
+func setProcessGroup(cmd *exec.Cmd) {
+	sysProcAttr(cmd).Setpgid = true
+}
+
+// setCredential makes cmd run as the user u.
+func setCredential(cmd *exec.Cmd, u *osUser) {
+	sysProcAttr(cmd).Credential = &syscall.Credential{Uid: u.uid, Gid: u.gid}
+}
+
+// sysProcAttr returns the attributes of cmd
+// specific to the OS, creating them if needed.
+func sysProcAttr(cmd *exec.Cmd) *syscall.SysProcAttr {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	return cmd.SysProcAttr
+}
+
+// killProcessGroup kills the process group of cmd,
+// which must have been started with setProcessGroup.
+func killProcessGroup(cmd *exec.Cmd) {
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
@@ -0,0 +1,16 @@
+package git
+
+import "os/exec"
+
+// setProcessGroup does nothing on Windows,
+// which has no process groups to kill.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// setCredential does nothing on Windows, where
+// repos cannot be configured with a user.
+func setCredential(cmd *exec.Cmd, u *osUser) {}
+
+// killProcessGroup kills the process of cmd.
+func killProcessGroup(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
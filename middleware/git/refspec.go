@@ -0,0 +1,63 @@
+package git
+
+import (
+	"fmt"
+	"strings"
+)
+
+// checkRefspec returns an error if refspec is not of the form
+// [+]src[:dst] with src and dst valid ref names. Patterns with
+// * are not allowed, as only one ref can be checked out.
+func checkRefspec(refspec string) error {
+	src, dst := strings.TrimPrefix(refspec, "+"), ""
+	if i := strings.Index(src, ":"); i >= 0 {
+		src, dst = src[:i], src[i+1:]
+		if dst == "" {
+			return fmt.Errorf("Invalid refspec %v: no destination after :", refspec)
+		}
+	}
+	if src == "" {
+		return fmt.Errorf("Invalid refspec %v: no source", refspec)
+	}
+	for _, ref := range []string{src, dst} {
+		if ref != "" && !validRefName(ref) {
+			return fmt.Errorf("Invalid refspec %v: %v is not a valid ref name", refspec, ref)
+		}
+	}
+	return nil
+}
+
+// validRefName returns whether name is a valid ref name, like
+// refs/pull/1/merge or main, along the rules of git check-ref-format.
+func validRefName(name string) bool {
+	if name == "@" || strings.HasSuffix(name, ".") || strings.HasSuffix(name, ".lock") ||
+		strings.Contains(name, "..") || strings.Contains(name, "@{") || strings.Contains(name, "//") ||
+		strings.HasPrefix(name, "/") || strings.HasSuffix(name, "/") {
+		return false
+	}
+	for _, component := range strings.Split(name, "/") {
+		if strings.HasPrefix(component, ".") {
+			return false
+		}
+	}
+	for _, c := range name {
+		if c < 0x20 || c == 0x7f || strings.ContainsRune(" ~^:?*[\\", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// fetchRefspec fetches Refspec from origin into the clone at
+// dir and checks out the ref fetched, detached from any branch.
+func (r *Repo) fetchRefspec(dir string) error {
+	params := append([]string{"fetch"}, r.shallowParams()...)
+	if err := r.runGit(append(params, "origin", r.Refspec), dir); err != nil {
+		return err
+	}
+	target := "FETCH_HEAD"
+	if i := strings.Index(r.Refspec, ":"); i >= 0 {
+		target = r.Refspec[i+1:]
+	}
+	return r.runCmd(gitBinary, []string{"checkout", "--force", "--detach", target}, dir)
+}
@@ -0,0 +1,70 @@
+package git
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// DefaultTokenUser is the user name a token is sent with over
+// https if none is configured, which GitHub accepts for tokens.
+const DefaultTokenUser = "x-access-token"
+
+// checkSecretFile makes sure path is a regular file and none
+// of the permission bits in forbidden are set on it.
+func checkSecretFile(path string, forbidden os.FileMode) error {
+	// secret mounts are often symlinks to the current version
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("Secret file %v is not a regular file", path)
+	}
+	if fi.Mode().Perm()&forbidden != 0 {
+		return fmt.Errorf("Secret file %v has too open permissions (mode %v)", path, fi.Mode().Perm())
+	}
+	return nil
+}
+
+// readSecretFile reads the secret in the file at path, without
+// surrounding whitespace. The file must not be writable by others.
+// It is read every time, so that changes to it take effect.
+func readSecretFile(path string) (string, error) {
+	if err := checkSecretFile(path, 0022); err != nil {
+		return "", err
+	}
+	secret, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	secret = bytes.TrimSpace(secret)
+	if len(secret) == 0 {
+		return "", fmt.Errorf("Secret file %v is empty", path)
+	}
+	return string(secret), nil
+}
+
+// tokenEnv returns the environment git needs to send the token in
+// the repo's TokenFile with https requests. The token is passed in
+// the environment rather than in arguments or the repository URL so
+// that it is neither visible to other users nor stored in .git/config.
+func (r *Repo) tokenEnv() ([]string, error) {
+	token, err := readSecretFile(r.TokenFile)
+	if err != nil {
+		return nil, err
+	}
+	user := r.TokenUser
+	if user == "" {
+		user = DefaultTokenUser
+	}
+	auth := base64.StdEncoding.EncodeToString([]byte(user + ":" + token))
+	return append(os.Environ(),
+		"GIT_CONFIG_COUNT=1",
+		"GIT_CONFIG_KEY_0=http.extraHeader",
+		"GIT_CONFIG_VALUE_0=Authorization: Basic "+auth,
+		"GIT_TERMINAL_PROMPT=0",
+	), nil
+}
@@ -0,0 +1,75 @@
+package git
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/mholt/caddy/middleware"
+)
+
+// Conditions a ThenStep may be run on.
+const (
+	ThenOnSuccess = "success"
+	ThenOnFailure = "failure"
+	ThenAlways    = "always"
+)
+
+// ThenStep is a command run after Then, depending on how
+// the step run last before it went: its exit status or,
+// if Match is set, its output.
+type ThenStep struct {
+	Command string         // Command to execute, with arguments
+	When    string         // ThenOnSuccess, ThenOnFailure or ThenAlways
+	Match   *regexp.Regexp // Pattern the output must match instead, if set
+}
+
+// runs returns whether step is to be run after a step which
+// printed output and ended with err.
+func (step ThenStep) runs(output []byte, err error) bool {
+	if step.Match != nil {
+		return step.Match.Match(output)
+	}
+	switch step.When {
+	case ThenAlways:
+		return true
+	case ThenOnFailure:
+		return err != nil
+	default:
+		return err == nil
+	}
+}
+
+// runThen runs command in dir, retrying it as set by
+// ThenRetries. It returns the output of the last attempt,
+// which is printed to os.Stderr as well, and how long that
+// attempt took.
+func (r *Repo) runThen(command, dir string) ([]byte, time.Duration, error) {
+	c, args, err := middleware.SplitCommandAndArgs(command)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	delay := r.ThenRetryDelay
+	for attempt := 0; ; attempt++ {
+		var output bytes.Buffer
+		cmd := r.command(c, args, dir, nil)
+		cmd.Stdout = io.MultiWriter(os.Stderr, &output)
+		cmd.Stderr = cmd.Stdout
+		start := time.Now()
+		err = runTimeout(cmd, r.timeout())
+		took := time.Since(start)
+		if err == nil {
+			logger().Printf("Command %v successful in %v.\n", command, took)
+			return output.Bytes(), took, nil
+		}
+		if attempt >= r.ThenRetries {
+			return output.Bytes(), took, err
+		}
+		logger().Printf("Command %v failed (attempt %d of %d), retrying in %v: %v\n", command, attempt+1, r.ThenRetries+1, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
@@ -0,0 +1,47 @@
+package git
+
+import (
+	"os"
+	"time"
+)
+
+// triggerPoll is how often the trigger file is checked for changes.
+const triggerPoll = time.Second
+
+// triggerDebounce is how long the trigger file must be left alone
+// after a change before pulling, so that a burst of changes, e.g.
+// by several CI jobs, causes a single pull.
+const triggerDebounce = 2 * time.Second
+
+// watchTrigger pulls r whenever the modification time of
+// TriggerFile changes, e.g. because it is touched. Creating
+// or removing the file counts as a change. It never returns.
+func (r *Repo) watchTrigger() {
+	last := modTime(r.TriggerFile)
+	var changed time.Time // when a change not pulled for yet was seen
+	for {
+		time.Sleep(triggerPoll)
+		if mtime := modTime(r.TriggerFile); !mtime.Equal(last) {
+			last = mtime
+			changed = time.Now()
+			continue
+		}
+		if !changed.IsZero() && time.Since(changed) >= triggerDebounce {
+			changed = time.Time{}
+			logger().Printf("%v changed, pulling %v.\n", r.TriggerFile, r.Url)
+			if err := r.ForcePull(); err != nil {
+				logger().Println(err)
+			}
+		}
+	}
+}
+
+// modTime returns the modification time of
+// file, or the zero time if it does not exist.
+func modTime(file string) time.Time {
+	fi, err := os.Stat(file)
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
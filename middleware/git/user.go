@@ -0,0 +1,73 @@
+package git
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+)
+
+// osUser is an OS user commands are run as.
+type osUser struct {
+	uid  uint32
+	gid  uint32
+	home string
+}
+
+// lookupUser looks up the user called name, or with the ID name,
+// and the group given the same way, if not empty. If group is
+// empty, the primary group of the user is used.
+func lookupUser(name, group string) (*osUser, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		if u, err = user.LookupId(name); err != nil {
+			return nil, fmt.Errorf("Unknown user %v", name)
+		}
+	}
+	gid := u.Gid
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			if g, err = user.LookupGroupId(group); err != nil {
+				return nil, fmt.Errorf("Unknown group %v", group)
+			}
+		}
+		gid = g.Gid
+	}
+
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot run commands as user %v: %v", name, err)
+	}
+	ugid, err := strconv.ParseUint(gid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot run commands as group %v: %v", gid, err)
+	}
+	return &osUser{uid: uint32(uid), gid: uint32(ugid), home: u.HomeDir}, nil
+}
+
+// checkUser makes sure commands can be run as the user of r,
+// which usually requires running as root.
+func (r *Repo) checkUser() error {
+	if _, err := r.runCmdOutput(gitBinary, []string{"--version"}, ""); err != nil {
+		return fmt.Errorf("Cannot run git as user %v: %v", r.User, err)
+	}
+	return nil
+}
+
+// chown hands the files over to the user of r, if any,
+// so that the commands run as the user can use them.
+func (r *Repo) chown(files ...*os.File) error {
+	if r.runAs == nil {
+		return nil
+	}
+	for _, file := range files {
+		if file == nil {
+			continue
+		}
+		if err := os.Chown(file.Name(), int(r.runAs.uid), int(r.runAs.gid)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
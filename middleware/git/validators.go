@@ -0,0 +1,105 @@
+package git
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// validators returns the ETag and Last-Modified time of the content
+// pulled as exposed by r, which are "" and the zero time if r does
+// not expose them or if they are not known yet.
+func (r *Repo) validators() (string, time.Time) {
+	r.state.RLock()
+	defer r.state.RUnlock()
+	etag := ""
+	if r.CommitETag && r.lastCommit != "" {
+		etag = `W/"` + r.lastCommit + `"`
+	}
+	var modified time.Time
+	if r.CommitModTime {
+		modified = r.lastCommitTime
+	}
+	return etag, modified
+}
+
+// notModified returns whether the client which sent req already has
+// the content with etag, or that modified at the time given, as it
+// asks for the content only if it is not.
+func notModified(req *http.Request, etag string, modified time.Time) bool {
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		if etag == "" {
+			return false
+		}
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+	if ims := req.Header.Get("If-Modified-Since"); ims != "" && !modified.IsZero() {
+		t, err := http.ParseTime(ims)
+		return err == nil && !modified.Truncate(time.Second).After(t)
+	}
+	return false
+}
+
+// validatorWriter sets the ETag and Last-Modified headers of
+// successful responses, replacing those of the file server,
+// which change with each checkout even if the files do not.
+type validatorWriter struct {
+	http.ResponseWriter
+	etag        string
+	modified    time.Time
+	wroteHeader bool
+}
+
+func (w *validatorWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if status >= 200 && status < 300 {
+			setValidators(w.Header(), w.etag, w.modified)
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *validatorWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// setValidators sets the headers for etag and modified,
+// if not empty or zero.
+func setValidators(header http.Header, etag string, modified time.Time) {
+	if etag != "" {
+		header.Set("ETag", etag)
+	}
+	if !modified.IsZero() {
+		header.Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+}
+
+// serveValidated answers conditional GET and HEAD requests for the
+// content pulled with 304 Not Modified if the client has it already,
+// and otherwise returns w wrapped to set the validators of the
+// content in the response. It returns false if it answered req.
+func (g Git) serveValidated(w http.ResponseWriter, req *http.Request) (http.ResponseWriter, bool) {
+	etag, modified := g.Repo.validators()
+	if etag == "" && modified.IsZero() {
+		return w, true
+	}
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return w, true
+	}
+	if notModified(req, etag, modified) {
+		setValidators(w.Header(), etag, modified)
+		w.WriteHeader(http.StatusNotModified)
+		return w, false
+	}
+	return &validatorWriter{ResponseWriter: w, etag: etag, modified: modified}, true
+}
@@ -0,0 +1,35 @@
+package git
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestNotModified(t *testing.T) {
+	modified := time.Date(2015, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		header, value string
+		expected      bool
+	}{
+		{"If-None-Match", `W/"abc"`, true},
+		{"If-None-Match", `"abc"`, true},
+		{"If-None-Match", `"old", W/"abc"`, true},
+		{"If-None-Match", `*`, true},
+		{"If-None-Match", `W/"old"`, false},
+		{"If-Modified-Since", modified.Format(http.TimeFormat), true},
+		{"If-Modified-Since", modified.Add(time.Hour).Format(http.TimeFormat), true},
+		{"If-Modified-Since", modified.Add(-time.Hour).Format(http.TimeFormat), false},
+		{"If-Modified-Since", "yesterday", false},
+		{"", "", false},
+	}
+	for i, test := range tests {
+		r, _ := http.NewRequest("GET", "/", nil)
+		if test.header != "" {
+			r.Header.Set(test.header, test.value)
+		}
+		if actual := notModified(r, `W/"abc"`, modified); actual != test.expected {
+			t.Errorf("Test %d: Expected %v for %s: %s, got %v", i, test.expected, test.header, test.value, actual)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package git
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// The signatures Verify may ask for.
+const (
+	VerifyCommit = "commit" // the commit checked out is signed
+	VerifyTag    = "tag"    // a tag pointing at the commit checked out is signed
+)
+
+// verify checks the signature Verify asks for of the commit checked
+// out in the clone at dir against the keys in VerifyKeyring, or those
+// of the user git runs as if it is not set.
+func (r *Repo) verify(dir string) error {
+	var env []string
+	if r.VerifyKeyring != "" {
+		env = append(os.Environ(), "GNUPGHOME="+r.VerifyKeyring)
+	}
+	if r.Verify == VerifyCommit {
+		if err := r.runCmdEnv(gitBinary, []string{"verify-commit", "HEAD"}, dir, env); err != nil {
+			return fmt.Errorf("%v: commit is not signed by a trusted key: %v", r.Url, err)
+		}
+		return nil
+	}
+
+	tags, err := r.runCmdOutput(gitBinary, []string{"tag", "--points-at", "HEAD"}, dir)
+	if err != nil {
+		return err
+	}
+	for _, tag := range strings.Fields(tags) {
+		if r.runCmdEnv(gitBinary, []string{"verify-tag", tag}, dir, env) == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("%v: no tag of the commit is signed by a trusted key", r.Url)
+}
+
+// verifyPull verifies the commit pulled into the clone at dir, and
+// checks out previous again if it cannot be, so that the content
+// stays at the last commit which could be.
+func (r *Repo) verifyPull(dir, previous string) error {
+	err := r.verify(dir)
+	if err == nil {
+		return nil
+	}
+	if resetErr := r.runCmd(gitBinary, []string{"reset", "--hard", previous}, dir); resetErr != nil {
+		return fmt.Errorf("%v; could not go back to %v: %v", err, previous, resetErr)
+	}
+	return fmt.Errorf("%v; keeping %v", err, previous)
+}
+
+// verifyClone verifies the commit cloned into dir, and removes
+// the clone if it cannot be, so that it is not served.
+func (r *Repo) verifyClone(dir string) error {
+	err := r.verify(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+	}
+	return err
+}
@@ -0,0 +1,75 @@
+package git
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// serveHook handles a webhook request from a git host like GitHub
+// or GitLab. Requests which cannot be verified to come from the
+// host are rejected; otherwise a pull is started in the background.
+func (g Git) serveHook(w http.ResponseWriter, r *http.Request) (int, error) {
+	if r.Method != "POST" {
+		return http.StatusMethodNotAllowed, nil
+	}
+
+	// the body is only needed to check the signature,
+	// so there is no need to take in more than a push
+	maxBody := g.Repo.HookMaxBody
+	if maxBody == 0 {
+		maxBody = DefaultHookMaxBody
+	}
+	if r.ContentLength > maxBody {
+		return http.StatusRequestEntityTooLarge, nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxBody+1))
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	if int64(len(body)) > maxBody {
+		return http.StatusRequestEntityTooLarge, nil
+	}
+
+	if !validHook(r, body, g.Repo.HookSecret) {
+		return http.StatusUnauthorized, nil
+	}
+
+	// GitHub sends a ping when the hook is created
+	if r.Header.Get("X-GitHub-Event") != "ping" {
+		go func() {
+			if err := g.Repo.ForcePull(); err != nil {
+				logger().Println(err)
+			}
+		}()
+	}
+
+	w.WriteHeader(http.StatusOK)
+	return http.StatusOK, nil
+}
+
+// validHook reports whether the webhook request r with the given
+// body is signed (GitHub) or authenticated (GitLab) with secret.
+func validHook(r *http.Request, body []byte, secret string) bool {
+	if sig := r.Header.Get("X-Hub-Signature-256"); sig != "" {
+		if !strings.HasPrefix(sig, "sha256=") {
+			return false
+		}
+		actual, err := hex.DecodeString(sig[len("sha256="):])
+		if err != nil {
+			return false
+		}
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		return hmac.Equal(actual, mac.Sum(nil))
+	}
+	if token := r.Header.Get("X-Gitlab-Token"); token != "" {
+		return subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1
+	}
+	return false
+}
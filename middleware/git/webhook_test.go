@@ -0,0 +1,147 @@
+package git
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const hookBody = `{"ref":"refs/heads/master"}`
+
+// hookSignature returns the X-Hub-Signature-256 GitHub
+// sends for body with the secret of a webhook.
+func hookSignature(secret, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// waitForPulls waits for repo to have attempted at least
+// count pulls, or fails the test after a while.
+func waitForPulls(t *testing.T, repo *Repo, count int64) {
+	for deadline := time.Now().Add(10 * time.Second); atomic.LoadInt64(&repo.pulls) < count; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d pulls, got %d", count, atomic.LoadInt64(&repo.pulls))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServeHook(t *testing.T) {
+	repo := newTestRepo(t)
+	repo.HookUrl = "/hook"
+	repo.HookSecret = "secret"
+	g := Git{Repo: repo}
+
+	tests := []struct {
+		method   string
+		header   string
+		value    string
+		expected int
+	}{
+		{"GET", "X-Hub-Signature-256", hookSignature("secret", hookBody), http.StatusMethodNotAllowed},
+		{"POST", "X-Hub-Signature-256", hookSignature("wrong", hookBody), http.StatusUnauthorized},
+		{"POST", "X-Hub-Signature-256", hookSignature("secret", hookBody+" "), http.StatusUnauthorized},
+		{"POST", "X-Hub-Signature-256", strings.TrimPrefix(hookSignature("secret", hookBody), "sha256="), http.StatusUnauthorized},
+		{"POST", "X-Hub-Signature-256", "sha1=" + strings.TrimPrefix(hookSignature("secret", hookBody), "sha256="), http.StatusUnauthorized},
+		{"POST", "X-Hub-Signature-256", "sha256=not hex", http.StatusUnauthorized},
+		{"POST", "X-Hub-Signature-256", "sha256=", http.StatusUnauthorized},
+		{"POST", "X-Gitlab-Token", "wrong", http.StatusUnauthorized},
+		{"POST", "X-Gitlab-Token", "secret ", http.StatusUnauthorized},
+		{"POST", "", "", http.StatusUnauthorized},
+		{"POST", "X-Hub-Signature-256", hookSignature("secret", hookBody), http.StatusOK},
+		{"POST", "X-Gitlab-Token", "secret", http.StatusOK},
+	}
+
+	var pulls int64
+	for i, test := range tests {
+		r := httptest.NewRequest(test.method, "/hook", strings.NewReader(hookBody))
+		if test.header != "" {
+			r.Header.Set(test.header, test.value)
+		}
+		w := httptest.NewRecorder()
+		status, err := g.ServeHTTP(w, r)
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got %v", i, err)
+		}
+		if status != test.expected {
+			t.Errorf("Test %d: Expected status %d, got %d", i, test.expected, status)
+		}
+		if status == http.StatusOK {
+			// pulls are one after another, so
+			// wait for each to count them apart
+			pulls++
+			waitForPulls(t, repo, pulls)
+		}
+		if got := atomic.LoadInt64(&repo.pulls); got != pulls {
+			t.Errorf("Test %d: Expected %d pulls, got %d", i, pulls, got)
+		}
+	}
+
+	// a ping is verified, but nothing was pushed to pull
+	r := httptest.NewRequest("POST", "/hook", strings.NewReader(hookBody))
+	r.Header.Set("X-Hub-Signature-256", hookSignature("secret", hookBody))
+	r.Header.Set("X-GitHub-Event", "ping")
+	if status, _ := g.ServeHTTP(httptest.NewRecorder(), r); status != http.StatusOK {
+		t.Errorf("Expected status %d for a ping, got %d", http.StatusOK, status)
+	}
+
+	// pulls which were wrongly started would be done by now
+	time.Sleep(100 * time.Millisecond)
+	if got := atomic.LoadInt64(&repo.pulls); got != pulls {
+		t.Errorf("Expected %d pulls in all, got %d", pulls, got)
+	}
+}
+
+func TestServeHookMaxBody(t *testing.T) {
+	repo := newTestRepo(t)
+	repo.HookUrl = "/hook"
+	repo.HookSecret = "secret"
+	repo.HookMaxBody = int64(len(hookBody))
+	g := Git{Repo: repo}
+
+	tests := []struct {
+		body     string
+		length   int64 // Content-Length, -1 if chunked, or 0 for that of body
+		expected int
+	}{
+		{hookBody, 0, http.StatusOK},
+		{hookBody, -1, http.StatusOK},
+		{hookBody + " ", 0, http.StatusRequestEntityTooLarge},
+		{hookBody + " ", -1, http.StatusRequestEntityTooLarge},
+		{strings.Repeat(" ", 1<<16), -1, http.StatusRequestEntityTooLarge},
+		// rejected by the Content-Length alone, before reading
+		{hookBody, int64(len(hookBody)) + 1, http.StatusRequestEntityTooLarge},
+	}
+
+	var pulls int64
+	for i, test := range tests {
+		r := httptest.NewRequest("POST", "/hook", strings.NewReader(test.body))
+		if test.length != 0 {
+			r.ContentLength = test.length
+		}
+		r.Header.Set("X-Hub-Signature-256", hookSignature("secret", test.body))
+		status, err := g.ServeHTTP(httptest.NewRecorder(), r)
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got %v", i, err)
+		}
+		if status != test.expected {
+			t.Errorf("Test %d: Expected status %d, got %d", i, test.expected, status)
+		}
+		if status == http.StatusOK {
+			pulls++
+			waitForPulls(t, repo, pulls)
+		}
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if got := atomic.LoadInt64(&repo.pulls); got != pulls {
+		t.Errorf("Expected %d pulls, got %d", pulls, got)
+	}
+}
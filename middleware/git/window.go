@@ -0,0 +1,99 @@
+package git
+
+import (
+	"fmt"
+	"time"
+)
+
+// windowPoll is how often the scheduler checks for pulls
+// which are due, and whether it is in the pull window, for
+// repos which are only pulled within one.
+const windowPoll = time.Minute
+
+// PullWindow is the time of day pulls are done within, in
+// local time. It wraps around midnight if End is before Start.
+type PullWindow struct {
+	Start  time.Duration // since midnight
+	End    time.Duration // since midnight
+	Bypass bool          // Pull for webhooks and trigger files at any time
+}
+
+// contains returns whether t is within w.
+func (w *PullWindow) contains(t time.Time) bool {
+	hour, min, sec := t.Clock()
+	now := time.Duration(hour)*time.Hour + time.Duration(min)*time.Minute + time.Duration(sec)*time.Second
+	if w.Start <= w.End {
+		return now >= w.Start && now < w.End
+	}
+	return now >= w.Start || now < w.End
+}
+
+func (w *PullWindow) String() string {
+	return fmt.Sprintf("%s-%s", clock(w.Start), clock(w.End))
+}
+
+// parseClock parses a time of day like 01:30 and
+// returns how long after midnight it is.
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid time of day %v, expected hh:mm", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// clock formats d after midnight as a time of day.
+func clock(d time.Duration) string {
+	return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+}
+
+// inWindow returns whether r may be pulled at t.
+func (r *Repo) inWindow(t time.Time) bool {
+	return r.Window == nil || r.Window.contains(t)
+}
+
+// schedule pulls r every Interval, only within Window if set,
+// unless r is ManualOnly. Pulls triggered outside of Window are
+// done once it opens. It never returns.
+func (r *Repo) schedule() {
+	for {
+		if r.Window == nil {
+			time.Sleep(r.Interval)
+		} else {
+			time.Sleep(windowPoll)
+		}
+		if r.inWindow(time.Now()) {
+			var err error
+			if r.takeDeferred() {
+				err = r.ForcePull()
+			} else if !r.ManualOnly {
+				err = r.Pull()
+			}
+			if err != nil {
+				logger().Println(err)
+			}
+		}
+		if r.Previews != nil {
+			r.Previews.Prune()
+		}
+	}
+}
+
+// deferPull notes that a pull was triggered outside of Window,
+// to be done once it opens.
+func (r *Repo) deferPull() {
+	r.state.Lock()
+	r.deferred = true
+	r.state.Unlock()
+	logger().Printf("%v is only pulled between %v, deferring pull.\n", r.Url, r.Window)
+}
+
+// takeDeferred returns whether a pull was deferred,
+// and forgets about it.
+func (r *Repo) takeDeferred() bool {
+	r.state.Lock()
+	defer r.state.Unlock()
+	deferred := r.deferred
+	r.deferred = false
+	return deferred
+}
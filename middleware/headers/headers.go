@@ -4,13 +4,25 @@
 package headers
 
 import (
+	"bufio"
+	"errors"
+	"net"
 	"net/http"
+	"path"
+	"regexp"
+	"strings"
 
 	"github.com/mholt/caddy/middleware"
 )
 
 // Headers is middleware that adds headers to the responses
-// for requests matching a certain path.
+// for requests matching a certain path. The headers of all the
+// rules that match are applied, in order, so where rules give
+// the same header, the rule that comes last wins. The rules
+// parsed from the config are ordered from the least to the most
+// specific, so the most specific rule wins: rules with a longer
+// path are more specific, and regular expressions are more
+// specific than paths. Equally specific rules keep their order.
 type Headers struct {
 	Next  middleware.Handler
 	Rules []HeaderRule
@@ -19,27 +31,158 @@ type Headers struct {
 // ServeHTTP implements the middleware.Handler interface and serves requests,
 // adding headers to the response according to the configured rules.
 func (h Headers) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	var defaults, removals []Header
 	for _, rule := range h.Rules {
-		if middleware.Path(r.URL.Path).Matches(rule.Url) {
-			for _, header := range rule.Headers {
-				w.Header().Set(header.Name, header.Value)
+		var match []int
+		if rule.Regexp != nil {
+			if match = rule.Regexp.FindStringSubmatchIndex(r.URL.Path); match == nil {
+				continue
+			}
+		} else if !rule.matchesPath(r.URL.Path) {
+			continue
+		}
+		for _, header := range rule.Headers {
+			if match != nil {
+				// substitute the captures of the path, like $1
+				header.Value = string(rule.Regexp.ExpandString(nil, header.Value, r.URL.Path, match))
+			}
+			if header.IfAbsent {
+				defaults = append(defaults, header)
+				continue
+			}
+			if header.Remove {
+				removals = append(removals, header)
+				continue
 			}
+			w.Header().Set(header.Name, header.Value)
 		}
 	}
+	if len(defaults) > 0 || len(removals) > 0 {
+		w = &headerWriter{ResponseWriter: w, defaults: defaults, removals: removals}
+	}
 	return h.Next.ServeHTTP(w, r)
 }
 
+// headerWriter is a ResponseWriter which changes the response
+// header just before it is written: it sets default headers that
+// were not set by the handlers further down the chain, and removes
+// headers that match the removals.
+type headerWriter struct {
+	http.ResponseWriter
+	defaults    []Header
+	removals    []Header
+	wroteHeader bool
+}
+
+// WriteHeader sets any missing default headers, removes
+// the headers to be removed and then writes the response
+// header with status.
+func (w *headerWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		// informational responses come before the final one
+		w.wroteHeader = status >= 200 || status == http.StatusSwitchingProtocols
+		// the defaults of later rules win, so they go first
+		for i := len(w.defaults) - 1; i >= 0; i-- {
+			header := w.defaults[i]
+			if _, ok := w.Header()[http.CanonicalHeaderKey(header.Name)]; !ok {
+				w.Header().Set(header.Name, header.Value)
+			}
+		}
+		for _, header := range w.removals {
+			for name := range w.Header() {
+				if header.matches(name) {
+					w.Header().Del(name)
+				}
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write writes buf as part of the response body,
+// writing the response header first if needed.
+func (w *headerWriter) Write(buf []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(buf)
+}
+
+// Hijack hijacks the connection of the underlying ResponseWriter,
+// e.g. for the proxy to pass on a WebSocket upgrade. The headers
+// are then up to whoever hijacked it.
+func (w *headerWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("Response writer does not support hijacking")
+	}
+	return hj.Hijack()
+}
+
+// Flush writes the response header if needed, so that
+// it is changed first, and flushes the underlying
+// ResponseWriter if it can be.
+func (w *headerWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 type (
 	// HeaderRule groups a slice of HTTP headers by a URL pattern.
+	// If Regexp is set, the rule applies to paths it matches instead
+	// of those starting with Url, and header values may refer to its
+	// capture groups, e.g. $1. If IgnoreCase is set, paths starting
+	// with Url in any case match, e.g. /API for /api; a Regexp
+	// should then be compiled to ignore case as well.
 	// TODO: use http.Header type instead?
 	HeaderRule struct {
-		Url     string
-		Headers []Header
+		Url        string
+		Regexp     *regexp.Regexp
+		IgnoreCase bool
+		Headers    []Header
 	}
 
 	// Header represents a single HTTP header, simply a name and value.
+	// If IfAbsent is true, the header is only set when the response
+	// does not already have it by the time it is written. If Remove
+	// is true, the headers matching Name are removed instead; Name
+	// may then be a pattern like X-Debug-*.
 	Header struct {
-		Name  string
-		Value string
+		Name     string
+		Value    string
+		IfAbsent bool
+		Remove   bool
 	}
 )
+
+// bySpecificity sorts header rules from the least
+// to the most specific.
+type bySpecificity []HeaderRule
+
+func (r bySpecificity) Len() int      { return len(r) }
+func (r bySpecificity) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r bySpecificity) Less(i, j int) bool {
+	if (r[i].Regexp == nil) != (r[j].Regexp == nil) {
+		return r[i].Regexp == nil
+	}
+	return r[i].Regexp == nil && len(r[i].Url) < len(r[j].Url)
+}
+
+// matchesPath returns whether the path-based rule r applies to path.
+func (r HeaderRule) matchesPath(path string) bool {
+	if r.IgnoreCase {
+		return middleware.Path(path).MatchesFold(r.Url)
+	}
+	return middleware.Path(path).Matches(r.Url)
+}
+
+// matches returns whether the header called name is matched
+// by h, ignoring case.
+func (h Header) matches(name string) bool {
+	ok, _ := path.Match(strings.ToLower(h.Name), strings.ToLower(name))
+	return ok
+}
@@ -0,0 +1,349 @@
+package headers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/mholt/caddy/middleware"
+)
+
+func TestOverlappingRules(t *testing.T) {
+	// in config order; the most specific rule
+	// must win wherever they give the same header
+	rules := []HeaderRule{
+		{Url: "~\\.css$", Regexp: regexp.MustCompile(`\.css$`), Headers: []Header{
+			{Name: "Cache-Control", Value: "max-age=86400"},
+		}},
+		{Url: "/static", Headers: []Header{
+			{Name: "Cache-Control", Value: "max-age=3600"},
+			{Name: "X-Frame-Options", Value: "SAMEORIGIN", IfAbsent: true},
+		}},
+		{Url: "/", Headers: []Header{
+			{Name: "Cache-Control", Value: "no-cache"},
+			{Name: "X-Frame-Options", Value: "DENY", IfAbsent: true},
+			{Name: "X-Site", Value: "example"},
+		}},
+		{Url: "/static/fonts", Headers: []Header{
+			{Name: "Access-Control-Allow-Origin", Value: "*"},
+		}},
+		{Url: "/", Headers: []Header{
+			{Name: "X-Site", Value: "example.com"},
+		}},
+	}
+	sort.Stable(bySpecificity(rules))
+
+	h := Headers{
+		Next: middleware.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			w.Write([]byte("ok"))
+			return 0, nil
+		}),
+		Rules: rules,
+	}
+
+	tests := []struct {
+		path     string
+		expected map[string]string
+	}{
+		{"/index.html", map[string]string{
+			"Cache-Control":   "no-cache",
+			"X-Frame-Options": "DENY",
+			"X-Site":          "example.com",
+		}},
+		{"/static/app.js", map[string]string{
+			"Cache-Control":   "max-age=3600",
+			"X-Frame-Options": "SAMEORIGIN",
+			"X-Site":          "example.com",
+		}},
+		{"/static/app.css", map[string]string{
+			"Cache-Control":   "max-age=86400",
+			"X-Frame-Options": "SAMEORIGIN",
+		}},
+		{"/static/fonts/font.woff", map[string]string{
+			"Cache-Control":               "max-age=3600",
+			"Access-Control-Allow-Origin": "*",
+		}},
+	}
+
+	for i, test := range tests {
+		r, err := http.NewRequest("GET", test.path, nil)
+		if err != nil {
+			t.Fatalf("Test %d: Could not create request: %v", i, err)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		for name, value := range test.expected {
+			if got := w.Header().Get(name); got != value {
+				t.Errorf("Test %d: Expected %s to be '%s', got '%s'", i, name, value, got)
+			}
+		}
+	}
+}
+
+func TestIgnoreCase(t *testing.T) {
+	h := Headers{
+		Next: middleware.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			return 0, nil
+		}),
+		Rules: []HeaderRule{
+			{Url: "/api", Headers: []Header{{Name: "X-Sensitive", Value: "yes"}}},
+			{Url: "/api", IgnoreCase: true, Headers: []Header{{Name: "X-Insensitive", Value: "yes"}}},
+		},
+	}
+
+	tests := []struct {
+		path        string
+		sensitive   bool
+		insensitive bool
+	}{
+		{"/api/users", true, true},
+		{"/API/users", false, true},
+		{"/Api", false, true},
+		{"/ap", false, false},
+	}
+
+	for i, test := range tests {
+		r, err := http.NewRequest("GET", test.path, nil)
+		if err != nil {
+			t.Fatalf("Test %d: Could not create request: %v", i, err)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if got := w.Header().Get("X-Sensitive") != ""; got != test.sensitive {
+			t.Errorf("Test %d: Expected case sensitive match %v, got %v", i, test.sensitive, got)
+		}
+		if got := w.Header().Get("X-Insensitive") != ""; got != test.insensitive {
+			t.Errorf("Test %d: Expected case insensitive match %v, got %v", i, test.insensitive, got)
+		}
+	}
+}
+
+func TestHijackAndFlush(t *testing.T) {
+	h := Headers{
+		Next: middleware.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			if r.URL.Path == "/stream" {
+				w.Header().Set("X-Debug-Id", "1")
+				w.(http.Flusher).Flush()
+				w.Write([]byte("streamed"))
+				return 0, nil
+			}
+			conn, brw, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				return http.StatusInternalServerError, err
+			}
+			defer conn.Close()
+			brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+			brw.Flush()
+			return 0, nil
+		}),
+		Rules: []HeaderRule{
+			{Url: "/", Headers: []Header{{Name: "X-Debug-*", Remove: true}}},
+		},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := h.ServeHTTP(w, r); err != nil {
+			t.Errorf("Expected no error, got %v", err)
+		}
+	}))
+	defer server.Close()
+
+	r, _ := http.NewRequest("GET", server.URL+"/socket", nil)
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	res, err := http.DefaultTransport.RoundTrip(r)
+	if err != nil {
+		t.Fatalf("Expected no error upgrading, got %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Errorf("Expected status %d from the hijacked connection, got %d", http.StatusSwitchingProtocols, res.StatusCode)
+	}
+
+	res, err = http.Get(server.URL + "/stream")
+	if err != nil {
+		t.Fatalf("Expected no error streaming, got %v", err)
+	}
+	res.Body.Close()
+	if res.Header.Get("X-Debug-Id") != "" {
+		t.Errorf("Expected the header to be removed before flushing, got '%s'", res.Header.Get("X-Debug-Id"))
+	}
+	if len(res.TransferEncoding) == 0 || res.TransferEncoding[0] != "chunked" {
+		t.Errorf("Expected a flushed, chunked response, got %v", res.TransferEncoding)
+	}
+}
+
+func TestDefaults(t *testing.T) {
+	// in config order; later defaults win
+	rules := []HeaderRule{
+		{Url: "/", Headers: []Header{{Name: "Cache-Control", Value: "no-cache", IfAbsent: true}}},
+		{Url: "/static", Headers: []Header{{Name: "Cache-Control", Value: "max-age=3600", IfAbsent: true}}},
+	}
+
+	tests := []struct {
+		path     string
+		backend  string // value the backend sets, if any
+		status   int    // status the backend writes, or 0 to only write a body
+		expected string
+	}{
+		{"/index.html", "", 0, "no-cache"},
+		{"/index.html", "private", 0, "private"},
+		{"/index.html", "", http.StatusNotFound, "no-cache"},
+		{"/index.html", "private", http.StatusNotFound, "private"},
+		{"/static/app.js", "", 0, "max-age=3600"},
+		{"/static/app.js", "private", 0, "private"},
+	}
+
+	for i, test := range tests {
+		h := Headers{
+			Next: middleware.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+				if test.backend != "" {
+					w.Header().Set("Cache-Control", test.backend)
+				}
+				if test.status != 0 {
+					w.WriteHeader(test.status)
+				}
+				w.Write([]byte("ok"))
+				return 0, nil
+			}),
+			Rules: rules,
+		}
+		r, err := http.NewRequest("GET", test.path, nil)
+		if err != nil {
+			t.Fatalf("Test %d: Could not create request: %v", i, err)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if got := w.Header().Get("Cache-Control"); got != test.expected {
+			t.Errorf("Test %d: Expected Cache-Control to be '%s', got '%s'", i, test.expected, got)
+		}
+		if test.status != 0 && w.Code != test.status {
+			t.Errorf("Test %d: Expected status %d, got %d", i, test.status, w.Code)
+		}
+	}
+}
+
+func TestRemovals(t *testing.T) {
+	h := Headers{
+		Next: middleware.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			// as set by a backend
+			w.Header().Set("Server", "backend")
+			w.Header().Set("X-Debug-Id", "1")
+			w.Header().Set("x-debug-time", "2ms")
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte("ok"))
+			return 0, nil
+		}),
+		Rules: []HeaderRule{
+			{Url: "/", Headers: []Header{
+				{Name: "X-Powered-By", Value: "caddy"},
+				{Name: "Server", Remove: true},
+			}},
+			{Url: "/app", Headers: []Header{
+				{Name: "X-Debug-*", Remove: true},
+				{Name: "x-powered-by", Remove: true},
+			}},
+		},
+	}
+
+	tests := []struct {
+		path    string
+		removed []string
+		kept    []string
+	}{
+		{"/index.html", []string{"Server"}, []string{"X-Debug-Id", "X-Debug-Time", "X-Powered-By", "Content-Type"}},
+		{"/app/users", []string{"Server", "X-Debug-Id", "X-Debug-Time", "X-Powered-By"}, []string{"Content-Type"}},
+	}
+
+	for i, test := range tests {
+		r, err := http.NewRequest("GET", test.path, nil)
+		if err != nil {
+			t.Fatalf("Test %d: Could not create request: %v", i, err)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		for _, name := range test.removed {
+			if got, ok := w.Header()[name]; ok {
+				t.Errorf("Test %d: Expected %s to be removed, got '%s'", i, name, got)
+			}
+		}
+		for _, name := range test.kept {
+			if w.Header().Get(name) == "" {
+				t.Errorf("Test %d: Expected %s to be kept", i, name)
+			}
+		}
+		if w.Body.String() != "ok" {
+			t.Errorf("Test %d: Expected body 'ok', got '%s'", i, w.Body.String())
+		}
+	}
+}
+
+func TestCaptures(t *testing.T) {
+	tests := []struct {
+		pattern  string // "~" and a regexp, or a path
+		value    string
+		path     string
+		expected string
+	}{
+		// a capture group
+		{`~^/users/(\w+)`, "user-$1", "/users/alice/posts", "user-alice"},
+		// multiple groups, in any order, and by name
+		{`~^/(\w+)/(\d+)$`, "$2 of $1", "/posts/7", "7 of posts"},
+		{`~^/(?P<kind>\w+)/(\d+)$`, "${kind}-${2}", "/posts/7", "posts-7"},
+		// $0 is the whole match, and missing groups are empty
+		{`~^/files/(.*)$`, "$0", "/files/a.txt", "/files/a.txt"},
+		{`~^/files/(.*)$`, "[$2]", "/files/a.txt", "[]"},
+		{`~^/files/(.*)$`, "[$name]", "/files/a.txt", "[]"},
+		// $$ is a literal $, as is a $ without a name
+		{`~^/price/(\d+)$`, "$$$1", "/price/5", "$5"},
+		{`~^/price/(\d+)$`, "$1 $", "/price/5", "5 $"},
+		// values of rules without a regexp are left alone
+		{"/users", "user-$1", "/users/alice", "user-$1"},
+		{"/price", "$$5", "/price/5", "$$5"},
+	}
+
+	for i, test := range tests {
+		rule := HeaderRule{Url: test.pattern, Headers: []Header{{Name: "X-Value", Value: test.value}}}
+		if strings.HasPrefix(test.pattern, "~") {
+			rule.Regexp = regexp.MustCompile(test.pattern[1:])
+		}
+		h := Headers{
+			Next: middleware.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+				return 0, nil
+			}),
+			Rules: []HeaderRule{rule},
+		}
+		r, err := http.NewRequest("GET", test.path, nil)
+		if err != nil {
+			t.Fatalf("Test %d: Could not create request: %v", i, err)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if got := w.Header().Get("X-Value"); got != test.expected {
+			t.Errorf("Test %d: Expected X-Value to be '%s', got '%s'", i, test.expected, got)
+		}
+		if rule.Headers[0].Value != test.value {
+			t.Errorf("Test %d: Expected the value of the rule to stay '%s', got '%s'", i, test.value, rule.Headers[0].Value)
+		}
+	}
+}
+
+func TestNewHeader(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected Header
+	}{
+		{"X-Frame-Options", Header{Name: "X-Frame-Options"}},
+		{"?X-Frame-Options", Header{Name: "X-Frame-Options", IfAbsent: true}},
+		{"-Server", Header{Name: "Server", Remove: true}},
+		{"-X-Debug-*", Header{Name: "X-Debug-*", Remove: true}},
+	}
+
+	for i, test := range tests {
+		if got := newHeader(test.name); got != test.expected {
+			t.Errorf("Test %d: Expected %+v, got %+v", i, test.expected, got)
+		}
+	}
+}
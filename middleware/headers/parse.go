@@ -1,6 +1,12 @@
 package headers
 
-import "github.com/mholt/caddy/middleware"
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/mholt/caddy/middleware"
+)
 
 func parse(c middleware.Controller) ([]HeaderRule, error) {
 	var rules []HeaderRule
@@ -26,12 +32,31 @@ func parse(c middleware.Controller) ([]HeaderRule, error) {
 		if head.Url == "" {
 			head.Url = pattern
 			isNewPattern = true
+
+			// a leading "~" makes the pattern a regular expression,
+			// compiled once here rather than for every request
+			if strings.HasPrefix(pattern, "~") {
+				re, err := regexp.Compile(pattern[1:])
+				if err != nil {
+					return rules, c.Err("Invalid header path pattern: " + err.Error())
+				}
+				head.Regexp = re
+			}
 		}
 
 		for c.NextBlock() {
 			// A block of headers was opened...
 
-			h := Header{Name: c.Val()}
+			if c.Val() == "case_insensitive" {
+				// ...which may say how to match the path
+				if c.NextArg() {
+					return rules, c.ArgErr()
+				}
+				head.IgnoreCase = true
+				continue
+			}
+
+			h := newHeader(c.Val())
 
 			if c.NextArg() {
 				h.Value = c.Val()
@@ -42,7 +67,7 @@ func parse(c middleware.Controller) ([]HeaderRule, error) {
 		if c.NextArg() {
 			// ... or single header was defined as an argument instead.
 
-			h := Header{Name: c.Val()}
+			h := newHeader(c.Val())
 
 			h.Value = c.Val()
 
@@ -53,6 +78,10 @@ func parse(c middleware.Controller) ([]HeaderRule, error) {
 			head.Headers = append(head.Headers, h)
 		}
 
+		if head.IgnoreCase && head.Regexp != nil && !strings.HasPrefix(head.Regexp.String(), "(?i)") {
+			head.Regexp = regexp.MustCompile("(?i)" + head.Regexp.String())
+		}
+
 		if isNewPattern {
 			rules = append(rules, head)
 		} else {
@@ -65,5 +94,20 @@ func parse(c middleware.Controller) ([]HeaderRule, error) {
 		}
 	}
 
+	// the most specific rules are applied last, so they win
+	sort.Stable(bySpecificity(rules))
 	return rules, nil
 }
+
+// newHeader makes a Header from the name given in the config.
+// A leading "?" means the header is only a default value, and a
+// leading "-" means headers matching the name are removed.
+func newHeader(name string) Header {
+	if strings.HasPrefix(name, "?") {
+		return Header{Name: name[1:], IfAbsent: true}
+	}
+	if strings.HasPrefix(name, "-") {
+		return Header{Name: name[1:], Remove: true}
+	}
+	return Header{Name: name}
+}
@@ -1,7 +1,10 @@
 // Package middleware provides some types and functions common among middleware.
 package middleware
 
-import "net/http"
+import (
+	"fmt"
+	"net/http"
+)
 
 type (
 	// Generator represents the outer layer of a middleware that
@@ -117,6 +120,7 @@ type (
 		ArgErr() error
 
 		// Err generates a custom parse error with a message of msg.
+		// The error is a *ParseError.
 		Err(string) error
 	}
 )
@@ -130,3 +134,16 @@ type HandlerFunc func(http.ResponseWriter, *http.Request) (int, error)
 func (f HandlerFunc) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
 	return f(w, r)
 }
+
+// ParseError is an error in the configuration of a middleware,
+// at Line of File. Dispensers return errors of this type.
+type ParseError struct {
+	File    string
+	Line    int
+	Message string
+}
+
+// Error implements the error interface.
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%s:%d - Parse error: %s", e.File, e.Line, e.Message)
+}
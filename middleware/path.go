@@ -11,3 +11,10 @@ type Path string
 func (p Path) Matches(other string) bool {
 	return strings.HasPrefix(string(p), other)
 }
+
+// MatchesFold is like Matches, but ignores case, so
+// that /API/users matches /api. It is opt-in for the
+// middleware that supports it.
+func (p Path) MatchesFold(other string) bool {
+	return len(p) >= len(other) && strings.EqualFold(string(p)[:len(other)], other)
+}
@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+)
+
+// A FailureKind tells how a request to a backend failed.
+type FailureKind int
+
+// The ways a request to a backend can fail.
+const (
+	FailureOther   FailureKind = iota // none of the below
+	FailureDial                       // no connection could be made
+	FailureTLS                        // the TLS handshake failed, e.g. over the certificate
+	FailureTimeout                    // the backend did not respond in time
+	FailureRead                       // the connection broke before a response was read
+)
+
+func (k FailureKind) String() string {
+	switch k {
+	case FailureDial:
+		return "dial"
+	case FailureTLS:
+		return "tls"
+	case FailureTimeout:
+		return "timeout"
+	case FailureRead:
+		return "read"
+	}
+	return "other"
+}
+
+// BackendError is the error of a request to a backend
+// which got no response, with how the request failed.
+type BackendError struct {
+	Kind FailureKind
+	Err  error
+}
+
+func (e *BackendError) Error() string {
+	return e.Kind.String() + ": " + e.Err.Error()
+}
+
+// Unwrap returns the error of the transport.
+func (e *BackendError) Unwrap() error {
+	return e.Err
+}
+
+// Retryable returns whether the request may succeed if it is
+// tried again. A failed TLS handshake, e.g. because of a
+// certificate which does not match, fails every time.
+func (e *BackendError) Retryable() bool {
+	return e.Kind != FailureTLS
+}
+
+// failureKind returns how the request which failed with err
+// failed, and false if err is not a BackendError.
+func failureKind(err error) (FailureKind, bool) {
+	var backendErr *BackendError
+	if errors.As(err, &backendErr) {
+		return backendErr.Kind, true
+	}
+	return FailureOther, false
+}
+
+// newBackendError classifies err, an error returned by
+// the transport for a request to a backend.
+func newBackendError(err error) *BackendError {
+	return &BackendError{Kind: classifyFailure(err), Err: err}
+}
+
+// classifyFailure returns how the request which failed with err
+// failed. TLS errors are told apart first, as they come with net
+// errors; timeouts next, as dial timeouts are timeouts too. Alerts
+// the backend sends are not told apart from other read errors, as
+// crypto/tls gives them no type of their own.
+func classifyFailure(err error) FailureKind {
+	if tlsFailure(err) {
+		return FailureTLS
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return FailureTimeout
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		if opErr.Op == "dial" {
+			return FailureDial
+		}
+		return FailureRead
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return FailureRead
+	}
+	return FailureOther
+}
+
+// tlsFailure returns whether err is, or wraps, an error
+// of the TLS handshake or of verifying a certificate.
+func tlsFailure(err error) bool {
+	var recordErr tls.RecordHeaderError
+	var certErr *tls.CertificateVerificationError
+	var alertErr tls.AlertError
+	var echErr *tls.ECHRejectionError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	return errors.As(err, &recordErr) || errors.As(err, &certErr) || errors.As(err, &alertErr) ||
+		errors.As(err, &echErr) || errors.As(err, &authorityErr) || errors.As(err, &hostnameErr) ||
+		errors.As(err, &invalidErr)
+}
@@ -0,0 +1,333 @@
+package proxy
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultCacheStatusHeader is the response header which tells
+// whether a response was served from the cache, if cache_status
+// is given without a header name.
+const DefaultCacheStatusHeader = "X-Cache"
+
+// Cache keeps responses to GET requests in memory so that they can be
+// served again without asking the backend while they are fresh, as
+// given by the Cache-Control or Expires headers of the response. HEAD
+// requests are answered from the responses kept as well. Stale
+// responses with an ETag or Last-Modified header are revalidated with
+// a conditional request. Always use NewCache to get one of these.
+type Cache struct {
+	// Maximum number of bytes of response bodies kept;
+	// the least recently used responses are evicted first
+	MaxSize int64
+
+	// Longest time a response is served from the cache
+	// without revalidation, or 0 for no limit
+	MaxAge time.Duration
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List // of *cacheEntry, most recently used first
+	entries map[string]*list.Element
+}
+
+// cacheEntry is a response kept in a Cache.
+type cacheEntry struct {
+	key     string
+	status  int
+	header  http.Header
+	body    []byte
+	vary    map[string]string // request headers the response varies by
+	stored  time.Time
+	expires time.Time
+}
+
+// NewCache makes a new cache which keeps at most maxSize bytes of
+// responses, each fresh for at most maxAge if it is not zero.
+func NewCache(maxSize int64, maxAge time.Duration) *Cache {
+	return &Cache{
+		MaxSize: maxSize,
+		MaxAge:  maxAge,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// cacheableRequest returns whether the response to r may be
+// served from a cache, and stored in one if r is a GET request.
+func cacheableRequest(r *http.Request) bool {
+	if (r.Method != "GET" && r.Method != "HEAD") || r.Header.Get("Authorization") != "" || r.Header.Get("Range") != "" {
+		return false
+	}
+	cc := cacheControl(r.Header)
+	_, noStore := cc["no-store"]
+	_, noCache := cc["no-cache"]
+	return !noStore && !noCache && r.Header.Get("Pragma") != "no-cache"
+}
+
+// conditionalRequest returns whether r is made
+// conditional on the version the client has.
+func conditionalRequest(r *http.Request) bool {
+	return r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != ""
+}
+
+// cacheKey returns the key the response to outreq, a request
+// to a host of pool, is stored with. The responses of the hosts
+// of one pool are shared, but those of a canary or a route are
+// told apart. So are those for different Hosts, if outreq is not
+// sent with just the Host of the host, e.g. with host_header {host}.
+func cacheKey(pool string, outreq *http.Request) string {
+	host := outreq.Host
+	if host == outreq.URL.Host {
+		host = ""
+	}
+	return pool + " " + host + outreq.URL.RequestURI()
+}
+
+// get returns the response stored for the request r with key,
+// or nil if there is none.
+func (c *Cache) get(key string, r *http.Request) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := el.Value.(*cacheEntry)
+	for name, value := range entry.vary {
+		if r.Header.Get(name) != value {
+			return nil
+		}
+	}
+	c.lru.MoveToFront(el)
+	return entry
+}
+
+// put stores the response with status, header and body to
+// the request r with key, if the response may be stored.
+func (c *Cache) put(key string, r *http.Request, status int, header http.Header, body []byte) {
+	if status != http.StatusOK || header.Get("Set-Cookie") != "" || int64(len(body)) > c.MaxSize {
+		return
+	}
+	now := time.Now()
+	age, ok := c.freshness(header, now)
+	if !ok {
+		return
+	}
+	entry := &cacheEntry{
+		key:     key,
+		status:  status,
+		header:  cloneHeader(header),
+		body:    body,
+		stored:  now,
+		expires: now.Add(age),
+	}
+	for _, names := range header["Vary"] {
+		for _, name := range strings.Split(names, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return
+			}
+			if entry.vary == nil {
+				entry.vary = make(map[string]string)
+			}
+			entry.vary[name] = r.Header.Get(name)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	c.size += int64(len(body))
+	for c.size > c.MaxSize {
+		c.remove(c.lru.Back())
+	}
+}
+
+// revalidated returns entry updated with the header of the
+// Not Modified response the backend confirmed it with, and
+// replaces entry in the cache with it. Entries are never
+// changed in place, as they may be being served.
+func (c *Cache) revalidated(entry *cacheEntry, header http.Header) *cacheEntry {
+	now := time.Now()
+	updated := *entry
+	updated.header = cloneHeader(entry.header)
+	for _, name := range []string{"Cache-Control", "Date", "ETag", "Expires", "Last-Modified"} {
+		if value, ok := header[name]; ok {
+			updated.header[name] = value
+		}
+	}
+	age, ok := c.freshness(updated.header, now)
+	updated.stored = now
+	updated.expires = now.Add(age)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, found := c.entries[entry.key]; found && el.Value == entry {
+		if ok {
+			el.Value = &updated
+		} else {
+			c.remove(el)
+		}
+	}
+	return &updated
+}
+
+// remove removes the entry of el from the cache. c must be locked.
+func (c *Cache) remove(el *list.Element) {
+	entry := c.lru.Remove(el).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= int64(len(entry.body))
+}
+
+// freshness returns for how long a response with header may be
+// served without revalidation, and false if it may not be stored.
+func (c *Cache) freshness(header http.Header, now time.Time) (time.Duration, bool) {
+	cc := cacheControl(header)
+	if _, ok := cc["no-store"]; ok {
+		return 0, false
+	}
+	if _, ok := cc["private"]; ok {
+		return 0, false
+	}
+
+	var age time.Duration
+	explicit := true
+	if _, ok := cc["no-cache"]; ok {
+		age = 0
+	} else if s, ok := cc["s-maxage"]; ok {
+		age = parseSeconds(s)
+	} else if s, ok := cc["max-age"]; ok {
+		age = parseSeconds(s)
+	} else if expires, err := http.ParseTime(header.Get("Expires")); err == nil {
+		date, err := http.ParseTime(header.Get("Date"))
+		if err != nil {
+			date = now
+		}
+		age = expires.Sub(date)
+	} else {
+		explicit = false
+	}
+
+	// without an explicit lifetime, a response is only worth keeping
+	// if it can be revalidated on every request
+	validator := header.Get("ETag") != "" || header.Get("Last-Modified") != ""
+	if !explicit && !validator {
+		return 0, false
+	}
+	if age < 0 {
+		age = 0
+	}
+	if c.MaxAge > 0 && age > c.MaxAge {
+		age = c.MaxAge
+	}
+	return age, age > 0 || validator
+}
+
+// fresh returns whether entry may be served without revalidation.
+func (entry *cacheEntry) fresh(now time.Time) bool {
+	return now.Before(entry.expires)
+}
+
+// condition sets the headers of r to ask the backend
+// whether entry is still up to date.
+func (entry *cacheEntry) condition(r *http.Request) {
+	if etag := entry.header.Get("ETag"); etag != "" {
+		r.Header.Set("If-None-Match", etag)
+	}
+	if modified := entry.header.Get("Last-Modified"); modified != "" {
+		r.Header.Set("If-Modified-Since", modified)
+	}
+}
+
+// serve writes entry as the response to rw,
+// without the body if it is for a HEAD request.
+func (entry *cacheEntry) serve(rw http.ResponseWriter, now time.Time, head bool) {
+	copyHeader(rw.Header(), entry.header)
+	rw.Header().Set("Age", strconv.Itoa(int(now.Sub(entry.stored).Seconds())))
+	rw.WriteHeader(entry.status)
+	if !head {
+		rw.Write(entry.body)
+	}
+}
+
+// cacheControl returns the directives of the
+// Cache-Control header in h and their values.
+func cacheControl(h http.Header) map[string]string {
+	cc := make(map[string]string)
+	for _, header := range h["Cache-Control"] {
+		for _, directive := range strings.Split(header, ",") {
+			directive = strings.ToLower(strings.TrimSpace(directive))
+			if directive == "" {
+				continue
+			}
+			name, value := directive, ""
+			if eq := strings.Index(directive, "="); eq >= 0 {
+				name, value = directive[:eq], strings.Trim(directive[eq+1:], `"`)
+			}
+			cc[name] = value
+		}
+	}
+	return cc
+}
+
+// parseSeconds parses a number of seconds, which is
+// 0 if it is invalid.
+func parseSeconds(s string) time.Duration {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return time.Duration(n) * time.Second
+}
+
+// cloneHeader returns a copy of h.
+func cloneHeader(h http.Header) http.Header {
+	clone := make(http.Header, len(h))
+	copyHeader(clone, h)
+	return clone
+}
+
+// cacheBuffer collects a response body to store until it
+// gets larger than max, and notes whether all of it was read.
+type cacheBuffer struct {
+	r        io.Reader
+	buf      bytes.Buffer
+	max      int64
+	overflow bool
+	complete bool
+}
+
+func (b *cacheBuffer) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if !b.overflow {
+		if int64(b.buf.Len()+n) > b.max {
+			b.overflow = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF {
+		b.complete = true
+	}
+	return n, err
+}
+
+// body returns the body read if all of it was
+// read and kept, or nil otherwise.
+func (b *cacheBuffer) body() []byte {
+	if !b.complete || b.overflow {
+		return nil
+	}
+	return b.buf.Bytes()
+}
@@ -0,0 +1,246 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestCache(t *testing.T) {
+	var requests, full int
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch r.URL.Path {
+		case "/fresh":
+			w.Header().Set("Cache-Control", "public, max-age=60")
+		case "/nostore":
+			w.Header().Set("Cache-Control", "no-store")
+		case "/revalidate":
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		case "/vary":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Vary", "Accept-Language")
+			w.Write([]byte(r.Header.Get("Accept-Language")))
+			full++
+			return
+		}
+		full++
+		fmt.Fprintf(w, "response %d", full)
+	}))
+	defer backend.Close()
+
+	backendUrl, _ := url.Parse(backend.URL)
+	p := NewSingleHostReverseProxy(backendUrl)
+	p.Cache = NewCache(1024, 0)
+
+	get := func(path string, header http.Header) *httptest.ResponseRecorder {
+		r, err := http.NewRequest("GET", path, nil)
+		if err != nil {
+			t.Fatalf("Could not create request: %v", err)
+		}
+		for name, values := range header {
+			r.Header[name] = values
+		}
+		w := httptest.NewRecorder()
+		if err := p.ServeHTTP(w, r, nil); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		return w
+	}
+
+	tests := []struct {
+		path     string
+		header   http.Header
+		body     string
+		requests int
+	}{
+		{"/fresh", nil, "response 1", 1},
+		{"/fresh", nil, "response 1", 1},                                                  // served from the cache
+		{"/fresh", http.Header{"Cache-Control": {"no-cache"}}, "response 2", 2},           // client asks to bypass it
+		{"/fresh", http.Header{"Authorization": {"Basic Zm9vOmJhcg=="}}, "response 3", 3}, // private request
+		{"/nostore", nil, "response 4", 4},
+		{"/nostore", nil, "response 5", 5},
+		{"/revalidate", nil, "response 6", 6},
+		{"/revalidate", nil, "response 6", 7}, // revalidated with the backend
+		{"/vary", http.Header{"Accept-Language": {"en"}}, "en", 8},
+		{"/vary", http.Header{"Accept-Language": {"en"}}, "en", 8},
+		{"/vary", http.Header{"Accept-Language": {"de"}}, "de", 9},
+	}
+	for i, test := range tests {
+		w := get(test.path, test.header)
+		if w.Code != http.StatusOK {
+			t.Errorf("Test %d: Expected status 200, got %d", i, w.Code)
+		}
+		if w.Body.String() != test.body {
+			t.Errorf("Test %d: Expected body '%s', got '%s'", i, test.body, w.Body.String())
+		}
+		if requests != test.requests {
+			t.Errorf("Test %d: Expected %d requests to the backend, got %d", i, test.requests, requests)
+		}
+	}
+	if full != 8 {
+		t.Errorf("Expected 8 full responses from the backend, got %d", full)
+	}
+}
+
+func TestCacheHead(t *testing.T) {
+	var requests int
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("cached"))
+	}))
+	defer backend.Close()
+
+	backendUrl, _ := url.Parse(backend.URL)
+	p := NewSingleHostReverseProxy(backendUrl)
+	p.Cache = NewCache(1024, 0)
+
+	for i, method := range []string{"HEAD", "GET", "HEAD"} {
+		r, err := http.NewRequest(method, "/", nil)
+		if err != nil {
+			t.Fatalf("Test %d: Could not create request: %v", i, err)
+		}
+		w := httptest.NewRecorder()
+		if err := p.ServeHTTP(w, r, nil); err != nil {
+			t.Fatalf("Test %d: Expected no error, got %v", i, err)
+		}
+		expected := "cached"
+		if method == "HEAD" {
+			expected = ""
+		}
+		if w.Body.String() != expected {
+			t.Errorf("Test %d: Expected body '%s', got '%s'", i, expected, w.Body.String())
+		}
+	}
+	// the response to HEAD is not stored, but the one to GET is
+	if requests != 2 {
+		t.Errorf("Expected 2 requests to the backend, got %d", requests)
+	}
+}
+
+func TestCacheStatus(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("cached"))
+	}))
+	defer backend.Close()
+
+	backendUrl, _ := url.Parse(backend.URL)
+	p := NewSingleHostReverseProxy(backendUrl)
+	p.Cache = NewCache(1024, 0)
+	p.CacheStatusHeader = DefaultCacheStatusHeader
+
+	tests := []struct {
+		method   string
+		expected string
+	}{
+		{"GET", "MISS"},
+		{"GET", "HIT"},
+		{"POST", "BYPASS"},
+	}
+	for i, test := range tests {
+		r, err := http.NewRequest(test.method, "/", nil)
+		if err != nil {
+			t.Fatalf("Test %d: Could not create request: %v", i, err)
+		}
+		w := httptest.NewRecorder()
+		if err := p.ServeHTTP(w, r, nil); err != nil {
+			t.Fatalf("Test %d: Expected no error, got %v", i, err)
+		}
+		if got := w.Header().Get("X-Cache"); got != test.expected {
+			t.Errorf("Test %d: Expected X-Cache '%s', got '%s'", i, test.expected, got)
+		}
+	}
+}
+
+func TestCacheSize(t *testing.T) {
+	c := NewCache(10, 0)
+	r, _ := http.NewRequest("GET", "/", nil)
+	header := http.Header{"Cache-Control": {"max-age=60"}}
+
+	c.put("/a", r, http.StatusOK, header, []byte("aaaa"))
+	c.put("/b", r, http.StatusOK, header, []byte("bbbb"))
+	c.get("/a", r)
+	c.put("/c", r, http.StatusOK, header, []byte("cccc"))
+	if c.get("/b", r) != nil {
+		t.Error("Expected the least recently used response to be evicted")
+	}
+	if c.get("/a", r) == nil || c.get("/c", r) == nil {
+		t.Error("Expected the other responses to be kept")
+	}
+	c.put("/d", r, http.StatusOK, header, []byte("too large to keep"))
+	if c.get("/d", r) != nil {
+		t.Error("Expected a response larger than the cache not to be kept")
+	}
+	if c.size != 8 {
+		t.Errorf("Expected 8 bytes in the cache, got %d", c.size)
+	}
+}
+
+func TestCachePools(t *testing.T) {
+	newBackend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "max-age=60")
+			fmt.Fprintf(w, "%s %s", name, r.Host)
+		}))
+	}
+	stable, beta := newBackend("stable"), newBackend("beta")
+	defer stable.Close()
+	defer beta.Close()
+
+	cache := NewCache(1024, 0)
+	newHost := func(name, pool string) *UpstreamHost {
+		baseUrl, _ := url.Parse(name)
+		uh := &UpstreamHost{Name: name, HostHeader: "{host}", ReverseProxy: NewSingleHostReverseProxy(baseUrl)}
+		uh.ReverseProxy.Cache = cache
+		uh.ReverseProxy.CachePool = pool
+		return uh
+	}
+	upstream := newTestUpstream(stable.URL)
+	upstream.Hosts[0] = newHost(stable.URL, "")
+	upstream.Routes = []HeaderRoute{
+		{Header: "X-Group", Value: "beta", Hosts: HostPool{newHost(beta.URL, "route 0")}},
+	}
+	p := Proxy{Upstreams: []Upstream{upstream}}
+
+	tests := []struct {
+		host  string
+		group string
+		body  string
+	}{
+		{"a.example", "", "stable a.example"},
+		{"a.example", "beta", "beta a.example"},
+		{"b.example", "", "stable b.example"},
+		// served from the cache, each from its own
+		{"a.example", "", "stable a.example"},
+		{"a.example", "beta", "beta a.example"},
+		{"b.example", "", "stable b.example"},
+	}
+	for i, test := range tests {
+		r, err := http.NewRequest("GET", "http://"+test.host+"/", nil)
+		if err != nil {
+			t.Fatalf("Test %d: Could not create request: %v", i, err)
+		}
+		if test.group != "" {
+			r.Header.Set("X-Group", test.group)
+		}
+		w := httptest.NewRecorder()
+		if _, err := p.ServeHTTP(w, r); err != nil {
+			t.Fatalf("Test %d: Expected no error, got %v", i, err)
+		}
+		if w.Body.String() != test.body {
+			t.Errorf("Test %d: Expected body '%s', got '%s'", i, test.body, w.Body.String())
+		}
+	}
+	if len(cache.entries) != 3 {
+		t.Errorf("Expected 3 responses in the cache, got %d", len(cache.entries))
+	}
+}
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// canaryPoll is how often the percent file of a canary is read.
+const canaryPoll = time.Second
+
+// Canary sends a share of the requests to an upstream to a pool of
+// Hosts of their own, like those of a new version being rolled out,
+// and the rest to the hosts of the upstream. With Key, requests are
+// split by a hash of the key, so that requests with the same key, like
+// those of a user, all go to the same pool; otherwise they are split
+// randomly. The share may be changed at any time with SetPercent.
+type Canary struct {
+	Hosts       HostPool
+	Key         KeyFunc
+	PercentFile string // file to read the share from while running, if any
+
+	basisPoints int32 // share of requests in hundredths of a percent; access atomically
+}
+
+// Percent returns the share of requests sent to the canary hosts.
+func (c *Canary) Percent() float64 {
+	return float64(atomic.LoadInt32(&c.basisPoints)) / 100
+}
+
+// SetPercent sets the share of requests sent to the canary
+// hosts to percent, which is brought within 0 to 100.
+func (c *Canary) SetPercent(percent float64) {
+	if percent < 0 {
+		percent = 0
+	} else if percent > 100 {
+		percent = 100
+	}
+	atomic.StoreInt32(&c.basisPoints, int32(percent*100+0.5))
+}
+
+// selects returns whether the request with key, which
+// may be "", is one of those sent to the canary hosts.
+func (c *Canary) selects(key string) bool {
+	basisPoints := uint32(atomic.LoadInt32(&c.basisPoints))
+	if basisPoints == 0 {
+		return false
+	}
+	if key == "" {
+		return uint32(rand.Intn(10000)) < basisPoints
+	}
+	return hashKey(nil, key)%10000 < basisPoints
+}
+
+// watchPercentFile sets the share of requests sent to the canary
+// hosts to the percentage in PercentFile whenever it changes. A
+// file which is missing or does not hold a percentage is ignored,
+// leaving the share as it is. It never returns.
+func (c *Canary) watchPercentFile() {
+	last := ""
+	for {
+		if content, err := ioutil.ReadFile(c.PercentFile); err == nil && string(content) != last {
+			last = string(content)
+			if percent, err := parsePercent(strings.TrimSpace(last)); err == nil {
+				c.SetPercent(percent)
+				log.Printf("[INFO] Sending %v%% of requests to the canary hosts", c.Percent())
+			} else {
+				log.Printf("[WARNING] %s: %v", c.PercentFile, err)
+			}
+		}
+		time.Sleep(canaryPoll)
+	}
+}
+
+// parsePercent parses a percentage from 0 to 100,
+// like 5 or 12.5%.
+func parsePercent(s string) (float64, error) {
+	percent, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if err != nil || percent < 0 || percent > 100 {
+		return 0, fmt.Errorf("Invalid percentage %s", s)
+	}
+	return percent, nil
+}
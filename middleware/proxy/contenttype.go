@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"mime"
+	"strings"
+)
+
+// contentTypeError is the error of a response which is not passed
+// on to the client because of its content type.
+type contentTypeError struct {
+	contentType string
+}
+
+func (e contentTypeError) Error() string {
+	return "Content type " + e.contentType + " of backend response not allowed"
+}
+
+// allowedContentType returns whether a response with the
+// Content-Type header contentType may be passed on to the client.
+// Without AllowContentTypes, all types not denied are allowed. A
+// response without a Content-Type is application/octet-stream.
+func (p *ReverseProxy) allowedContentType(contentType string) bool {
+	if len(p.AllowContentTypes) == 0 && len(p.DenyContentTypes) == 0 {
+		return true
+	}
+	mediaType := "application/octet-stream"
+	if contentType != "" {
+		var err error
+		if mediaType, _, err = mime.ParseMediaType(contentType); err != nil {
+			// types we cannot tell are not known to be allowed
+			return false
+		}
+	}
+	for _, t := range p.DenyContentTypes {
+		if matchMediaType(t, mediaType) {
+			return false
+		}
+	}
+	if len(p.AllowContentTypes) == 0 {
+		return true
+	}
+	for _, t := range p.AllowContentTypes {
+		if matchMediaType(t, mediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchMediaType returns whether mediaType, which is
+// lower case, matches pattern, like text/html, text/*
+// or */*, ignoring case.
+func matchMediaType(pattern, mediaType string) bool {
+	pattern = strings.ToLower(pattern)
+	if pattern == "*/*" || pattern == mediaType {
+		return true
+	}
+	return strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mediaType, pattern[:len(pattern)-1])
+}
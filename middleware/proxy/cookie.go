@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// CookieRewrite changes an attribute of the cookies set by a backend
+// so that they apply to the site being proxied to, not the backend.
+// For the Domain attribute, From must equal the domain, ignoring case
+// and a leading dot. For the Path attribute, From is a prefix of the
+// path which is replaced with To.
+type CookieRewrite struct {
+	From string
+	To   string
+}
+
+// rewriteCookies rewrites the Domain and Path attributes of
+// the Set-Cookie headers in h with the first matching rewrite.
+func (p *ReverseProxy) rewriteCookies(h http.Header) {
+	if len(p.CookieDomains) == 0 && len(p.CookiePaths) == 0 {
+		return
+	}
+	cookies := h["Set-Cookie"]
+	for i, cookie := range cookies {
+		attrs := strings.Split(cookie, ";")
+		// the first part is the name and value of the cookie
+		for j := 1; j < len(attrs); j++ {
+			name, value := attrs[j], ""
+			if eq := strings.Index(name, "="); eq >= 0 {
+				name, value = name[:eq], strings.TrimSpace(name[eq+1:])
+			}
+			switch strings.ToLower(strings.TrimSpace(name)) {
+			case "domain":
+				domain := strings.TrimPrefix(value, ".")
+				for _, rw := range p.CookieDomains {
+					if strings.EqualFold(domain, strings.TrimPrefix(rw.From, ".")) {
+						attrs[j] = " Domain=" + rw.To
+						break
+					}
+				}
+			case "path":
+				for _, rw := range p.CookiePaths {
+					if strings.HasPrefix(value, rw.From) {
+						attrs[j] = " Path=" + rw.To + value[len(rw.From):]
+						break
+					}
+				}
+			}
+		}
+		cookies[i] = strings.Join(attrs, ";")
+	}
+}
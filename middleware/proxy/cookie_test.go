@@ -0,0 +1,31 @@
+package proxy
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestRewriteCookies(t *testing.T) {
+	p := &ReverseProxy{
+		CookieDomains: []CookieRewrite{{From: "backend.internal", To: "example.com"}},
+		CookiePaths:   []CookieRewrite{{From: "/app/", To: "/"}},
+	}
+
+	h := http.Header{}
+	h.Add("Set-Cookie", "session=abc; Domain=backend.internal; Path=/app/admin; HttpOnly")
+	h.Add("Set-Cookie", "theme=dark; domain=.BACKEND.internal; path=/app/")
+	h.Add("Set-Cookie", "other=1; Domain=other.internal; Path=/static")
+	h.Add("Set-Cookie", "plain=1")
+	p.rewriteCookies(h)
+
+	expected := []string{
+		"session=abc; Domain=example.com; Path=/admin; HttpOnly",
+		"theme=dark; Domain=example.com; Path=/",
+		"other=1; Domain=other.internal; Path=/static",
+		"plain=1",
+	}
+	if !reflect.DeepEqual(h["Set-Cookie"], expected) {
+		t.Errorf("Expected cookies %q, got %q", expected, h["Set-Cookie"])
+	}
+}
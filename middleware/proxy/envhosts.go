@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// envHosts matches arguments which stand for the hosts
+// in an environment variable, like {env.UPSTREAMS}.
+var envHosts = regexp.MustCompile(`^\{env\.([A-Za-z_][A-Za-z0-9_]*)\}$`)
+
+// expandHosts returns hosts with each {env.NAME} replaced by the
+// hosts in the environment variable NAME, separated by commas or
+// spaces, like host1:8080,host2:8080. The hosts taken from the
+// environment are validated, so that a typo in them is reported
+// at startup rather than when proxying to them.
+func expandHosts(hosts []string) ([]string, error) {
+	var expanded []string
+	for _, host := range hosts {
+		match := envHosts.FindStringSubmatch(host)
+		if match == nil {
+			expanded = append(expanded, host)
+			continue
+		}
+		value, ok := os.LookupEnv(match[1])
+		if !ok {
+			return nil, fmt.Errorf("Environment variable %s is not set", match[1])
+		}
+		fromEnv := strings.FieldsFunc(value, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t' || r == '\n'
+		})
+		if len(fromEnv) == 0 {
+			return nil, fmt.Errorf("Environment variable %s has no upstream hosts", match[1])
+		}
+		for _, h := range fromEnv {
+			if err := checkHost(h); err != nil {
+				return nil, fmt.Errorf("Invalid upstream host %q in %s: %v", h, match[1], err)
+			}
+		}
+		expanded = append(expanded, fromEnv...)
+	}
+	return expanded, nil
+}
+
+// checkHost returns an error if host is not an upstream
+// host, like host:8080, 10.0.0.1 or https://host.
+func checkHost(host string) error {
+	u, err := url.Parse(upstreamName(host))
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("scheme must be http or https")
+	}
+	if u.Hostname() == "" {
+		return fmt.Errorf("no host name")
+	}
+	if port := u.Port(); port != "" {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("invalid port %s", port)
+		}
+	} else if strings.HasSuffix(u.Host, ":") {
+		return fmt.Errorf("no port after :")
+	}
+	if u.Path != "" && u.Path != "/" || u.RawQuery != "" || u.User != nil {
+		return fmt.Errorf("only a scheme, host and port are allowed")
+	}
+	return nil
+}
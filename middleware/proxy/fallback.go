@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// Fallback is a page, such as a maintenance notice, which is
+// served instead when no upstream host could serve a request.
+type Fallback struct {
+	// File to serve; if it is a directory, its index.html
+	// is served. It is opened on every use so that it may
+	// be changed (e.g. by git) while the server is running.
+	Path string
+
+	// Status code to respond with
+	Status int
+}
+
+// serve writes the fallback page to w. If the page cannot be
+// served, the proxy error err is returned along with the
+// fallback status code, as if there was no fallback.
+func (f *Fallback) serve(w http.ResponseWriter, r *http.Request, err error) (int, error) {
+	name := f.Path
+	if fi, statErr := os.Stat(name); statErr == nil && fi.IsDir() {
+		name = filepath.Join(name, "index.html")
+	}
+	file, openErr := os.Open(name)
+	if openErr != nil {
+		return f.Status, err
+	}
+	defer file.Close()
+
+	if ctype := mime.TypeByExtension(filepath.Ext(name)); ctype != "" {
+		w.Header().Set("Content-Type", ctype)
+	}
+	if fi, statErr := file.Stat(); statErr == nil {
+		w.Header().Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(f.Status)
+	if r.Method != "HEAD" {
+		io.Copy(w, file)
+	}
+
+	// the response is written, but the reason
+	// for the fallback should still be logged
+	return 0, err
+}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// forwardedHeaders adds the X-Forwarded-Host, X-Forwarded-Port and
+// Forwarded headers for the request r, originally for requestHost,
+// to extraHeaders as enabled for host. Like X-Forwarded-For, the
+// values of prior proxies are kept, separated by a comma. Headers
+// already given by proxy_header are left alone.
+func forwardedHeaders(extraHeaders http.Header, host *UpstreamHost, r *http.Request, requestHost string) {
+	if host.ForwardedHost && extraHeaders.Get("X-Forwarded-Host") == "" {
+		extraHeaders.Set("X-Forwarded-Host", appendForwarded(r.Header["X-Forwarded-Host"], requestHost))
+	}
+	if host.ForwardedPort && extraHeaders.Get("X-Forwarded-Port") == "" {
+		extraHeaders.Set("X-Forwarded-Port", appendForwarded(r.Header["X-Forwarded-Port"], requestPort(r, requestHost)))
+	}
+	if host.Forwarded && extraHeaders.Get("Forwarded") == "" {
+		extraHeaders.Set("Forwarded", appendForwarded(r.Header["Forwarded"], forwardedElement(r, requestHost)))
+	}
+}
+
+// forwardedElement returns the element of the Forwarded
+// header describing the request r for requestHost, like
+// for=192.0.2.60;host=example.com;proto=https.
+func forwardedElement(r *http.Request, requestHost string) string {
+	var pairs []string
+	if clientIP, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if strings.Contains(clientIP, ":") {
+			// IPv6 addresses are bracketed and quoted
+			clientIP = `"[` + clientIP + `]"`
+		}
+		pairs = append(pairs, "for="+clientIP)
+	}
+	if requestHost != "" {
+		pairs = append(pairs, "host="+forwardedValue(requestHost))
+	}
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	pairs = append(pairs, "proto="+proto)
+	return strings.Join(pairs, ";")
+}
+
+// forwardedValue returns value as the value of a pair of
+// the Forwarded header, which is quoted unless it is a token.
+func forwardedValue(value string) string {
+	for _, c := range value {
+		if !isTokenChar(c) {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+		}
+	}
+	return value
+}
+
+// isTokenChar returns whether c may be part
+// of a token as defined by RFC 7230.
+func isTokenChar(c rune) bool {
+	if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' {
+		return true
+	}
+	return strings.ContainsRune("!#$%&'*+-.^_`|~", c)
+}
+
+// appendForwarded appends value to the values of
+// prior proxies, folding them into a single value.
+func appendForwarded(prior []string, value string) string {
+	if len(prior) == 0 {
+		return value
+	}
+	return strings.Join(prior, ", ") + ", " + value
+}
+
+// requestPort returns the port the request r was received
+// on, which is that of requestHost, if it has one, or else
+// that of the connection, or the default port of the scheme.
+func requestPort(r *http.Request, requestHost string) string {
+	if _, port, err := net.SplitHostPort(requestHost); err == nil {
+		return port
+	}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if _, port, err := net.SplitHostPort(addr.String()); err == nil {
+			return port
+		}
+	}
+	if r.TLS != nil {
+		return "443"
+	}
+	return "80"
+}
@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// A KeyFunc extracts the key a hashing policy selects a host
+// by from a request, like a tenant ID. If it returns "", the
+// policy hashes what it does by default.
+type KeyFunc func(r *http.Request) string
+
+// HeaderKey returns a KeyFunc which takes the
+// key from the request header name.
+func HeaderKey(name string) KeyFunc {
+	return func(r *http.Request) string {
+		return r.Header.Get(name)
+	}
+}
+
+// JWTClaimKey returns a KeyFunc which takes the key from claim
+// in the payload of the JSON Web Token in the request header
+// name, like Authorization, with or without a Bearer prefix.
+// The signature of the token is not verified; it only decides
+// which host requests go to, and the backend is still to check
+// it. Claims which are not strings are keyed by their JSON.
+func JWTClaimKey(name, claim string) KeyFunc {
+	return func(r *http.Request) string {
+		token := r.Header.Get(name)
+		if len(token) > 7 && strings.EqualFold(token[:7], "Bearer ") {
+			token = token[7:]
+		}
+		value, err := jwtClaim(strings.TrimSpace(token), claim)
+		if err != nil {
+			return ""
+		}
+		return value
+	}
+}
+
+// jwtClaim returns claim from the payload of token.
+func jwtClaim(token, claim string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("Not a JSON Web Token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return "", err
+	}
+	var claims map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", err
+	}
+	raw, ok := claims[claim]
+	if !ok {
+		return "", fmt.Errorf("No %s claim in token", claim)
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s, nil
+	}
+	return string(raw), nil
+}
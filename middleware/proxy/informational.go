@@ -0,0 +1,36 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+)
+
+// informationalTrace returns a trace which passes informational
+// (1xx) responses of the backend, like 103 Early Hints, on to the
+// client through rw before the final response. Their headers are
+// only sent with them: the headers of rw are put back afterwards.
+//
+// 100 Continue is not passed on, as the server sends it itself
+// once the body of the request is read, which the transport only
+// does after the backend asked for it with its own 100 Continue.
+func informationalTrace(rw http.ResponseWriter) *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			if code == http.StatusContinue {
+				return nil
+			}
+			hints := http.Header(header).Clone()
+			removeHopHeaders(hints)
+			h := rw.Header()
+			saved := h.Clone()
+			copyHeader(h, hints)
+			rw.WriteHeader(code)
+			for name := range h {
+				delete(h, name)
+			}
+			copyHeader(h, saved)
+			return nil
+		},
+	}
+}
@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// latencyWeight is the weight of each new response time in
+// the moving average of the response times of a host.
+const latencyWeight = 0.2
+
+// observeLatency adds the response time took to the moving average
+// of the response times of uh, taking uh down for being slow while
+// the average is above MaxLatency. A host taken down is tried again
+// after FailTimeout, with the average starting afresh; health checks
+// count as responses, so they can bring it back up sooner.
+func (uh *UpstreamHost) observeLatency(took time.Duration) {
+	if uh.MaxLatency <= 0 {
+		return
+	}
+	now := time.Now().UnixNano()
+	slowUntil := atomic.LoadInt64(&uh.slowUntil)
+	for {
+		old := atomic.LoadInt64(&uh.latency)
+		avg := int64(took)
+		if old != 0 && (slowUntil == 0 || now < slowUntil) {
+			avg = int64(float64(old)*(1-latencyWeight) + float64(took)*latencyWeight)
+		}
+		if atomic.CompareAndSwapInt64(&uh.latency, old, avg) {
+			break
+		}
+	}
+
+	if time.Duration(atomic.LoadInt64(&uh.latency)) > uh.MaxLatency {
+		timeout := uh.FailTimeout
+		if timeout == 0 {
+			timeout = 10 * time.Second
+		}
+		if atomic.SwapInt64(&uh.slowUntil, now+int64(timeout)) == 0 {
+			log.Printf("[WARNING] Upstream host %s is slow, taking it down", uh.Name)
+		}
+	} else if atomic.SwapInt64(&uh.slowUntil, 0) != 0 {
+		log.Printf("[INFO] Upstream host %s is fast enough again", uh.Name)
+	}
+}
+
+// Slow returns whether uh is down for responding too
+// slowly on average, as MaxLatency is exceeded.
+func (uh *UpstreamHost) Slow() bool {
+	slowUntil := atomic.LoadInt64(&uh.slowUntil)
+	return slowUntil != 0 && time.Now().UnixNano() < slowUntil
+}
+
+// Latency returns the moving average of the response
+// times of uh, if MaxLatency is set, or else 0.
+func (uh *UpstreamHost) Latency() time.Duration {
+	return time.Duration(atomic.LoadInt64(&uh.latency))
+}
@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/mholt/caddy/middleware"
+)
+
+// DefaultLogFormat is the format requests to an upstream
+// are logged in if no format is given.
+const DefaultLogFormat = `{remote} [{when}] "{method} {uri} {proto}" {upstream} {status} {latency}`
+
+// CommonLogFormat and CombinedLogFormat are the Common and Combined
+// Log Formats of Apache, with the upstream host last tried added as
+// a last field, so that requests to an upstream can be analyzed with
+// the tools for those. They are given as {common} and {combined}.
+const (
+	CommonLogFormat   = `{remote} - [{when}] "{method} {uri} {proto}" {status} {size} {upstream}`
+	CombinedLogFormat = `{remote} - [{when}] "{method} {uri} {proto}" {status} {size} "{>Referer}" "{>User-Agent}" {upstream}`
+)
+
+// logTimeFormat is the format of {when}, that of the Common Log Format.
+const logTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// UpstreamLog logs the requests proxied to an upstream, one line
+// per request. Format may have the placeholders of the log
+// directive, {upstream}, the upstream host last tried, and
+// {upstream_failure}, how the request to it failed if it got
+// no response: dial, tls, timeout, read or other. {when} is
+// the time the request came in.
+type UpstreamLog struct {
+	OutputFile string
+	Format     string
+	Log        *log.Logger
+}
+
+// open opens the output file of l for writing;
+// it may also be stdout or stderr.
+func (l *UpstreamLog) open() error {
+	var file *os.File
+	switch l.OutputFile {
+	case "stdout":
+		file = os.Stdout
+	case "stderr":
+		file = os.Stderr
+	default:
+		var err error
+		file, err = os.OpenFile(l.OutputFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+	}
+	l.Log = log.New(file, "", 0)
+	return nil
+}
+
+// write logs the request which came in at start and was proxied
+// to host, given by rep. If status is not 0, the response was not
+// written yet, and status is logged instead. err is the error the
+// request was served with, if any.
+func (l *UpstreamLog) write(rep middleware.Replacer, host *UpstreamHost, start time.Time, status int, err error) {
+	name := ""
+	if host != nil {
+		name = host.Name
+	}
+	rep.Set("upstream", name)
+	rep.Set("when", start.Format(logTimeFormat))
+	failure := ""
+	if kind, ok := failureKind(err); ok {
+		failure = kind.String()
+	}
+	rep.Set("upstream_failure", failure)
+	if status != 0 {
+		rep.Set("status", strconv.Itoa(status))
+	}
+	l.Log.Println(rep.Replace(l.Format))
+}
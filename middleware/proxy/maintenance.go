@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// maintenancePoll is how often the file of a maintenance toggle is checked.
+const maintenancePoll = time.Second
+
+// Maintenance puts an upstream in maintenance mode, e.g. for
+// planned downtime, in which requests get 503 Service Unavailable
+// with Page right away instead of being proxied. Upstreams given
+// the same File go in and out of maintenance mode together.
+type Maintenance struct {
+	// File which turns maintenance mode on while it exists,
+	// so that a deploy can toggle it without a config change,
+	// or "" if it is only toggled with SetOn
+	File string
+
+	// Page to serve, or nil for the default error page
+	Page *Fallback
+
+	on int32 // access atomically
+}
+
+// On returns whether maintenance mode is on.
+func (m *Maintenance) On() bool {
+	return atomic.LoadInt32(&m.on) == 1
+}
+
+// SetOn turns maintenance mode on or off. Requests are proxied
+// again as soon as it is off. With File, whether it exists
+// decides again at the next check.
+func (m *Maintenance) SetOn(on bool) {
+	var value int32
+	if on {
+		value = 1
+	}
+	atomic.StoreInt32(&m.on, value)
+}
+
+// watchFile turns maintenance mode on while File exists,
+// and off while it does not. It never returns.
+func (m *Maintenance) watchFile() {
+	for {
+		_, err := os.Stat(m.File)
+		if on := err == nil; on != m.On() {
+			m.SetOn(on)
+			if on {
+				log.Printf("[INFO] %s exists, in maintenance mode", m.File)
+			} else {
+				log.Printf("[INFO] %s is gone, out of maintenance mode", m.File)
+			}
+		}
+		time.Sleep(maintenancePoll)
+	}
+}
+
+// serve answers r with the maintenance page, or with just
+// 503 Service Unavailable if there is none.
+func (m *Maintenance) serve(w http.ResponseWriter, r *http.Request) (int, error) {
+	if m.Page == nil {
+		return http.StatusServiceUnavailable, nil
+	}
+	return m.Page.serve(w, r, nil)
+}
@@ -0,0 +1,31 @@
+package proxy
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// ErrOutage is the reason an upstream gives for not selecting a
+// host while it cools down after finding all of its hosts down.
+var ErrOutage = errors.New("All upstream hosts were down moments ago")
+
+// DefaultOutageCooldown is how long an upstream cools down after
+// finding all of its hosts down if outage_cooldown has no duration.
+const DefaultOutageCooldown = time.Second
+
+// noteOutage starts the cooldown of u after all of its hosts
+// were found down, if it has one. For the cooldown, requests
+// fail right away, without looking at each host again.
+func (u *staticUpstream) noteOutage() {
+	if u.OutageCooldown > 0 {
+		atomic.StoreInt64(&u.outageUntil, time.Now().Add(u.OutageCooldown).UnixNano())
+	}
+}
+
+// coolingDown returns whether u is within the
+// cooldown after all of its hosts were down.
+func (u *staticUpstream) coolingDown() bool {
+	until := atomic.LoadInt64(&u.outageUntil)
+	return until != 0 && time.Now().UnixNano() < until
+}
@@ -1,18 +1,60 @@
 package proxy
 
 import (
+	"hash"
+	"hash/crc32"
+	"hash/fnv"
 	"math/rand"
+	"net"
+	"net/http"
 	"sync/atomic"
 )
 
 type HostPool []*UpstreamHost
 
+// available returns whether a host of the pool is available.
+func (pool HostPool) available() bool {
+	for _, host := range pool {
+		if host.Available() {
+			return true
+		}
+	}
+	return false
+}
+
+// without returns a copy of the pool that excludes host.
+func (pool HostPool) without(host *UpstreamHost) HostPool {
+	others := make(HostPool, 0, len(pool))
+	for _, h := range pool {
+		if h != host {
+			others = append(others, h)
+		}
+	}
+	return others
+}
+
 // Policy decides how a host will be selected from a pool.
 type Policy interface {
 	Select(pool HostPool) *UpstreamHost
 }
 
-// The random policy randomly selected an up host from the pool.
+// A RequestPolicy is a Policy which can select a host for a
+// particular request, e.g. by hashing the client address.
+type RequestPolicy interface {
+	Policy
+	SelectFor(pool HostPool, r *http.Request) *UpstreamHost
+}
+
+// selectFor selects a host from pool with policy, for r if
+// policy is a RequestPolicy and r is not nil.
+func selectFor(policy Policy, pool HostPool, r *http.Request) *UpstreamHost {
+	if rp, ok := policy.(RequestPolicy); ok && r != nil {
+		return rp.SelectFor(pool, r)
+	}
+	return policy.Select(pool)
+}
+
+// The random policy randomly selected an available host from the pool.
 type Random struct{}
 
 func (r *Random) Select(pool HostPool) *UpstreamHost {
@@ -21,7 +63,7 @@ func (r *Random) Select(pool HostPool) *UpstreamHost {
 	var randHost *UpstreamHost
 	count := 0
 	for _, host := range pool {
-		if host.Down() {
+		if !host.Available() {
 			continue
 		}
 		count++
@@ -47,10 +89,10 @@ func (r *LeastConn) Select(pool HostPool) *UpstreamHost {
 	count := 0
 	leastConn := int64(1<<63 - 1)
 	for _, host := range pool {
-		if host.Down() {
+		if !host.Available() {
 			continue
 		}
-		hostConns := host.Conns
+		hostConns := atomic.LoadInt64(&host.Conns)
 		if hostConns < leastConn {
 			bestHost = host
 			leastConn = hostConns
@@ -80,12 +122,117 @@ func (r *RoundRobin) Select(pool HostPool) *UpstreamHost {
 	poolLen := uint32(len(pool))
 	selection := atomic.AddUint32(&r.Robin, 1) % poolLen
 	host := pool[selection]
-	// if the currently selected host is down, just ffwd to up host
-	for i := uint32(1); host.Down() && i < poolLen; i++ {
+	// if the currently selected host is unavailable, just ffwd to available host
+	for i := uint32(1); !host.Available() && i < poolLen; i++ {
 		host = pool[(selection+i)%poolLen]
 	}
-	if host.Down() {
+	if !host.Available() {
 		return nil
 	}
 	return host
 }
+
+// Hashes are the hash functions the hashing policies can use, by name.
+//
+// fnv (32-bit FNV-1a) is the default. It is fast and spreads the short
+// keys hashed here, like IP addresses, evenly. crc32 (IEEE) is faster
+// for long keys on CPUs with CRC instructions but spreads keys which
+// differ in few bits, like addresses of one subnet, less evenly; use it
+// to match another balancer hashing with CRC32.
+//
+// Only hashes of the standard library are offered, so that the proxy
+// needs no other dependency for them. xxhash in particular is left out:
+// it is only faster than these for keys much longer than the addresses
+// and URIs hashed here. A program building the proxy in can add it, or
+// any other hash, to Hashes before the config is parsed.
+var Hashes = map[string]func() hash.Hash32{
+	"fnv":   fnv.New32a,
+	"crc32": crc32.NewIEEE,
+}
+
+// DefaultHash is the hash function the hashing policies use by default.
+var DefaultHash = fnv.New32a
+
+// hashKey hashes key with h, or DefaultHash if h is nil.
+func hashKey(h func() hash.Hash32, key string) uint32 {
+	if h == nil {
+		h = DefaultHash
+	}
+	hasher := h()
+	hasher.Write([]byte(key))
+	return hasher.Sum32()
+}
+
+// The ip_hash policy selects a host based on a hash of the client IP
+// address, so requests from a client go to the same host as long as
+// the pool does not change. If that host is unavailable, the next
+// available host is selected. Without a request, it selects randomly.
+// With Key, requests are hashed by the key it extracts instead.
+type IPHash struct {
+	Hash func() hash.Hash32
+	Key  KeyFunc
+}
+
+func (r *IPHash) Select(pool HostPool) *UpstreamHost {
+	return (&Random{}).Select(pool)
+}
+
+func (r *IPHash) SelectFor(pool HostPool, req *http.Request) *UpstreamHost {
+	if len(pool) == 0 {
+		return nil
+	}
+	key := ""
+	if r.Key != nil {
+		key = r.Key(req)
+	}
+	if key == "" {
+		var err error
+		if key, _, err = net.SplitHostPort(req.RemoteAddr); err != nil {
+			key = req.RemoteAddr
+		}
+	}
+	poolLen := uint32(len(pool))
+	selection := hashKey(r.Hash, key) % poolLen
+	for i := uint32(0); i < poolLen; i++ {
+		if host := pool[(selection+i)%poolLen]; host.Available() {
+			return host
+		}
+	}
+	return nil
+}
+
+// The consistent_hash policy selects a host based on a hash of the
+// request URI, using rendezvous hashing: each URI goes to the available
+// host for which the hash of the host name and URI is highest. Unlike
+// with ip_hash, a host becoming unavailable only moves the requests it
+// got to other hosts. Without a request, it selects randomly.
+// With Key, requests are hashed by the key it extracts instead.
+type ConsistentHash struct {
+	Hash func() hash.Hash32
+	Key  KeyFunc
+}
+
+func (r *ConsistentHash) Select(pool HostPool) *UpstreamHost {
+	return (&Random{}).Select(pool)
+}
+
+func (r *ConsistentHash) SelectFor(pool HostPool, req *http.Request) *UpstreamHost {
+	var bestHost *UpstreamHost
+	var bestScore uint32
+	key := ""
+	if r.Key != nil {
+		key = r.Key(req)
+	}
+	if key == "" {
+		key = req.URL.RequestURI()
+	}
+	for _, host := range pool {
+		if !host.Available() {
+			continue
+		}
+		if score := hashKey(r.Hash, host.Name+key); bestHost == nil || score > bestScore {
+			bestHost, bestScore = host, score
+		}
+	}
+	return bestHost
+}
@@ -1,6 +1,9 @@
 package proxy
 
 import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
 	"testing"
 )
 
@@ -33,7 +36,7 @@ func TestRoundRobinPolicy(t *testing.T) {
 		t.Error("Expected second round robin host to be third host in the pool.")
 	}
 	// mark host as down
-	pool[0].Unhealthy = true
+	pool[0].SetUnhealthy(true)
 	h = rrPolicy.Select(pool)
 	if h != pool[1] {
 		t.Error("Expected third round robin host to be first host in the pool.")
@@ -55,3 +58,126 @@ func TestLeastConnPolicy(t *testing.T) {
 		t.Error("Expected least connection host to be first or second host.")
 	}
 }
+
+func TestIPHashPolicy(t *testing.T) {
+	for name, hash := range Hashes {
+		pool := testPool()
+		policy := &IPHash{Hash: hash}
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+
+		h := policy.SelectFor(pool, r)
+		if h == nil {
+			t.Fatalf("%s: Expected a host to be selected", name)
+		}
+		r.RemoteAddr = "192.0.2.1:5678"
+		if policy.SelectFor(pool, r) != h {
+			t.Errorf("%s: Expected the same client IP to select the same host", name)
+		}
+		h.SetUnhealthy(true)
+		if other := policy.SelectFor(pool, r); other == nil || other == h {
+			t.Errorf("%s: Expected another host when the selected one is down, got %v", name, other)
+		}
+	}
+}
+
+func TestConsistentHashPolicy(t *testing.T) {
+	for name, hash := range Hashes {
+		pool := testPool()
+		policy := &ConsistentHash{Hash: hash}
+
+		selected := make(map[string]*UpstreamHost)
+		for i := 0; i < 100; i++ {
+			r, _ := http.NewRequest("GET", fmt.Sprintf("/page/%d", i), nil)
+			selected[r.URL.Path] = policy.SelectFor(pool, r)
+		}
+		pool[0].SetUnhealthy(true)
+		for path, h := range selected {
+			r, _ := http.NewRequest("GET", path, nil)
+			other := policy.SelectFor(pool, r)
+			if h != pool[0] && other != h {
+				t.Errorf("%s: Expected %s to stay on its host when another goes down", name, path)
+			}
+			if other == pool[0] {
+				t.Errorf("%s: Expected %s not to be sent to the down host", name, path)
+			}
+		}
+	}
+}
+
+func TestHashKey(t *testing.T) {
+	// {"sub":"1","tenant":"acme"} and {"sub":"2","tenant":"acme"}
+	tokens := []string{
+		"Bearer eyJhbGciOiJIUzI1NiJ9.eyJzdWIiOiIxIiwidGVuYW50IjoiYWNtZSJ9.c2ln",
+		"bearer eyJhbGciOiJIUzI1NiJ9.eyJzdWIiOiIyIiwidGVuYW50IjoiYWNtZSJ9.c2ln",
+	}
+	key := JWTClaimKey("Authorization", "tenant")
+	for i, token := range tokens {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.Header.Set("Authorization", token)
+		if got := key(r); got != "acme" {
+			t.Errorf("Test %d: Expected tenant claim 'acme', got '%s'", i, got)
+		}
+	}
+	for _, token := range []string{"", "Bearer not-a-token", "Bearer a.!!!.c"} {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.Header.Set("Authorization", token)
+		if got := key(r); got != "" {
+			t.Errorf("Expected no key from '%s', got '%s'", token, got)
+		}
+	}
+
+	for name, policy := range map[string]RequestPolicy{
+		"ip_hash":         &IPHash{Key: HeaderKey("X-Tenant")},
+		"consistent_hash": &ConsistentHash{Key: HeaderKey("X-Tenant")},
+	} {
+		pool := testPool()
+		selected := make(map[string]*UpstreamHost)
+		for i := 0; i < 20; i++ {
+			for _, tenant := range []string{"acme", "globex", "initech"} {
+				// a different client and path every time
+				r, _ := http.NewRequest("GET", fmt.Sprintf("/page/%d", i), nil)
+				r.RemoteAddr = fmt.Sprintf("192.0.2.%d:1234", i)
+				r.Header.Set("X-Tenant", tenant)
+				h := policy.SelectFor(pool, r)
+				if h == nil {
+					t.Fatalf("%s: Expected a host to be selected", name)
+				}
+				if prev, ok := selected[tenant]; ok && prev != h {
+					t.Errorf("%s: Expected tenant %s to stay on the same host", name, tenant)
+				}
+				selected[tenant] = h
+			}
+		}
+	}
+}
+
+// benchmarkPolicy measures Select of policy from many goroutines
+// at once, e.g. with -cpu 1,4,16. No policy takes a lock; they read
+// the counters of the hosts atomically.
+func benchmarkPolicy(b *testing.B, policy Policy) {
+	pool := make(HostPool, 16)
+	for i := range pool {
+		pool[i] = &UpstreamHost{Name: "http://localhost"}
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			host := policy.Select(pool)
+			atomic.AddInt64(&host.Conns, 1)
+			atomic.AddInt64(&host.Conns, -1)
+		}
+	})
+}
+
+func BenchmarkRandomPolicy(b *testing.B) {
+	benchmarkPolicy(b, &Random{})
+}
+
+func BenchmarkLeastConnPolicy(b *testing.B) {
+	benchmarkPolicy(b, &LeastConn{})
+}
+
+func BenchmarkRoundRobinPolicy(b *testing.B) {
+	benchmarkPolicy(b, &RoundRobin{})
+}
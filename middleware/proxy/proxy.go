@@ -2,16 +2,48 @@
 package proxy
 
 import (
+	"context"
 	"errors"
 	"github.com/mholt/caddy/middleware"
 	"net/http"
 	"net/url"
+	"regexp"
+	"strings"
 	"sync/atomic"
 	"time"
 )
 
 var errUnreachable = errors.New("Unreachable backend")
 
+var errRetryBudget = errors.New("Retry budget exhausted")
+
+var errLoop = errors.New("Proxy loop detected")
+
+// DefaultTryDuration is how long a request is retried with other
+// hosts at most if its upstream has no try duration. A request which
+// is tried no more than try_limit times may stop retrying before.
+const DefaultTryDuration = 60 * time.Second
+
+// ctxKey is the type of the context keys of the proxy.
+type ctxKey string
+
+// UpstreamCtxKey is the context key of the name of the upstream
+// host, like http://backend:8080, that the proxy last tried to
+// serve a request with. Once the proxy returns, middleware which
+// runs before it, like log, can read it from the request:
+//
+//	name, _ := r.Context().Value(proxy.UpstreamCtxKey).(string)
+//
+// It is not set if no host was tried, e.g. because all were down.
+var UpstreamCtxKey = ctxKey("upstream")
+
+// Reasons an upstream may give for not selecting a host.
+var (
+	ErrNoHosts = errors.New("No upstream hosts")
+	ErrAllDown = errors.New("All upstream hosts are down")
+	ErrAllBusy = errors.New("All upstream hosts are at their connection limit")
+)
+
 // Proxy represents a middleware instance that can proxy requests.
 type Proxy struct {
 	Next      middleware.Handler
@@ -27,6 +59,82 @@ type Upstream interface {
 	Select() *UpstreamHost
 }
 
+// A RequestUpstream is an Upstream which can select a host for a
+// particular request, e.g. by its headers, and tell why no host was
+// selected.
+type RequestUpstream interface {
+	Upstream
+	// Like Select, but selects for the request r, which may be nil,
+	// and also returns why no host was selected, e.g. ErrAllDown,
+	// ErrAllBusy or ErrOutage.
+	SelectHost(r *http.Request) (*UpstreamHost, error)
+}
+
+// An OptionsUpstream is an Upstream with options for how requests
+// are proxied to it. Other upstreams get the zero UpstreamOptions.
+// New options are added to UpstreamOptions, not as methods, so that
+// they do not break implementations of these interfaces.
+type OptionsUpstream interface {
+	Upstream
+	Options() UpstreamOptions
+}
+
+// UpstreamOptions are the options of an upstream for how requests
+// are proxied to it. The zero value proxies any request, and retries
+// with other hosts for up to DefaultTryDuration.
+type UpstreamOptions struct {
+	// Whether the path is matched against From ignoring case
+	CaseInsensitive bool
+	// The methods requests must have to be proxied, or nil for any
+	Methods []string
+	// The budget retries are drawn from, or nil if unlimited
+	RetryBudget *RetryBudget
+	// How long to wait before retrying, give or take some jitter
+	RetryDelay time.Duration
+	// How many times to try a request at most, or 0 for no limit
+	TryLimit int
+	// How long to keep trying a request at most, or 0 for
+	// DefaultTryDuration. Whichever of this and the try limit
+	// is reached first stops the retries.
+	TryDuration time.Duration
+	// Whether requests get 503 Service Unavailable right away
+	// if all hosts are down when they come in
+	FailFast bool
+	// The page to serve if no host could be reached, or nil
+	Fallback *Fallback
+	// The log requests to this upstream are logged to, or nil
+	Log *UpstreamLog
+	// The name added to the Via header of proxied requests,
+	// or "" if none is added
+	Via string
+	// The limit of requests in flight, or nil if unlimited
+	LoadShedder *LoadShedder
+	// The maintenance mode toggle, or nil if there is none
+	Maintenance *Maintenance
+}
+
+// upstreamOptions returns the options of upstream, or the
+// zero UpstreamOptions if it is not an OptionsUpstream.
+func upstreamOptions(upstream Upstream) UpstreamOptions {
+	if ou, ok := upstream.(OptionsUpstream); ok {
+		return ou.Options()
+	}
+	return UpstreamOptions{}
+}
+
+// selectHost selects a host of upstream for r, like SelectHost
+// if upstream is a RequestUpstream. Otherwise, no host selected
+// is taken to mean that all are down.
+func selectHost(upstream Upstream, r *http.Request) (*UpstreamHost, error) {
+	if ru, ok := upstream.(RequestUpstream); ok {
+		return ru.SelectHost(r)
+	}
+	if host := upstream.Select(); host != nil {
+		return host, nil
+	}
+	return nil, ErrAllDown
+}
+
 type UpstreamHostDownFunc func(*UpstreamHost) bool
 
 // An UpstreamHost represents a single proxy upstream
@@ -35,17 +143,158 @@ type UpstreamHost struct {
 	Name         string
 	ReverseProxy *ReverseProxy
 	Conns        int64
+	MaxConns     int64
 	Fails        int32
 	FailTimeout  time.Duration
-	Unhealthy    bool
+	// Whether a successful request clears Fails, rather than
+	// each failure only being forgotten after FailTimeout
+	ResetFailsOnSuccess bool
+	// Whether failures are never forgotten after FailTimeout,
+	// so that a failed host stays down until a passing health
+	// check clears Fails, or the config is reloaded
+	KeepFails bool
+	// Whether to tell the host the Host the request was made
+	// for and the port it was received on, in X-Forwarded-Host
+	// and X-Forwarded-Port
+	ForwardedHost bool
+	ForwardedPort bool
+	// Whether to tell the host the client address, the Host and
+	// the protocol of the request in the Forwarded header (RFC 7239)
+	Forwarded bool
+	// Longest the moving average of the time the host takes
+	// to respond may be before it is considered down, or 0
+	MaxLatency time.Duration
+	// Host to send to the host instead of its own, like
+	// app.internal. The Host of the request is replaced with
+	// that of the host by default; {host} preserves it, as
+	// there is no preserve_host. It takes precedence over a
+	// Host header in ExtraHeaders, and the others still apply.
+	HostHeader   string
 	ExtraHeaders http.Header
+	PathRewrites []PathRewrite
 	CheckDown    UpstreamHostDownFunc
+
+	// latency is the moving average of the response times of the
+	// host in nanoseconds, and slowUntil the time (in Unix
+	// nanoseconds) until which it is down for being slow, or 0 if
+	// it is not. Access them atomically; see observeLatency.
+	latency   int64
+	slowUntil int64
+
+	// unhealthy is 1 if the last health check of the host failed,
+	// else 0. The health checker sets it while requests are selecting
+	// hosts, so it is only accessed through IsUnhealthy and SetUnhealthy.
+	unhealthy int32
+
+	// upSince is the time (in Unix nanoseconds) at which this host was
+	// last seen to come back up, -1 if it is down, or 0 if it has been
+	// up for as long as we know. Access it atomically.
+	upSince int64
+}
+
+// Full returns whether uh is at its connection limit.
+func (uh *UpstreamHost) Full() bool {
+	return uh.MaxConns > 0 && atomic.LoadInt64(&uh.Conns) >= uh.MaxConns
+}
+
+// IsUnhealthy returns whether the last health check of uh failed.
+// It replaces the Unhealthy field, which could not be read safely
+// while the health checker was running.
+func (uh *UpstreamHost) IsUnhealthy() bool {
+	return atomic.LoadInt32(&uh.unhealthy) != 0
+}
+
+// SetUnhealthy records whether the last health check of uh failed,
+// in place of setting the Unhealthy field, which was removed.
+func (uh *UpstreamHost) SetUnhealthy(unhealthy bool) {
+	var value int32
+	if unhealthy {
+		value = 1
+	}
+	atomic.StoreInt32(&uh.unhealthy, value)
+}
+
+// Available returns whether uh can take a request,
+// which is when it is neither down nor full.
+func (uh *UpstreamHost) Available() bool {
+	return !uh.Down() && !uh.Full()
+}
+
+// observe records whether uh is currently down so that
+// the moment it becomes healthy again is known.
+func (uh *UpstreamHost) observe() {
+	if uh.Down() {
+		atomic.StoreInt64(&uh.upSince, -1)
+	} else {
+		atomic.CompareAndSwapInt64(&uh.upSince, -1, time.Now().UnixNano())
+	}
+}
+
+// warmth returns how far uh is into a slow start period of the given
+// duration, from just above 0 when it has only just come back up to 1
+// when it is fully warmed up.
+func (uh *UpstreamHost) warmth(slowStart time.Duration) float64 {
+	since := atomic.LoadInt64(&uh.upSince)
+	if since <= 0 || slowStart <= 0 {
+		return 1
+	}
+	elapsed := time.Since(time.Unix(0, since))
+	if elapsed >= slowStart {
+		return 1
+	}
+	return float64(elapsed) / float64(slowStart)
+}
+
+// PathRewrite rewrites the path of a proxied request if it matches
+// Pattern. Replacement may refer to capture groups, e.g. $1. The
+// query string of the request is kept; if Replacement has one of
+// its own, e.g. /search?v=2, it is put in front of that of the
+// request.
+type PathRewrite struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+// rewritePath applies the first of uh's path rewrites that matches
+// path and returns the resulting path and raw query, which is query
+// with that of the rewrite, if any, put in front. If none match, path
+// and query are returned as-is.
+func (uh *UpstreamHost) rewritePath(path, query string) (string, string) {
+	for _, rw := range uh.PathRewrites {
+		if rw.Pattern.MatchString(path) {
+			path = rw.Pattern.ReplaceAllString(path, rw.Replacement)
+			if i := strings.Index(path, "?"); i >= 0 {
+				path, query = path[:i], joinQuery(path[i+1:], query)
+			}
+			return path, query
+		}
+	}
+	return path, query
+}
+
+// joinQuery joins the raw queries a and b, either of which may be empty.
+func joinQuery(a, b string) string {
+	if a == "" || b == "" {
+		return a + b
+	}
+	return a + "&" + b
+}
+
+// forgetFail decrements Fails, unless it
+// was reset to zero since the failure.
+func (uh *UpstreamHost) forgetFail() {
+	for {
+		fails := atomic.LoadInt32(&uh.Fails)
+		if fails <= 0 || atomic.CompareAndSwapInt32(&uh.Fails, fails, fails-1) {
+			return
+		}
+	}
 }
 
 func (uh *UpstreamHost) Down() bool {
 	if uh.CheckDown == nil {
 		// Default settings
-		return uh.Unhealthy || uh.Fails > 0
+		return uh.IsUnhealthy() || atomic.LoadInt32(&uh.Fails) > 0 || uh.Slow()
 	}
 	return uh.CheckDown(uh)
 }
@@ -54,75 +303,222 @@ func (uh *UpstreamHost) Down() bool {
 func (p Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
 
 	for _, upstream := range p.Upstreams {
-		if middleware.Path(r.URL.Path).Matches(upstream.From()) {
-			var replacer middleware.Replacer
-			start := time.Now()
+		path := middleware.Path(r.URL.Path)
+		opts := upstreamOptions(upstream)
+		if path.Matches(upstream.From()) || opts.CaseInsensitive && path.MatchesFold(upstream.From()) {
+			upstreamLog := opts.Log
+			if upstreamLog == nil {
+				status, host, err := p.serveUpstreamOrFallback(w, r, upstream, opts)
+				setUpstream(r, host)
+				return status, err
+			}
 			requestHost := r.Host
+			start := time.Now()
+			rr := middleware.NewResponseRecorder(w)
+			status, host, err := p.serveUpstreamOrFallback(rr, r, upstream, opts)
+			setUpstream(r, host)
+			proxiedHost := r.Host
+			r.Host = requestHost
+			upstreamLog.write(middleware.NewReplacer(r, rr), host, start, status, err)
+			r.Host = proxiedHost
+			return status, err
+		}
+	}
 
-			// Since Select() should give us "up" hosts, keep retrying
-			// hosts until timeout (or until we get a nil host).
-			for time.Now().Sub(start) < (60 * time.Second) {
-				host := upstream.Select()
-				if host == nil {
-					return http.StatusBadGateway, errUnreachable
-				}
-				proxy := host.ReverseProxy
-				r.Host = host.Name
+	return p.Next.ServeHTTP(w, r)
+}
 
-				if baseUrl, err := url.Parse(host.Name); err == nil {
-					r.Host = baseUrl.Host
-					if proxy == nil {
-						proxy = NewSingleHostReverseProxy(baseUrl)
-					}
-				} else if proxy == nil {
-					return http.StatusInternalServerError, err
-				}
-				var extraHeaders http.Header
-				if host.ExtraHeaders != nil {
-					extraHeaders = make(http.Header)
-					if replacer == nil {
-						rHost := r.Host
-						r.Host = requestHost
-						replacer = middleware.NewReplacer(r, nil)
-						r.Host = rHost
-					}
-					for header, values := range host.ExtraHeaders {
-						for _, value := range values {
-							extraHeaders.Add(header,
-								replacer.Replace(value))
-							if header == "Host" {
-								r.Host = replacer.Replace(value)
-							}
-						}
+// setUpstream records the name of host, if not nil, in the
+// context of r under UpstreamCtxKey. r is changed in place, so
+// that middleware which passed r on to the proxy can read it.
+func setUpstream(r *http.Request, host *UpstreamHost) {
+	if host != nil {
+		*r = *r.WithContext(context.WithValue(r.Context(), UpstreamCtxKey, host.Name))
+	}
+}
+
+// serveUpstreamOrFallback proxies r to a host of upstream, which
+// has the options opts, serving its fallback page if no host could
+// serve r. It also returns the host last tried, or nil if none was
+// tried.
+func (p Proxy) serveUpstreamOrFallback(w http.ResponseWriter, r *http.Request, upstream Upstream, opts UpstreamOptions) (int, *UpstreamHost, error) {
+	if maintenance := opts.Maintenance; maintenance != nil && maintenance.On() {
+		status, err := maintenance.serve(w, r)
+		return status, nil, err
+	}
+	status, host, err := p.serveUpstream(w, r, upstream, opts)
+	if _, blocked := err.(contentTypeError); blocked {
+		// the backend is up, there is nothing to fall back for
+		return status, host, err
+	}
+	if status == http.StatusBadGateway || status == http.StatusServiceUnavailable {
+		if fallback := opts.Fallback; fallback != nil {
+			status, err = fallback.serve(w, r, err)
+		}
+	}
+	return status, host, err
+}
+
+// serveUpstream proxies r to a host of upstream, which has the
+// options opts. It also returns the host last tried, or nil if
+// none was tried.
+func (p Proxy) serveUpstream(w http.ResponseWriter, r *http.Request, upstream Upstream, opts UpstreamOptions) (int, *UpstreamHost, error) {
+	if methods := opts.Methods; methods != nil && !allowedMethod(methods, r.Method) {
+		w.Header().Set("Allow", strings.Join(methods, ", "))
+		return http.StatusMethodNotAllowed, nil, nil
+	}
+	// a request which already came through here was
+	// proxied back to us and would only go round again
+	if via := opts.Via; via != "" && hasVia(r.Header, via) {
+		return http.StatusLoopDetected, nil, errLoop
+	}
+	if shedder := opts.LoadShedder; shedder != nil {
+		if !shedder.admit() {
+			return http.StatusServiceUnavailable, nil, errShed
+		}
+		defer shedder.done()
+	}
+	var replacer middleware.Replacer
+	var tried *UpstreamHost
+	start := time.Now()
+	requestHost := r.Host
+	requestPath, requestQuery := r.URL.Path, r.URL.RawQuery
+	budget := opts.RetryBudget
+	if budget != nil {
+		budget.Request()
+	}
+
+	// Since Select() should give us "up" hosts, keep retrying hosts
+	// until the try limit or duration is reached (or until we get a
+	// nil host).
+	tryLimit, tryDuration := opts.TryLimit, opts.TryDuration
+	if tryDuration <= 0 {
+		tryDuration = DefaultTryDuration
+	}
+	var lastErr error
+	for tries := 0; ; tries++ {
+		if tryLimit > 0 && tries >= tryLimit {
+			// let the client know what went wrong with the last try
+			return http.StatusBadGateway, tried, lastErr
+		}
+		if tries > 0 {
+			// the next try would start after the duration
+			delay := jitter(opts.RetryDelay)
+			if time.Since(start)+delay >= tryDuration {
+				return http.StatusBadGateway, tried, errUnreachable
+			}
+			if budget != nil && !budget.Retry() {
+				return http.StatusBadGateway, tried, errRetryBudget
+			}
+			time.Sleep(delay)
+		}
+		host, err := selectHost(upstream, r)
+		if host == nil {
+			if err == ErrAllBusy || err == ErrOutage {
+				return http.StatusServiceUnavailable, tried, err
+			}
+			if err == ErrAllDown && tries == 0 && opts.FailFast {
+				// an outage, not a failure of this request
+				return http.StatusServiceUnavailable, tried, err
+			}
+			return http.StatusBadGateway, tried, err
+		}
+		tried = host
+		proxy := host.ReverseProxy
+		r.Host = host.Name
+
+		if baseUrl, err := url.Parse(host.Name); err == nil {
+			r.Host = baseUrl.Host
+			if proxy == nil {
+				proxy = NewSingleHostReverseProxy(baseUrl)
+			}
+		} else if proxy == nil {
+			return http.StatusInternalServerError, tried, err
+		}
+		if (host.ExtraHeaders != nil || host.HostHeader != "") && replacer == nil {
+			rHost := r.Host
+			r.Host = requestHost
+			replacer = middleware.NewReplacer(r, nil)
+			r.Host = rHost
+		}
+		var extraHeaders http.Header
+		if host.ExtraHeaders != nil {
+			extraHeaders = make(http.Header)
+			for header, values := range host.ExtraHeaders {
+				for _, value := range values {
+					extraHeaders.Add(header,
+						replacer.Replace(value))
+					if header == "Host" {
+						r.Host = replacer.Replace(value)
 					}
 				}
+			}
+		}
+		if host.HostHeader != "" {
+			r.Host = replacer.Replace(host.HostHeader)
+		}
 
-				atomic.AddInt64(&host.Conns, 1)
-				backendErr := proxy.ServeHTTP(w, r, extraHeaders)
-				atomic.AddInt64(&host.Conns, -1)
-				if backendErr == nil {
-					return 0, nil
-				}
-				timeout := host.FailTimeout
-				if timeout == 0 {
-					timeout = 10 * time.Second
-				}
-				atomic.AddInt32(&host.Fails, 1)
-				go func(host *UpstreamHost, timeout time.Duration) {
-					time.Sleep(timeout)
-					atomic.AddInt32(&host.Fails, -1)
-				}(host, timeout)
+		if host.ForwardedHost || host.ForwardedPort || host.Forwarded {
+			if extraHeaders == nil {
+				extraHeaders = make(http.Header)
+			}
+			forwardedHeaders(extraHeaders, host, r, requestHost)
+		}
+
+		r.URL.Path, r.URL.RawQuery = host.rewritePath(requestPath, requestQuery)
+
+		atomic.AddInt64(&host.Conns, 1)
+		backendErr := proxy.ServeHTTP(w, r, extraHeaders)
+		atomic.AddInt64(&host.Conns, -1)
+		r.URL.Path, r.URL.RawQuery = requestPath, requestQuery
+		lastErr = backendErr
+		if backendErr == nil {
+			if host.ResetFailsOnSuccess {
+				atomic.StoreInt32(&host.Fails, 0)
 			}
-			return http.StatusBadGateway, errUnreachable
+			return 0, tried, nil
+		}
+		if _, blocked := backendErr.(contentTypeError); blocked {
+			// the host responded fine, just not with
+			// something we may pass on
+			return http.StatusBadGateway, tried, backendErr
+		}
+		if backendErr == errNotHijackable {
+			// our own response writer cannot upgrade the
+			// connection, which is no fault of the host
+			return http.StatusInternalServerError, tried, backendErr
+		}
+		atomic.AddInt32(&host.Fails, 1)
+		if !host.KeepFails {
+			timeout := host.FailTimeout
+			if timeout == 0 {
+				timeout = 10 * time.Second
+			}
+			go func(host *UpstreamHost, timeout time.Duration) {
+				time.Sleep(timeout)
+				host.forgetFail()
+			}(host, timeout)
+		}
+		if failure, ok := backendErr.(*BackendError); ok && !failure.Retryable() {
+			// trying again would fail alike
+			return http.StatusBadGateway, tried, backendErr
 		}
 	}
+}
 
-	return p.Next.ServeHTTP(w, r)
+// allowedMethod returns whether method is one of methods.
+func allowedMethod(methods []string, method string) bool {
+	for _, m := range methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
 }
 
 // New creates a new instance of proxy middleware.
 func New(c middleware.Controller) (middleware.Middleware, error) {
-	if upstreams, err := newStaticUpstreams(c); err == nil {
+	if upstreams, err := newStaticUpstreams(c, false); err == nil {
 		return func(next middleware.Handler) middleware.Handler {
 			return Proxy{Next: next, Upstreams: upstreams}
 		}, nil
@@ -130,3 +526,17 @@ func New(c middleware.Controller) (middleware.Middleware, error) {
 		return nil, err
 	}
 }
+
+// Validate parses and validates the proxy configuration of c
+// like New, without starting health checks or registering
+// startup functions. Upstream hosts are not resolved or
+// connected to. Errors are returned as a *middleware.ParseError.
+func Validate(c middleware.Controller) error {
+	if _, err := newStaticUpstreams(c, true); err != nil {
+		if _, ok := err.(*middleware.ParseError); !ok {
+			err = c.Err(err.Error())
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,1095 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy/middleware"
+)
+
+func newTestUpstream(backend string) *staticUpstream {
+	return &staticUpstream{
+		from: "/",
+		Hosts: HostPool{
+			&UpstreamHost{
+				Name:        backend,
+				FailTimeout: 10 * time.Second,
+			},
+		},
+		Policy:      &Random{},
+		FailTimeout: 10 * time.Second,
+		MaxFails:    1,
+	}
+}
+
+func TestPathRewrite(t *testing.T) {
+	var backendPath, backendQuery string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendPath = r.URL.Path
+		backendQuery = r.URL.RawQuery
+	}))
+	defer backend.Close()
+
+	upstream := newTestUpstream(backend.URL)
+	upstream.Hosts[0].PathRewrites = []PathRewrite{
+		{Pattern: regexp.MustCompile(`^/old/(.*)$`), Replacement: "/new/$1"},
+		{Pattern: regexp.MustCompile(`^/old/`), Replacement: "/never/"},
+		{Pattern: regexp.MustCompile(`^/search$`), Replacement: "/find?v=2"},
+	}
+	p := Proxy{Upstreams: []Upstream{upstream}}
+
+	tests := []struct {
+		path          string
+		expected      string
+		expectedQuery string
+	}{
+		{"/old/foo/bar", "/new/foo/bar", ""},
+		{"/other/old/foo", "/other/old/foo", ""},
+		{"/old/list?page=2&sort=name", "/new/list", "page=2&sort=name"},
+		{"/other?q=a%26b", "/other", "q=a%26b"},
+		{"/search", "/find", "v=2"},
+		{"/search?q=caddy", "/find", "v=2&q=caddy"},
+	}
+
+	for i, test := range tests {
+		r, err := http.NewRequest("GET", test.path, nil)
+		if err != nil {
+			t.Fatalf("Test %d: Could not create request: %v", i, err)
+		}
+		if _, err := p.ServeHTTP(httptest.NewRecorder(), r); err != nil {
+			t.Errorf("Test %d: Expected no error, got %v", i, err)
+		}
+		if backendPath != test.expected {
+			t.Errorf("Test %d: Expected backend path %s, got %s", i, test.expected, backendPath)
+		}
+		if backendQuery != test.expectedQuery {
+			t.Errorf("Test %d: Expected backend query %s, got %s", i, test.expectedQuery, backendQuery)
+		}
+		if r.URL.RequestURI() != test.path {
+			t.Errorf("Test %d: Expected request URI to be restored to %s, got %s", i, test.path, r.URL.RequestURI())
+		}
+	}
+}
+
+func TestAllowedMethods(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	upstream := newTestUpstream(backend.URL)
+	upstream.Methods = []string{"GET", "HEAD", "PROPFIND"}
+	p := Proxy{Upstreams: []Upstream{upstream}}
+
+	tests := []struct {
+		method   string
+		expected int
+	}{
+		{"GET", 0},
+		{"HEAD", 0},
+		{"POST", http.StatusMethodNotAllowed},
+		{"DELETE", http.StatusMethodNotAllowed},
+		{"PROPFIND", 0},
+		{"propfind", http.StatusMethodNotAllowed},
+	}
+
+	for i, test := range tests {
+		r, err := http.NewRequest(test.method, "/", nil)
+		if err != nil {
+			t.Fatalf("Test %d: Could not create request: %v", i, err)
+		}
+		w := httptest.NewRecorder()
+		status, _ := p.ServeHTTP(w, r)
+		if status != test.expected {
+			t.Errorf("Test %d: Expected status %d, got %d", i, test.expected, status)
+		}
+		if status == http.StatusMethodNotAllowed && w.Header().Get("Allow") != "GET, HEAD, PROPFIND" {
+			t.Errorf("Test %d: Expected Allow header 'GET, HEAD, PROPFIND', got '%s'", i, w.Header().Get("Allow"))
+		}
+	}
+}
+
+func TestFallback(t *testing.T) {
+	page, err := ioutil.TempFile("", "maintenance*.html")
+	if err != nil {
+		t.Fatalf("Could not create fallback page: %v", err)
+	}
+	defer os.Remove(page.Name())
+	page.WriteString("Down for maintenance")
+	page.Close()
+
+	upstream := newTestUpstream("http://localhost")
+	upstream.Hosts[0].SetUnhealthy(true)
+	upstream.Fallback = &Fallback{Path: page.Name(), Status: http.StatusServiceUnavailable}
+	p := Proxy{Upstreams: []Upstream{upstream}}
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatalf("Could not create request: %v", err)
+	}
+	w := httptest.NewRecorder()
+	status, err := p.ServeHTTP(w, r)
+	if status != 0 {
+		t.Errorf("Expected status 0 as the fallback was written, got %d", status)
+	}
+	if err != ErrAllDown {
+		t.Errorf("Expected error %v to be passed on, got %v", ErrAllDown, err)
+	}
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected fallback status %d, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+	if w.Body.String() != "Down for maintenance" {
+		t.Errorf("Expected fallback page to be served, got '%s'", w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "text/html; charset=utf-8" {
+		t.Errorf("Expected html content type, got '%s'", ct)
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	page, err := ioutil.TempFile("", "maintenance*.html")
+	if err != nil {
+		t.Fatalf("Could not create maintenance page: %v", err)
+	}
+	defer os.Remove(page.Name())
+	page.WriteString("Down for maintenance")
+	page.Close()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello"))
+	}))
+	defer backend.Close()
+
+	upstream := newTestUpstream(backend.URL)
+	upstream.Maintenance = &Maintenance{}
+	p := Proxy{Upstreams: []Upstream{upstream}}
+
+	tests := []struct {
+		on     bool
+		page   bool
+		status int
+		code   int
+		body   string
+	}{
+		{true, true, 0, http.StatusServiceUnavailable, "Down for maintenance"},
+		// without a page, the error page is left to the errors middleware
+		{true, false, http.StatusServiceUnavailable, http.StatusOK, ""},
+		{false, true, 0, http.StatusOK, "Hello"},
+	}
+	for i, test := range tests {
+		upstream.Maintenance.SetOn(test.on)
+		upstream.Maintenance.Page = nil
+		if test.page {
+			upstream.Maintenance.Page = &Fallback{Path: page.Name(), Status: http.StatusServiceUnavailable}
+		}
+		r, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatalf("Test %d: Could not create request: %v", i, err)
+		}
+		w := httptest.NewRecorder()
+		status, err := p.ServeHTTP(w, r)
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got %v", i, err)
+		}
+		if status != test.status {
+			t.Errorf("Test %d: Expected status %d, got %d", i, test.status, status)
+		}
+		if w.Code != test.code {
+			t.Errorf("Test %d: Expected response status %d, got %d", i, test.code, w.Code)
+		}
+		if w.Body.String() != test.body {
+			t.Errorf("Test %d: Expected body '%s', got '%s'", i, test.body, w.Body.String())
+		}
+	}
+}
+
+func TestResetFailsOnSuccess(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	for _, reset := range []bool{false, true} {
+		upstream := newTestUpstream(backend.URL)
+		host := upstream.Hosts[0]
+		host.CheckDown = func(uh *UpstreamHost) bool { return uh.Fails >= 3 }
+		host.ResetFailsOnSuccess = reset
+		host.Fails = 2
+		p := Proxy{Upstreams: []Upstream{upstream}}
+
+		r, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatalf("Could not create request: %v", err)
+		}
+		if _, err := p.ServeHTTP(httptest.NewRecorder(), r); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		expected := int32(2)
+		if reset {
+			expected = 0
+		}
+		if host.Fails != expected {
+			t.Errorf("With reset %v: Expected %d fails after a success, got %d", reset, expected, host.Fails)
+		}
+
+		// the failures are still forgotten after the fail timeout,
+		// which must not take fails below zero once reset
+		host.forgetFail()
+		host.forgetFail()
+		if host.Fails != 0 {
+			t.Errorf("With reset %v: Expected 0 fails once forgotten, got %d", reset, host.Fails)
+		}
+	}
+}
+
+func TestTryLimit(t *testing.T) {
+	// closes connections without responding
+	backend := newRawBackend(t, "")
+
+	upstream := newTestUpstream(backend.String())
+	for i := 0; i < 3; i++ {
+		upstream.Hosts = append(upstream.Hosts, &UpstreamHost{
+			Name:        backend.String(),
+			FailTimeout: 10 * time.Second,
+		})
+	}
+	policy := &countingPolicy{}
+	upstream.Policy = policy
+	upstream.TryLimit = 2
+	p := Proxy{Upstreams: []Upstream{upstream}}
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatalf("Could not create request: %v", err)
+	}
+	status, err := p.ServeHTTP(httptest.NewRecorder(), r)
+	if status != http.StatusBadGateway {
+		t.Errorf("Expected status 502, got %d", status)
+	}
+	if err == nil || err == errUnreachable {
+		t.Errorf("Expected the error of the last try, got %v", err)
+	}
+	if policy.selections != 2 {
+		t.Errorf("Expected 2 hosts to be tried, got %d", policy.selections)
+	}
+}
+
+func TestTryDuration(t *testing.T) {
+	// closes connections without responding
+	backend := newRawBackend(t, "")
+	neverDown := func(*UpstreamHost) bool { return false }
+
+	tests := []struct {
+		tryLimit    int
+		tryDuration time.Duration
+		retryDelay  time.Duration
+		minTries    int
+		maxTries    int
+		unreachable bool // stopped by the duration, not the limit
+	}{
+		// the limit is reached first
+		{3, 10 * time.Second, 0, 3, 3, false},
+		// the duration is reached first
+		{0, 100 * time.Millisecond, 10 * time.Millisecond, 2, 20, true},
+		{1000, 100 * time.Millisecond, 10 * time.Millisecond, 2, 20, true},
+		// no try starts after the duration, even if it is after the delay
+		{0, 100 * time.Millisecond, time.Second, 1, 1, true},
+	}
+
+	for i, test := range tests {
+		upstream := newTestUpstream(backend.String())
+		upstream.Hosts = append(upstream.Hosts, &UpstreamHost{Name: backend.String()})
+		for _, host := range upstream.Hosts {
+			host.CheckDown = neverDown
+		}
+		policy := &countingPolicy{}
+		upstream.Policy = policy
+		upstream.TryLimit = test.tryLimit
+		upstream.TryDuration = test.tryDuration
+		upstream.RetryDelay = test.retryDelay
+		p := Proxy{Upstreams: []Upstream{upstream}}
+
+		r, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatalf("Test %d: Could not create request: %v", i, err)
+		}
+		start := time.Now()
+		status, err := p.ServeHTTP(httptest.NewRecorder(), r)
+		took := time.Since(start)
+		if status != http.StatusBadGateway {
+			t.Errorf("Test %d: Expected status 502, got %d", i, status)
+		}
+		if (err == errUnreachable) != test.unreachable {
+			t.Errorf("Test %d: Expected stopping by the duration to be %v, got error %v", i, test.unreachable, err)
+		}
+		if policy.selections < test.minTries || policy.selections > test.maxTries {
+			t.Errorf("Test %d: Expected %d to %d tries, got %d", i, test.minTries, test.maxTries, policy.selections)
+		}
+		// no try starts after the duration, but the last one
+		// may run past it, as may the scheduling of the test
+		if limit := test.tryDuration + 100*time.Millisecond; took >= limit {
+			t.Errorf("Test %d: Expected to stop within %v, took %v", i, limit, took)
+		}
+	}
+}
+
+// countingPolicy is the random policy, counting how often it selects.
+type countingPolicy struct {
+	selections int
+}
+
+func (c *countingPolicy) Select(pool HostPool) *UpstreamHost {
+	c.selections++
+	return (&Random{}).Select(pool)
+}
+
+func TestKeepFails(t *testing.T) {
+	// closes connections without responding
+	backend := newRawBackend(t, "")
+
+	upstream := newTestUpstream(backend.String())
+	host := upstream.Hosts[0]
+	host.FailTimeout = 0
+	host.KeepFails = true
+	p := Proxy{Upstreams: []Upstream{upstream}}
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatalf("Could not create request: %v", err)
+	}
+	if status, _ := p.ServeHTTP(httptest.NewRecorder(), r); status != http.StatusBadGateway {
+		t.Errorf("Expected status 502, got %d", status)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if !host.Down() {
+		t.Error("Expected the failed host to stay down")
+	}
+
+	// a passing health check brings it back up
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer healthy.Close()
+	host.Name = healthy.URL
+	upstream.HealthCheck.Path = "/health"
+	upstream.healthCheck()
+	if host.Down() {
+		t.Error("Expected the host to be up after passing a health check")
+	}
+}
+
+func TestUpstreamLog(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer backend.Close()
+
+	var buf bytes.Buffer
+	upstream := newTestUpstream(backend.URL)
+	upstream.Log = &UpstreamLog{
+		Format: "{method} {host}{path} {upstream} {status} {latency}",
+		Log:    log.New(&buf, "", 0),
+	}
+	p := Proxy{Upstreams: []Upstream{upstream}}
+
+	r, err := http.NewRequest("POST", "http://example.com/api", nil)
+	if err != nil {
+		t.Fatalf("Could not create request: %v", err)
+	}
+	p.ServeHTTP(httptest.NewRecorder(), r)
+	prefix := "POST example.com/api " + backend.URL + " 201 "
+	if !strings.HasPrefix(buf.String(), prefix) || strings.HasSuffix(buf.String(), " -\n") {
+		t.Errorf("Expected log line starting with '%s' and with the latency, got '%s'", prefix, buf.String())
+	}
+
+	// the status returned is logged if nothing was written
+	buf.Reset()
+	upstream.Hosts[0].SetUnhealthy(true)
+	r, err = http.NewRequest("POST", "http://example.com/api", nil)
+	if err != nil {
+		t.Fatalf("Could not create request: %v", err)
+	}
+	p.ServeHTTP(httptest.NewRecorder(), r)
+	prefix = "POST example.com/api - 502 "
+	if !strings.HasPrefix(buf.String(), prefix) {
+		t.Errorf("Expected log line starting with '%s', got '%s'", prefix, buf.String())
+	}
+
+	// in the Common Log Format, with the time the request came in
+	buf.Reset()
+	upstream.Hosts[0].SetUnhealthy(false)
+	upstream.Log.Format = CommonLogFormat
+	r, err = http.NewRequest("GET", "http://example.com/api?q=1", nil)
+	if err != nil {
+		t.Fatalf("Could not create request: %v", err)
+	}
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.RequestURI = "/api?q=1"
+	start := time.Now()
+	p.ServeHTTP(httptest.NewRecorder(), r)
+	expected := `192.0.2.1 - [` + start.Format("02/Jan/2006:15:04:05 -0700") + `] "GET /api?q=1 HTTP/1.1" 201 0 ` + backend.URL + "\n"
+	if buf.String() != expected {
+		t.Errorf("Expected log line '%s', got '%s'", expected, buf.String())
+	}
+}
+
+func TestForwardedHostPort(t *testing.T) {
+	var forwardedHost, forwardedPort string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwardedHost = r.Header.Get("X-Forwarded-Host")
+		forwardedPort = r.Header.Get("X-Forwarded-Port")
+	}))
+	defer backend.Close()
+
+	upstream := newTestUpstream(backend.URL)
+	upstream.Hosts[0].ForwardedHost = true
+	upstream.Hosts[0].ForwardedPort = true
+	p := Proxy{Upstreams: []Upstream{upstream}}
+
+	tests := []struct {
+		url          string
+		priorHost    string
+		priorPort    string
+		expectedHost string
+		expectedPort string
+	}{
+		{"http://example.com:8080/", "", "", "example.com:8080", "8080"},
+		{"http://example.com/", "", "", "example.com", "80"},
+		{"https://example.com/", "", "", "example.com", "443"},
+		{"http://example.com/", "edge.example.com", "443", "edge.example.com, example.com", "443, 80"},
+	}
+
+	for i, test := range tests {
+		r, err := http.NewRequest("GET", test.url, nil)
+		if err != nil {
+			t.Fatalf("Test %d: Could not create request: %v", i, err)
+		}
+		if r.URL.Scheme == "https" {
+			r.TLS = &tls.ConnectionState{}
+		}
+		if test.priorHost != "" {
+			r.Header.Set("X-Forwarded-Host", test.priorHost)
+			r.Header.Set("X-Forwarded-Port", test.priorPort)
+		}
+		if _, err := p.ServeHTTP(httptest.NewRecorder(), r); err != nil {
+			t.Fatalf("Test %d: Expected no error, got %v", i, err)
+		}
+		if forwardedHost != test.expectedHost {
+			t.Errorf("Test %d: Expected X-Forwarded-Host '%s', got '%s'", i, test.expectedHost, forwardedHost)
+		}
+		if forwardedPort != test.expectedPort {
+			t.Errorf("Test %d: Expected X-Forwarded-Port '%s', got '%s'", i, test.expectedPort, forwardedPort)
+		}
+	}
+}
+
+func TestForwardedRetry(t *testing.T) {
+	var tries int32
+	var received http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&tries, 1) == 1 {
+			// fail the first try
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		received = r.Header
+	}))
+	defer backend.Close()
+
+	upstream := newTestUpstream(backend.URL)
+	upstream.Hosts[0].CheckDown = func(*UpstreamHost) bool { return false }
+	upstream.Hosts[0].ForwardedHost = true
+	upstream.Hosts[0].ForwardedPort = true
+	upstream.Hosts[0].Forwarded = true
+	upstream.TryLimit = 2
+	p := Proxy{Upstreams: []Upstream{upstream}}
+
+	r, err := http.NewRequest("GET", "http://example.com/", nil)
+	if err != nil {
+		t.Fatalf("Could not create request: %v", err)
+	}
+	r.RemoteAddr = "192.0.2.1:56324"
+	r.Header.Set("X-Forwarded-Host", "edge.example.com")
+	r.Header.Set("Forwarded", "for=198.51.100.1")
+	if _, err := p.ServeHTTP(httptest.NewRecorder(), r); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if tries != 2 {
+		t.Fatalf("Expected 2 tries, got %d", tries)
+	}
+
+	// the second try gets the headers of a first one
+	expected := map[string]string{
+		"X-Forwarded-Host": "edge.example.com, example.com",
+		"X-Forwarded-Port": "80",
+		"X-Forwarded-For":  "192.0.2.1",
+		"Forwarded":        "for=198.51.100.1, for=192.0.2.1;host=example.com;proto=http",
+	}
+	for name, value := range expected {
+		if got := strings.Join(received[name], ", "); got != value {
+			t.Errorf("Expected %s '%s', got '%s'", name, value, got)
+		}
+	}
+	if len(r.Header) != 2 || r.Header.Get("X-Forwarded-Host") != "edge.example.com" || r.Header.Get("Forwarded") != "for=198.51.100.1" {
+		t.Errorf("Expected the headers of the request to be left alone, got %v", r.Header)
+	}
+}
+
+func TestContentTypes(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.URL.Query().Get("type"); ct != "" {
+			w.Header().Set("Content-Type", ct)
+		} else {
+			w.Header()["Content-Type"] = nil
+		}
+		w.Write([]byte("content"))
+	}))
+	defer backend.Close()
+
+	upstream := newTestUpstream(backend.URL)
+	host := upstream.Hosts[0]
+	backendUrl, _ := url.Parse(backend.URL)
+	host.ReverseProxy = NewSingleHostReverseProxy(backendUrl)
+	host.ReverseProxy.AllowContentTypes = []string{"text/*", "image/png"}
+	host.ReverseProxy.DenyContentTypes = []string{"text/x-shellscript"}
+	upstream.Fallback = &Fallback{Status: http.StatusServiceUnavailable}
+	p := Proxy{Upstreams: []Upstream{upstream}}
+
+	tests := []struct {
+		contentType string
+		expected    int
+	}{
+		{"text/html; charset=utf-8", 0},
+		{"Text/Plain", 0},
+		{"image/png", 0},
+		{"image/jpeg", http.StatusBadGateway},
+		{"text/x-shellscript", http.StatusBadGateway},
+		{"application/x-msdownload", http.StatusBadGateway},
+		{"", http.StatusBadGateway}, // application/octet-stream
+	}
+
+	for i, test := range tests {
+		r, err := http.NewRequest("GET", "/?type="+url.QueryEscape(test.contentType), nil)
+		if err != nil {
+			t.Fatalf("Test %d: Could not create request: %v", i, err)
+		}
+		w := httptest.NewRecorder()
+		status, err := p.ServeHTTP(w, r)
+		if status != test.expected {
+			t.Errorf("Test %d: Expected status %d, got %d", i, test.expected, status)
+		}
+		if status == 0 && w.Body.String() != "content" {
+			t.Errorf("Test %d: Expected the response to be passed on, got '%s'", i, w.Body.String())
+		}
+		if status != 0 && (err == nil || w.Body.Len() != 0) {
+			t.Errorf("Test %d: Expected an error and nothing written, got %v and '%s'", i, err, w.Body.String())
+		}
+	}
+	if host.Fails != 0 {
+		t.Errorf("Expected blocked responses not to count as failures, got %d", host.Fails)
+	}
+}
+
+func TestForwarded(t *testing.T) {
+	var forwarded string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header.Get("Forwarded")
+	}))
+	defer backend.Close()
+
+	upstream := newTestUpstream(backend.URL)
+	upstream.Hosts[0].Forwarded = true
+	p := Proxy{Upstreams: []Upstream{upstream}}
+
+	tests := []struct {
+		url        string
+		remoteAddr string
+		prior      string
+		expected   string
+	}{
+		{"http://example.com/", "192.0.2.60:1234", "", "for=192.0.2.60;host=example.com;proto=http"},
+		{"https://example.com:8443/", "[2001:db8::1]:1234", "", `for="[2001:db8::1]";host="example.com:8443";proto=https`},
+		{"http://example.com/", "192.0.2.60:1234", "for=198.51.100.17", "for=198.51.100.17, for=192.0.2.60;host=example.com;proto=http"},
+	}
+
+	for i, test := range tests {
+		r, err := http.NewRequest("GET", test.url, nil)
+		if err != nil {
+			t.Fatalf("Test %d: Could not create request: %v", i, err)
+		}
+		r.RemoteAddr = test.remoteAddr
+		if r.URL.Scheme == "https" {
+			r.TLS = &tls.ConnectionState{}
+		}
+		if test.prior != "" {
+			r.Header.Set("Forwarded", test.prior)
+		}
+		if _, err := p.ServeHTTP(httptest.NewRecorder(), r); err != nil {
+			t.Fatalf("Test %d: Expected no error, got %v", i, err)
+		}
+		if forwarded != test.expected {
+			t.Errorf("Test %d: Expected Forwarded '%s', got '%s'", i, test.expected, forwarded)
+		}
+	}
+}
+
+func TestUpstreamCtxKey(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	upstream := newTestUpstream(backend.URL)
+	p := Proxy{Upstreams: []Upstream{upstream}}
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatalf("Could not create request: %v", err)
+	}
+	if _, err := p.ServeHTTP(httptest.NewRecorder(), r); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if name, _ := r.Context().Value(UpstreamCtxKey).(string); name != backend.URL {
+		t.Errorf("Expected upstream %s in the request context, got '%s'", backend.URL, name)
+	}
+
+	// nothing is set if no host was tried
+	upstream.Hosts[0].SetUnhealthy(true)
+	r, err = http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatalf("Could not create request: %v", err)
+	}
+	p.ServeHTTP(httptest.NewRecorder(), r)
+	if name := r.Context().Value(UpstreamCtxKey); name != nil {
+		t.Errorf("Expected no upstream in the request context, got %v", name)
+	}
+}
+
+func TestCaseInsensitive(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	next := middleware.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		return http.StatusNotFound, nil
+	})
+
+	for _, insensitive := range []bool{false, true} {
+		upstream := newTestUpstream(backend.URL)
+		upstream.from = "/api"
+		upstream.CaseInsensitive = insensitive
+		p := Proxy{Next: next, Upstreams: []Upstream{upstream}}
+
+		r, err := http.NewRequest("GET", "/API/users", nil)
+		if err != nil {
+			t.Fatalf("Could not create request: %v", err)
+		}
+		status, _ := p.ServeHTTP(httptest.NewRecorder(), r)
+		expected := http.StatusNotFound
+		if insensitive {
+			expected = 0
+		}
+		if status != expected {
+			t.Errorf("With case_insensitive %v: Expected status %d, got %d", insensitive, expected, status)
+		}
+	}
+}
+
+func TestHostHeader(t *testing.T) {
+	var host string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host = r.Host
+	}))
+	defer backend.Close()
+	backendUrl, _ := url.Parse(backend.URL)
+
+	tests := []struct {
+		hostHeader   string
+		extraHeaders http.Header
+		expected     string
+	}{
+		// the host of the backend by default
+		{"", nil, backendUrl.Host},
+		{"app.internal", nil, "app.internal"},
+		{"{host}", nil, "example.com"},
+		// it takes precedence over a Host in the extra headers
+		{"", http.Header{"Host": {"extra.internal"}}, "extra.internal"},
+		{"app.internal", http.Header{"Host": {"extra.internal"}, "X-Other": {"1"}}, "app.internal"},
+	}
+	for i, test := range tests {
+		upstream := newTestUpstream(backend.URL)
+		upstream.Hosts[0].HostHeader = test.hostHeader
+		upstream.Hosts[0].ExtraHeaders = test.extraHeaders
+		p := Proxy{Upstreams: []Upstream{upstream}}
+
+		r, err := http.NewRequest("GET", "http://example.com/", nil)
+		if err != nil {
+			t.Fatalf("Test %d: Could not create request: %v", i, err)
+		}
+		host = ""
+		p.ServeHTTP(httptest.NewRecorder(), r)
+		if host != test.expected {
+			t.Errorf("Test %d: Expected Host %s, got %s", i, test.expected, host)
+		}
+	}
+}
+
+func TestTrailers(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/stream" {
+			// flushed, so that its length is not known
+			w.Write([]byte("hello "))
+			w.(http.Flusher).Flush()
+		}
+		w.Write([]byte("world"))
+	}))
+	defer backend.Close()
+
+	upstream := newTestUpstream(backend.URL)
+	backendUrl, _ := url.Parse(backend.URL)
+	upstream.Hosts[0].ReverseProxy = NewSingleHostReverseProxy(backendUrl)
+	upstream.Hosts[0].ReverseProxy.Trailers = http.Header{
+		"X-Checksum": {"sha256={body_sha256}"},
+		"X-Size":     {"{body_size}"},
+	}
+	p := Proxy{Upstreams: []Upstream{upstream}}
+	frontend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.ServeHTTP(w, r)
+	}))
+	defer frontend.Close()
+
+	tests := []struct {
+		path     string
+		body     string
+		checksum string
+		size     string
+	}{
+		{"/stream", "hello world", "sha256=b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9", "11"},
+		// with a known length, it is not sent chunked
+		{"/", "world", "", ""},
+	}
+	for i, test := range tests {
+		res, err := http.Get(frontend.URL + test.path)
+		if err != nil {
+			t.Fatalf("Test %d: Expected no error, got %v", i, err)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil || string(body) != test.body {
+			t.Errorf("Test %d: Expected body %s, got %s (%v)", i, test.body, body, err)
+		}
+		if checksum := res.Trailer.Get("X-Checksum"); checksum != test.checksum {
+			t.Errorf("Test %d: Expected checksum trailer '%s', got '%s'", i, test.checksum, checksum)
+		}
+		if size := res.Trailer.Get("X-Size"); size != test.size {
+			t.Errorf("Test %d: Expected size trailer '%s', got '%s'", i, test.size, size)
+		}
+	}
+}
+
+func TestInformational(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", "</style.css>; rel=preload; as=style")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.Header().Del("Link")
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	for i, drop := range []bool{false, true} {
+		upstream := newTestUpstream(backend.URL)
+		backendUrl, _ := url.Parse(backend.URL)
+		upstream.Hosts[0].ReverseProxy = NewSingleHostReverseProxy(backendUrl)
+		upstream.Hosts[0].ReverseProxy.DropInformational = drop
+		p := Proxy{Upstreams: []Upstream{upstream}}
+		frontend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Frontend", "yes")
+			p.ServeHTTP(w, r)
+		}))
+		defer frontend.Close()
+
+		var hints []string
+		trace := &httptrace.ClientTrace{
+			Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+				if code == http.StatusEarlyHints {
+					hints = append(hints, header.Get("Link"))
+				}
+				return nil
+			},
+		}
+		req, _ := http.NewRequest("GET", frontend.URL, nil)
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Test %d: Expected no error, got %v", i, err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+
+		if string(body) != "ok" {
+			t.Errorf("Test %d: Expected body ok, got %s", i, body)
+		}
+		if drop && len(hints) != 0 {
+			t.Errorf("Test %d: Expected no early hints, got %v", i, hints)
+		}
+		if !drop && (len(hints) != 1 || hints[0] != "</style.css>; rel=preload; as=style") {
+			t.Errorf("Test %d: Expected the early hints of the backend, got %v", i, hints)
+		}
+		if link := res.Header.Get("Link"); link != "" {
+			t.Errorf("Test %d: Expected no Link header in the final response, got %s", i, link)
+		}
+		if res.Header.Get("X-Frontend") != "yes" {
+			t.Errorf("Test %d: Expected the headers set before proxying to be kept", i)
+		}
+	}
+}
+
+func TestExpectContinue(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/reject" {
+			// without reading the body, so no 100 Continue is sent
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer backend.Close()
+
+	upstream := newTestUpstream(backend.URL)
+	backendUrl, _ := url.Parse(backend.URL)
+	upstream.Hosts[0].ReverseProxy = NewSingleHostReverseProxy(backendUrl)
+	p := Proxy{Upstreams: []Upstream{upstream}}
+	frontend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if status, err := p.ServeHTTP(w, r); err != nil {
+			w.WriteHeader(status)
+		}
+	}))
+	defer frontend.Close()
+
+	// waits long enough for the body not to be sent without a 100 Continue
+	client := &http.Client{Transport: &http.Transport{ExpectContinueTimeout: time.Minute}}
+	tests := []struct {
+		path      string
+		continued bool
+		status    int
+		body      string
+	}{
+		{"/", true, http.StatusOK, "upload"},
+		{"/reject", false, http.StatusRequestEntityTooLarge, ""},
+	}
+	for i, test := range tests {
+		continued := false
+		trace := &httptrace.ClientTrace{
+			Got100Continue: func() { continued = true },
+		}
+		req, _ := http.NewRequest("PUT", frontend.URL+test.path, strings.NewReader("upload"))
+		req.Header.Set("Expect", "100-continue")
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Test %d: Expected no error, got %v", i, err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+
+		if continued != test.continued {
+			t.Errorf("Test %d: Expected 100 Continue %v, got %v", i, test.continued, continued)
+		}
+		if res.StatusCode != test.status {
+			t.Errorf("Test %d: Expected status %d, got %d", i, test.status, res.StatusCode)
+		}
+		if string(body) != test.body {
+			t.Errorf("Test %d: Expected body '%s', got '%s'", i, test.body, body)
+		}
+	}
+}
+
+func TestWebSocketNotHijackable(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	upstream := newTestUpstream(backend.URL)
+	upstream.Hosts = append(upstream.Hosts, &UpstreamHost{Name: backend.URL, FailTimeout: 10 * time.Second})
+	p := Proxy{Upstreams: []Upstream{upstream}}
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatalf("Could not create request: %v", err)
+	}
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	// a recorder cannot be hijacked
+	status, err := p.ServeHTTP(httptest.NewRecorder(), r)
+	if status != http.StatusInternalServerError || err != errNotHijackable {
+		t.Errorf("Expected status %d and error %v, got %d and %v", http.StatusInternalServerError, errNotHijackable, status, err)
+	}
+	for i, host := range upstream.Hosts {
+		if host.Fails != 0 {
+			t.Errorf("Host %d: Expected no failures to be counted, got %d", i, host.Fails)
+		}
+	}
+}
+
+func TestWebSocketLogged(t *testing.T) {
+	// echoes everything after upgrading
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		brw.Flush()
+		io.Copy(conn, brw)
+	}))
+	defer backend.Close()
+
+	var buf bytes.Buffer
+	upstream := newTestUpstream(backend.URL)
+	upstream.Log = &UpstreamLog{Format: "{upstream}", Log: log.New(&buf, "", 0)}
+	p := Proxy{Upstreams: []Upstream{upstream}}
+	frontend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.ServeHTTP(w, r)
+	}))
+	defer frontend.Close()
+
+	conn, err := net.Dial("tcp", frontend.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("Could not read response: %v", err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected status 101 with a log, got %d", res.StatusCode)
+	}
+	io.WriteString(conn, "hello")
+	echo := make([]byte, 5)
+	if _, err := io.ReadFull(br, echo); err != nil || string(echo) != "hello" {
+		t.Errorf("Expected 'hello' to be echoed, got '%s' and %v", echo, err)
+	}
+	if upstream.Hosts[0].Fails != 0 {
+		t.Errorf("Expected no failures to be counted, got %d", upstream.Hosts[0].Fails)
+	}
+}
+
+func TestLoadShedding(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer backend.Close()
+
+	upstream := newTestUpstream(backend.URL)
+	upstream.LoadShedder = &LoadShedder{Max: 2}
+	p := Proxy{Upstreams: []Upstream{upstream}}
+
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			r, _ := http.NewRequest("GET", "/", nil)
+			_, err := p.ServeHTTP(httptest.NewRecorder(), r)
+			errs <- err
+		}()
+	}
+	for upstream.LoadShedder.InFlight() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	r, _ := http.NewRequest("GET", "/", nil)
+	status, err := p.ServeHTTP(httptest.NewRecorder(), r)
+	if status != http.StatusServiceUnavailable || err != errShed {
+		t.Errorf("Expected status %d and error %v over the limit, got %d and %v", http.StatusServiceUnavailable, errShed, status, err)
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("Expected no error within the limit, got %v", err)
+		}
+	}
+	if n := upstream.LoadShedder.InFlight(); n != 0 {
+		t.Errorf("Expected no requests in flight, got %d", n)
+	}
+}
+
+func TestFailFast(t *testing.T) {
+	for _, failFast := range []bool{false, true} {
+		upstream := newTestUpstream("http://localhost")
+		upstream.Hosts[0].SetUnhealthy(true)
+		upstream.FailFast = failFast
+		p := Proxy{Upstreams: []Upstream{upstream}}
+
+		r, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatalf("Could not create request: %v", err)
+		}
+		status, err := p.ServeHTTP(httptest.NewRecorder(), r)
+		expected := http.StatusBadGateway
+		if failFast {
+			expected = http.StatusServiceUnavailable
+		}
+		if status != expected {
+			t.Errorf("With fail_fast %v: Expected status %d, got %d", failFast, expected, status)
+		}
+		if err != ErrAllDown {
+			t.Errorf("With fail_fast %v: Expected error %v, got %v", failFast, ErrAllDown, err)
+		}
+	}
+}
+
+// plainUpstream is an Upstream which is neither a RequestUpstream
+// nor an OptionsUpstream, like those implemented outside this package.
+type plainUpstream struct {
+	host *UpstreamHost
+}
+
+func (u plainUpstream) From() string          { return "/" }
+func (u plainUpstream) Select() *UpstreamHost { return u.host }
+
+func TestPlainUpstream(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello, client"))
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		upstream plainUpstream
+		status   int
+		err      error
+	}{
+		{plainUpstream{&UpstreamHost{Name: backend.URL}}, 0, nil},
+		{plainUpstream{}, http.StatusBadGateway, ErrAllDown},
+	}
+
+	for i, test := range tests {
+		p := Proxy{Upstreams: []Upstream{test.upstream}}
+		r, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatalf("Test %d: Could not create request: %v", i, err)
+		}
+		w := httptest.NewRecorder()
+		status, err := p.ServeHTTP(w, r)
+		if status != test.status || err != test.err {
+			t.Errorf("Test %d: Expected status %d and error %v, got %d and %v", i, test.status, test.err, status, err)
+		}
+		if test.status == 0 && w.Body.String() != "Hello, client" {
+			t.Errorf("Test %d: Expected the response of the backend, got '%s'", i, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// remoteAddrKey is the context key of the address of the
+// client a request to a backend is proxied for.
+type remoteAddrKey struct{}
+
+// proxyProtocolSignature starts each PROXY protocol version 2 header.
+var proxyProtocolSignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtocolHeader returns the PROXY protocol header of the given
+// version (1 or 2) telling a backend that the connection proxied to it
+// is from the client at src to dst. If either is not a TCP address, the
+// header tells the backend to use the address of the connection itself.
+func proxyProtocolHeader(version int, src, dst net.Addr) []byte {
+	srcAddr, srcOk := src.(*net.TCPAddr)
+	dstAddr, dstOk := dst.(*net.TCPAddr)
+	known := srcOk && dstOk && srcAddr != nil && dstAddr != nil
+	v4 := known && srcAddr.IP.To4() != nil && dstAddr.IP.To4() != nil
+
+	if version == 1 {
+		switch {
+		case !known:
+			return []byte("PROXY UNKNOWN\r\n")
+		case v4:
+			return []byte(fmt.Sprintf("PROXY TCP4 %v %v %d %d\r\n", srcAddr.IP.To4(), dstAddr.IP.To4(), srcAddr.Port, dstAddr.Port))
+		default:
+			return []byte(fmt.Sprintf("PROXY TCP6 %v %v %d %d\r\n", srcAddr.IP.To16(), dstAddr.IP.To16(), srcAddr.Port, dstAddr.Port))
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.Write(proxyProtocolSignature)
+	if !known {
+		// LOCAL command, without addresses
+		buf.Write([]byte{0x20, 0x00, 0x00, 0x00})
+		return buf.Bytes()
+	}
+	var addrs []byte
+	if v4 {
+		buf.Write([]byte{0x21, 0x11}) // PROXY command, TCP over IPv4
+		addrs = append(append(addrs, srcAddr.IP.To4()...), dstAddr.IP.To4()...)
+	} else {
+		buf.Write([]byte{0x21, 0x21}) // PROXY command, TCP over IPv6
+		addrs = append(append(addrs, srcAddr.IP.To16()...), dstAddr.IP.To16()...)
+	}
+	ports := make([]byte, 4)
+	binary.BigEndian.PutUint16(ports, uint16(srcAddr.Port))
+	binary.BigEndian.PutUint16(ports[2:], uint16(dstAddr.Port))
+	addrs = append(addrs, ports...)
+	binary.Write(&buf, binary.BigEndian, uint16(len(addrs)))
+	buf.Write(addrs)
+	return buf.Bytes()
+}
+
+// writeProxyProtocolHeader writes the PROXY protocol header of the
+// given version for the client the request with ctx is from to conn.
+func writeProxyProtocolHeader(ctx context.Context, conn net.Conn, version int) error {
+	var src, dst net.Addr
+	if remoteAddr, ok := ctx.Value(remoteAddrKey{}).(string); ok {
+		src = clientAddr(remoteAddr)
+	}
+	if localAddr, ok := ctx.Value(http.LocalAddrContextKey).(net.Addr); ok {
+		dst = localAddr
+	}
+	_, err := conn.Write(proxyProtocolHeader(version, src, dst))
+	return err
+}
+
+// clientAddr returns the TCP address of a client from the RemoteAddr
+// of its request, or nil if that is not an IP address and a port, e.g.
+// for a client on a unix socket. Host names are not looked up.
+func clientAddr(remoteAddr string) net.Addr {
+	host, port, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	p, err := strconv.ParseUint(port, 10, 16)
+	if ip == nil || err != nil {
+		return nil
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}
+}
+
+// proxyProtocolDialer returns a dial function which dials with dialer
+// and starts each connection with a PROXY protocol header of the
+// given version.
+func proxyProtocolDialer(version int, dialer *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeProxyProtocolHeader(ctx, conn, version); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestProxyProtocolHeader(t *testing.T) {
+	v4Src := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324}
+	v4Dst := &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 443}
+	v6Src := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324}
+	v6Dst := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}
+
+	tests := []struct {
+		version  int
+		src, dst net.Addr
+		expected []byte
+	}{
+		{1, v4Src, v4Dst, []byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n")},
+		{1, v6Src, v6Dst, []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n")},
+		{1, nil, v4Dst, []byte("PROXY UNKNOWN\r\n")},
+		{2, v4Src, v4Dst, append(append([]byte{}, proxyProtocolSignature...),
+			0x21, 0x11, 0x00, 0x0C,
+			192, 0, 2, 1, 192, 0, 2, 2,
+			0xDC, 0x04, 0x01, 0xBB)},
+		{2, nil, nil, append(append([]byte{}, proxyProtocolSignature...), 0x20, 0x00, 0x00, 0x00)},
+	}
+
+	for i, test := range tests {
+		if header := proxyProtocolHeader(test.version, test.src, test.dst); !bytes.Equal(header, test.expected) {
+			t.Errorf("Test %d: Expected header %q, got %q", i, test.expected, header)
+		}
+	}
+
+	v6 := proxyProtocolHeader(2, v6Src, v6Dst)
+	if len(v6) != len(proxyProtocolSignature)+4+36 || v6[13] != 0x21 {
+		t.Errorf("Expected an IPv6 header with 36 bytes of addresses, got %q", v6)
+	}
+}
+
+func TestProxyProtocolClientAddr(t *testing.T) {
+	dst := &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 443}
+
+	tests := []struct {
+		remoteAddr string
+		expected   string
+	}{
+		{"192.0.2.1:56324", "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n"},
+		{"[2001:db8::1]:56324", "PROXY TCP6 2001:db8::1 192.0.2.2 56324 443\r\n"},
+		// not an IP address and a port, like those of unix sockets
+		// or rewritten by other middleware, and never looked up
+		{"@", "PROXY UNKNOWN\r\n"},
+		{"", "PROXY UNKNOWN\r\n"},
+		{"192.0.2.1", "PROXY UNKNOWN\r\n"},
+		{"192.0.2.1:http", "PROXY UNKNOWN\r\n"},
+		{"192.0.2.1:65536", "PROXY UNKNOWN\r\n"},
+		{"localhost:56324", "PROXY UNKNOWN\r\n"},
+	}
+
+	for i, test := range tests {
+		ctx := context.WithValue(context.Background(), remoteAddrKey{}, test.remoteAddr)
+		ctx = context.WithValue(ctx, http.LocalAddrContextKey, dst)
+		client, backend := net.Pipe()
+		go func() {
+			writeProxyProtocolHeader(ctx, client, 1)
+			client.Close()
+		}()
+		header, err := ioutil.ReadAll(backend)
+		if err != nil {
+			t.Fatalf("Test %d: Could not read header: %v", i, err)
+		}
+		if string(header) != test.expected {
+			t.Errorf("Test %d: Expected header %q, got %q", i, test.expected, header)
+		}
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	defer ln.Close()
+	headers := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		br := bufio.NewReader(conn)
+		header, _ := br.ReadString('\n')
+		headers <- header
+		if _, err := http.ReadRequest(br); err == nil {
+			io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+		}
+	}()
+
+	upstream := newTestUpstream("http://" + ln.Addr().String())
+	host := upstream.Hosts[0]
+	host.ReverseProxy = NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: ln.Addr().String()})
+	host.ReverseProxy.Transport = newTransport(nil, 1, nil)
+	host.ReverseProxy.ProxyProtocol = 1
+	p := Proxy{Upstreams: []Upstream{upstream}}
+	front := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.ServeHTTP(w, r)
+	}))
+	defer front.Close()
+
+	res, err := http.Get(front.URL)
+	if err != nil {
+		t.Fatalf("Could not request: %v", err)
+	}
+	res.Body.Close()
+
+	header := <-headers
+	proxyPort := strings.Split(front.Listener.Addr().String(), ":")[1]
+	if !strings.HasPrefix(header, "PROXY TCP4 127.0.0.1 127.0.0.1 ") || !strings.HasSuffix(header, " "+proxyPort+"\r\n") {
+		t.Errorf("Expected a PROXY header from the client to the proxy, got %q", header)
+	}
+}
@@ -0,0 +1,34 @@
+package proxy
+
+import "net/http"
+
+// filterRequestHeaders removes the headers of a request to the
+// backend which are denied by DenyRequestHeaders or, if there
+// are AllowRequestHeaders, not allowed by them. Header names
+// must be canonical.
+func (p *ReverseProxy) filterRequestHeaders(h http.Header) {
+	for name := range h {
+		if !p.allowedRequestHeader(name) {
+			delete(h, name)
+		}
+	}
+}
+
+// allowedRequestHeader returns whether the request
+// header name may be sent to the backend.
+func (p *ReverseProxy) allowedRequestHeader(name string) bool {
+	for _, denied := range p.DenyRequestHeaders {
+		if name == denied {
+			return false
+		}
+	}
+	if len(p.AllowRequestHeaders) == 0 {
+		return true
+	}
+	for _, allowed := range p.AllowRequestHeaders {
+		if name == allowed {
+			return true
+		}
+	}
+	return false
+}
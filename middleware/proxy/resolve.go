@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"log"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// lookupHost resolves host names for resolveWorker.
+var lookupHost = net.LookupHost
+
+// resolveWorker resolves the names of the hosts of u every
+// ResolveInterval. Connections are made to the addresses a
+// name resolves to when they are made, but are kept alive;
+// so when the addresses of a host change, the idle connections
+// to it are closed, and new ones are made to the new addresses.
+func (u *staticUpstream) resolveWorker() {
+	addrs := make(map[string]string)
+	u.resolve(addrs)
+	ticker := time.NewTicker(u.ResolveInterval)
+	for range ticker.C {
+		u.resolve(addrs)
+	}
+}
+
+// resolve resolves the names of the hosts of u, and closes the
+// idle connections to those which resolve to other addresses
+// than those in addrs, by host. addrs is updated.
+func (u *staticUpstream) resolve(addrs map[string]string) {
+	for _, pool := range u.pools() {
+		for _, host := range pool {
+			hostUrl, err := url.Parse(host.Name)
+			if err != nil || net.ParseIP(hostUrl.Hostname()) != nil {
+				continue
+			}
+			ips, err := lookupHost(hostUrl.Hostname())
+			if err != nil {
+				// keep what works until the name resolves again
+				continue
+			}
+			sort.Strings(ips)
+			resolved := strings.Join(ips, ",")
+			if prev, ok := addrs[host.Name]; ok && prev != resolved {
+				log.Printf("[INFO] Upstream host %s now resolves to %s", host.Name, resolved)
+				if t, ok := host.ReverseProxy.Transport.(interface{ CloseIdleConnections() }); ok {
+					t.CloseIdleConnections()
+				}
+			}
+			addrs[host.Name] = resolved
+		}
+	}
+}
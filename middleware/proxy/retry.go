@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// jitter returns a random duration between half and one and a half
+// times d, so that retries of many requests do not line up.
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d)))
+}
+
+// retryBudgetBuckets is the number of buckets a
+// retry budget's sliding window is divided into.
+const retryBudgetBuckets = 10
+
+// RetryBudget limits the retries made to an upstream to a ratio
+// of the requests proxied to it over a sliding window of time,
+// so that a struggling backend is not swamped with retries.
+// Always use NewRetryBudget to get one of these.
+type RetryBudget struct {
+	// Ratio of retries to requests allowed, e.g. 0.2
+	Ratio float64
+
+	// Retries that are always allowed per window,
+	// so that retrying works under low traffic
+	MinRetries int
+
+	// Length of the sliding window
+	Window time.Duration
+
+	mu       sync.Mutex
+	requests [retryBudgetBuckets]int
+	retries  [retryBudgetBuckets]int
+	current  int       // index of the current bucket
+	rotated  time.Time // start of the current bucket
+}
+
+// NewRetryBudget makes a new retry budget which allows
+// ratio retries per request and at least minRetries
+// retries over the sliding window.
+func NewRetryBudget(ratio float64, minRetries int, window time.Duration) *RetryBudget {
+	return &RetryBudget{
+		Ratio:      ratio,
+		MinRetries: minRetries,
+		Window:     window,
+		rotated:    time.Now(),
+	}
+}
+
+// Request records a new request.
+func (b *RetryBudget) Request() {
+	b.mu.Lock()
+	b.rotate()
+	b.requests[b.current]++
+	b.mu.Unlock()
+}
+
+// Retry reports whether the budget allows another retry,
+// and if so, records the retry.
+func (b *RetryBudget) Retry() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rotate()
+
+	var requests, retries int
+	for i := 0; i < retryBudgetBuckets; i++ {
+		requests += b.requests[i]
+		retries += b.retries[i]
+	}
+	if retries >= b.MinRetries && float64(retries) >= b.Ratio*float64(requests) {
+		return false
+	}
+	b.retries[b.current]++
+	return true
+}
+
+// rotate advances the window to the current time,
+// clearing the buckets that fell out of it.
+// It must be called with b.mu held.
+func (b *RetryBudget) rotate() {
+	width := b.Window / retryBudgetBuckets
+	if width <= 0 {
+		width = 1
+	}
+	for i := 0; i < retryBudgetBuckets && time.Since(b.rotated) >= width; i++ {
+		b.current = (b.current + 1) % retryBudgetBuckets
+		b.requests[b.current] = 0
+		b.retries[b.current] = 0
+		b.rotated = b.rotated.Add(width)
+	}
+	if time.Since(b.rotated) >= width {
+		// the whole window has passed
+		b.rotated = time.Now()
+	}
+}
@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryBudget(t *testing.T) {
+	budget := NewRetryBudget(0.5, 1, time.Hour)
+
+	if !budget.Retry() {
+		t.Error("Expected minimum retries to be allowed without any requests")
+	}
+	if budget.Retry() {
+		t.Error("Expected retry to be denied once minimum retries are used up")
+	}
+
+	for i := 0; i < 4; i++ {
+		budget.Request()
+	}
+	if !budget.Retry() {
+		t.Error("Expected retry to be allowed within ratio of requests")
+	}
+	if budget.Retry() {
+		t.Error("Expected retry to be denied after exceeding ratio of requests")
+	}
+}
+
+func TestRetryBudgetWindow(t *testing.T) {
+	budget := NewRetryBudget(0, 1, 10*time.Millisecond)
+	if !budget.Retry() {
+		t.Fatal("Expected first retry to be allowed")
+	}
+	if budget.Retry() {
+		t.Fatal("Expected second retry to be denied")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if !budget.Retry() {
+		t.Error("Expected retry to be allowed again after the window passed")
+	}
+}
+
+func TestJitter(t *testing.T) {
+	if d := jitter(0); d != 0 {
+		t.Errorf("Expected no delay without a retry delay, got %v", d)
+	}
+	for i := 0; i < 100; i++ {
+		if d := jitter(time.Second); d < 500*time.Millisecond || d >= 1500*time.Millisecond {
+			t.Fatalf("Expected delay within 0.5s and 1.5s, got %v", d)
+		}
+	}
+}
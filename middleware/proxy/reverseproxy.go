@@ -7,9 +7,11 @@
 package proxy
 
 import (
+	"context"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"strings"
 	"sync"
@@ -39,6 +41,80 @@ type ReverseProxy struct {
 	// response body.
 	// If zero, no periodic flushing is done.
 	FlushInterval time.Duration
+
+	// WebSocketIdleTimeout specifies how long no data may
+	// flow over a proxied WebSocket connection before it
+	// is closed. If zero, DefaultWebSocketIdleTimeout is used.
+	WebSocketIdleTimeout time.Duration
+
+	// CookieDomains and CookiePaths rewrite the Domain
+	// and Path attributes of cookies set by the backend.
+	CookieDomains []CookieRewrite
+	CookiePaths   []CookieRewrite
+
+	// AllowContentTypes and DenyContentTypes are the media
+	// types, like text/html or image/*, of backend responses
+	// which are passed on to the client, and which are not.
+	// Responses of other types are not if any are allowed.
+	AllowContentTypes []string
+	DenyContentTypes  []string
+
+	// AllowRequestHeaders and DenyRequestHeaders are the
+	// canonical names of client request headers which are
+	// sent to the backend, and which are not. Others are
+	// not sent if any are allowed. Headers the proxy adds,
+	// like X-Forwarded-For, are sent regardless.
+	AllowRequestHeaders []string
+	DenyRequestHeaders  []string
+
+	// ProxyProtocol is the version of the PROXY protocol
+	// (1 or 2) used to tell the backend the address of
+	// the client, or 0 for none. Transport must start
+	// its connections with the header; see proxyProtocolDialer.
+	ProxyProtocol int
+
+	// Cache keeps responses to GET requests to serve again,
+	// also to HEAD requests, while they are fresh, if not nil.
+	Cache *Cache
+
+	// CacheStatusHeader is the response header which tells
+	// whether the response was served from Cache: HIT if it
+	// was, MISS if it was not but could have been, and BYPASS
+	// if the request could not be answered from the cache.
+	// If empty, no such header is set.
+	CacheStatusHeader string
+
+	// CachePool names the pool of hosts, like canary, the proxy
+	// sends requests to a host of, so that Cache, which the pools
+	// of an upstream share, keeps their responses apart.
+	CachePool string
+
+	// Trailers are sent after the body of responses whose length
+	// is not known up front, which are streamed. Values may have
+	// the placeholders {body_size} and {body_sha256}, for clients
+	// to check they got all of the body.
+	Trailers http.Header
+
+	// HeadAsGet makes HEAD requests GET requests to the
+	// backend, for backends which mishandle HEAD. The body
+	// of the response is not passed on to the client.
+	HeadAsGet bool
+
+	// DropInformational keeps informational (1xx) responses of
+	// the backend, like 103 Early Hints, from the client, which
+	// only gets the final response then.
+	DropInformational bool
+
+	// ResponseTime, if not nil, is called with how long the
+	// backend took to respond with the headers of a response.
+	ResponseTime func(time.Duration)
+
+	// Via is the name the proxy identifies itself with in
+	// the Via header of requests to the backend if ViaRequest
+	// is set, and of responses to the client if ViaResponse is.
+	Via         string
+	ViaRequest  bool
+	ViaResponse bool
 }
 
 func singleJoiningSlash(a, b string) string {
@@ -80,19 +156,37 @@ func copyHeader(dst, src http.Header) {
 	}
 }
 
-// Hop-by-hop headers. These are removed when sent to the backend.
-// http://www.w3.org/Protocols/rfc2616/rfc2616-sec13.html
+// Hop-by-hop headers. These are removed when sent to the backend,
+// and from the response of the backend, along with the headers
+// listed in the Connection header.
+// https://tools.ietf.org/html/rfc7230#section-6.1
 var hopHeaders = []string{
 	"Connection",
+	"Proxy-Connection", // non-standard, but sent by some clients
 	"Keep-Alive",
 	"Proxy-Authenticate",
 	"Proxy-Authorization",
 	"Te", // canonicalized version of "TE"
-	"Trailers",
+	"Trailer",
 	"Transfer-Encoding",
 	"Upgrade",
 }
 
+// removeHopHeaders removes the hop-by-hop headers from h,
+// including the headers listed in its Connection header.
+func removeHopHeaders(h http.Header) {
+	for _, value := range h["Connection"] {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
 func (p *ReverseProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request, extraHeaders http.Header) error {
 	transport := p.Transport
 	if transport == nil {
@@ -103,26 +197,41 @@ func (p *ReverseProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request, extr
 	*outreq = *req // includes shallow copies of maps, but okay
 
 	p.Director(outreq)
+	head := req.Method == "HEAD"
+	if head && p.HeadAsGet {
+		outreq.Method = "GET"
+	}
 	outreq.Proto = "HTTP/1.1"
 	outreq.ProtoMajor = 1
 	outreq.ProtoMinor = 1
 	outreq.Close = false
 
+	// The headers to the backend are changed below, e.g. with
+	// X-Forwarded-For, so they are a copy: req may be tried again
+	// with another backend, which must not get those of this one.
+	outreq.Header = make(http.Header)
+	copyHeader(outreq.Header, req.Header)
+
 	// Remove hop-by-hop headers to the backend.  Especially
 	// important is "Connection" because we want a persistent
-	// connection, regardless of what the client sent to us.  This
-	// is modifying the same underlying map from req (shallow
-	// copied above) so we only copy it if necessary.
-	copiedHeaders := false
-	for _, h := range hopHeaders {
-		if outreq.Header.Get(h) != "" {
-			if !copiedHeaders {
-				outreq.Header = make(http.Header)
-				copyHeader(outreq.Header, req.Header)
-				copiedHeaders = true
-			}
-			outreq.Header.Del(h)
-		}
+	// connection, regardless of what the client sent to us.
+	removeHopHeaders(outreq.Header)
+
+	// Leave out the client headers the backend is not to see.
+	if len(p.AllowRequestHeaders) > 0 || len(p.DenyRequestHeaders) > 0 {
+		p.filterRequestHeaders(outreq.Header)
+	}
+
+	// The transport needs the client address for the PROXY protocol header.
+	if p.ProxyProtocol != 0 {
+		outreq = outreq.WithContext(context.WithValue(outreq.Context(), remoteAddrKey{}, req.RemoteAddr))
+	}
+
+	// The backend needs to be asked to upgrade the connection too.
+	websocket := isWebSocket(req)
+	if websocket {
+		outreq.Header.Set("Connection", "Upgrade")
+		outreq.Header.Set("Upgrade", req.Header.Get("Upgrade"))
 	}
 
 	if clientIP, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
@@ -135,29 +244,119 @@ func (p *ReverseProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request, extr
 		outreq.Header.Set("X-Forwarded-For", clientIP)
 	}
 
+	if p.ViaRequest {
+		addVia(outreq.Header, viaValue(req.ProtoMajor, req.ProtoMinor, p.Via))
+	}
+
 	if extraHeaders != nil {
 		for k, v := range extraHeaders {
 			outreq.Header[k] = v
 		}
 	}
 
+	if websocket {
+		return p.serveWebSocket(rw, outreq)
+	}
+
+	// A fresh response from the cache is served without asking the
+	// backend at all; a stale one is revalidated unless the client
+	// made the request conditional on a version of its own.
+	var key string
+	var cached *cacheEntry
+	cacheable := p.Cache != nil && cacheableRequest(req)
+	if cacheable {
+		key = cacheKey(p.CachePool, outreq)
+		now := time.Now()
+		if cached = p.Cache.get(key, req); cached != nil {
+			if cached.fresh(now) {
+				p.setCacheStatus(rw, "HIT")
+				cached.serve(rw, now, head)
+				return nil
+			}
+			if conditionalRequest(req) {
+				cached = nil
+			} else {
+				cached.condition(outreq)
+			}
+		}
+	}
+
+	if !p.DropInformational {
+		outreq = outreq.WithContext(httptrace.WithClientTrace(outreq.Context(), informationalTrace(rw)))
+	}
+
+	start := time.Now()
 	res, err := transport.RoundTrip(outreq)
 	if err != nil {
-		return err
+		return newBackendError(err)
 	}
 	defer res.Body.Close()
+	if p.ResponseTime != nil {
+		p.ResponseTime(time.Since(start))
+	}
+
+	if cached != nil && res.StatusCode == http.StatusNotModified {
+		p.setCacheStatus(rw, "HIT")
+		p.Cache.revalidated(cached, res.Header).serve(rw, time.Now(), head)
+		return nil
+	}
 
-	for _, h := range hopHeaders {
-		res.Header.Del(h)
+	if contentType := res.Header.Get("Content-Type"); !p.allowedContentType(contentType) {
+		return contentTypeError{contentType}
 	}
 
+	removeHopHeaders(res.Header)
+
+	p.rewriteCookies(res.Header)
+	if p.ViaResponse {
+		addVia(res.Header, viaValue(res.ProtoMajor, res.ProtoMinor, p.Via))
+	}
 	copyHeader(rw.Header(), res.Header)
+	if cacheable {
+		p.setCacheStatus(rw, "MISS")
+	} else if p.Cache != nil {
+		p.setCacheStatus(rw, "BYPASS")
+	}
+
+	var trailers *trailerBody
+	if !head && p.streamedTrailers(res) {
+		p.announceTrailers(rw.Header())
+		trailers = newTrailerBody(res.Body)
+	}
 
 	rw.WriteHeader(res.StatusCode)
-	p.copyResponse(rw, res.Body)
+	if head {
+		// only a response to GET is worth storing, and
+		// the body of one is not for the client anyway
+		return nil
+	}
+	var src io.Reader = res.Body
+	if trailers != nil {
+		src = trailers
+	}
+	if cacheable {
+		body := &cacheBuffer{r: src, max: p.Cache.MaxSize}
+		p.copyResponse(rw, body)
+		if b := body.body(); b != nil {
+			p.Cache.put(key, req, res.StatusCode, res.Header, b)
+		}
+	} else {
+		p.copyResponse(rw, src)
+	}
+	if trailers != nil {
+		p.setTrailers(rw.Header(), trailers)
+	}
 	return nil
 }
 
+// setCacheStatus sets the CacheStatusHeader of
+// the response to rw to status, if there is one.
+func (p *ReverseProxy) setCacheStatus(rw http.ResponseWriter, status string) {
+	if p.CacheStatusHeader != "" {
+		rw.Header().Set(p.CacheStatusHeader, status)
+	}
+}
+
 func (p *ReverseProxy) copyResponse(dst io.Writer, src io.Reader) {
 	if p.FlushInterval != 0 {
 		if wf, ok := dst.(writeFlusher); ok {
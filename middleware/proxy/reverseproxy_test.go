@@ -0,0 +1,463 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newRawBackend starts a backend which answers every request
+// on a connection with response, then closes the connection.
+func newRawBackend(t *testing.T, response string) *url.URL {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+					return
+				}
+				io.WriteString(conn, response)
+			}(conn)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return &url.URL{Scheme: "http", Host: ln.Addr().String()}
+}
+
+func TestHTTP10AndConnectionCloseBackends(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+	}{
+		{"HTTP/1.0 without Content-Length", "HTTP/1.0 200 OK\r\nContent-Type: text/plain\r\n\r\nHello, legacy"},
+		{"HTTP/1.0 with Content-Length", "HTTP/1.0 200 OK\r\nContent-Length: 13\r\n\r\nHello, legacy"},
+		{"HTTP/1.1 closing connection", "HTTP/1.1 200 OK\r\nConnection: close\r\n\r\nHello, legacy"},
+	}
+
+	for _, test := range tests {
+		backend := newRawBackend(t, test.response)
+		p := NewSingleHostReverseProxy(backend)
+
+		// more than once, since the backend connection is closed each time
+		for i := 0; i < 2; i++ {
+			r, err := http.NewRequest("GET", "/", nil)
+			if err != nil {
+				t.Fatalf("%s: Could not create request: %v", test.name, err)
+			}
+			w := httptest.NewRecorder()
+			if err := p.ServeHTTP(w, r, nil); err != nil {
+				t.Fatalf("%s: Expected no error, got %v", test.name, err)
+			}
+			if w.Code != http.StatusOK {
+				t.Errorf("%s: Expected status 200, got %d", test.name, w.Code)
+			}
+			if body := w.Body.String(); body != "Hello, legacy" {
+				t.Errorf("%s: Expected body 'Hello, legacy', got '%s'", test.name, body)
+			}
+			if c := w.Header().Get("Connection"); c != "" {
+				t.Errorf("%s: Expected Connection header not to be passed on, got '%s'", test.name, c)
+			}
+		}
+	}
+}
+
+func TestWebSocketIdleTimeout(t *testing.T) {
+	// echoes everything after upgrading
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		brw.Flush()
+		io.Copy(conn, brw)
+	}))
+	defer backend.Close()
+
+	backendUrl, _ := url.Parse(backend.URL)
+	p := NewSingleHostReverseProxy(backendUrl)
+	p.WebSocketIdleTimeout = 100 * time.Millisecond
+	front := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.ServeHTTP(w, r, nil)
+	}))
+	defer front.Close()
+
+	conn, err := net.Dial("tcp", front.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("Could not read response: %v", err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected status 101, got %d", res.StatusCode)
+	}
+
+	io.WriteString(conn, "hello")
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(br, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("Expected 'hello' to be echoed, got '%s' and %v", buf, err)
+	}
+
+	start := time.Now()
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Fatalf("Expected the idle connection to be closed, got %v", err)
+	}
+	if idle := time.Since(start); idle < 50*time.Millisecond {
+		t.Errorf("Expected the connection to be closed after being idle, closed after %v", idle)
+	}
+}
+
+func TestWebSocketRefused(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Connection", "X-Internal")
+		w.Header().Set("X-Internal", "secret")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("Origin not allowed"))
+	}))
+	defer backend.Close()
+
+	backendUrl, _ := url.Parse(backend.URL)
+	p := NewSingleHostReverseProxy(backendUrl)
+	p.Via, p.ViaResponse = "caddy", true
+	front := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := p.ServeHTTP(w, r, nil); err != nil {
+			t.Errorf("Expected no error, got %v", err)
+		}
+	}))
+	defer front.Close()
+
+	conn, err := net.Dial("tcp", front.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+
+	// the response of the backend, as the proxy parsed and wrote it
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("Could not read response: %v", err)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected status %d, got %d", http.StatusForbidden, res.StatusCode)
+	}
+	if err != nil || string(body) != "Origin not allowed" {
+		t.Errorf("Expected body 'Origin not allowed', got '%s' (%v)", body, err)
+	}
+	if ct := res.Header.Get("Content-Type"); ct != "text/plain" {
+		t.Errorf("Expected Content-Type 'text/plain', got '%s'", ct)
+	}
+	if via := res.Header.Get("Via"); via != "1.1 caddy" {
+		t.Errorf("Expected Via '1.1 caddy', got '%s'", via)
+	}
+	if internal := res.Header.Get("X-Internal"); internal != "" {
+		t.Errorf("Expected hop-by-hop header X-Internal to be removed, got '%s'", internal)
+	}
+
+	// the connection is still one of HTTP
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	if res, err = http.ReadResponse(br, nil); err != nil || res.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected another response over the connection, got %v", err)
+	}
+}
+
+func TestCustomMethods(t *testing.T) {
+	var method, body string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method = r.Method
+		b, _ := ioutil.ReadAll(r.Body)
+		body = string(b)
+		w.WriteHeader(207)
+	}))
+	defer backend.Close()
+
+	backendUrl, _ := url.Parse(backend.URL)
+	p := NewSingleHostReverseProxy(backendUrl)
+
+	propfind := `<?xml version="1.0"?><propfind xmlns="DAV:"><allprop/></propfind>`
+	for _, m := range []string{"PROPFIND", "PROPPATCH", "REPORT", "MKCOL", "LOCK", "UNLOCK", "MKCALENDAR", "PURGE"} {
+		r, err := http.NewRequest(m, "/calendars/", strings.NewReader(propfind))
+		if err != nil {
+			t.Fatalf("%s: Could not create request: %v", m, err)
+		}
+		w := httptest.NewRecorder()
+		if err := p.ServeHTTP(w, r, nil); err != nil {
+			t.Fatalf("%s: Expected no error, got %v", m, err)
+		}
+		if method != m {
+			t.Errorf("%s: Expected method to be forwarded unchanged, got %s", m, method)
+		}
+		if body != propfind {
+			t.Errorf("%s: Expected body to be forwarded, got '%s'", m, body)
+		}
+		if w.Code != 207 {
+			t.Errorf("%s: Expected status 207 to be passed on, got %d", m, w.Code)
+		}
+	}
+}
+
+func TestHeadAsGet(t *testing.T) {
+	var method string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method = r.Method
+		if r.Method == "HEAD" {
+			// mishandles HEAD
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Length", "5")
+		io.WriteString(w, "hello")
+	}))
+	defer backend.Close()
+
+	backendUrl, _ := url.Parse(backend.URL)
+	for _, headAsGet := range []bool{false, true} {
+		p := NewSingleHostReverseProxy(backendUrl)
+		p.HeadAsGet = headAsGet
+
+		r, err := http.NewRequest("HEAD", "/", nil)
+		if err != nil {
+			t.Fatalf("Could not create request: %v", err)
+		}
+		w := httptest.NewRecorder()
+		if err := p.ServeHTTP(w, r, nil); err != nil {
+			t.Fatalf("With HeadAsGet %v: Expected no error, got %v", headAsGet, err)
+		}
+		expectedMethod, expectedCode := "HEAD", http.StatusMethodNotAllowed
+		if headAsGet {
+			expectedMethod, expectedCode = "GET", http.StatusOK
+		}
+		if method != expectedMethod {
+			t.Errorf("With HeadAsGet %v: Expected %s request to the backend, got %s", headAsGet, expectedMethod, method)
+		}
+		if w.Code != expectedCode {
+			t.Errorf("With HeadAsGet %v: Expected status %d, got %d", headAsGet, expectedCode, w.Code)
+		}
+		if w.Body.Len() != 0 {
+			t.Errorf("With HeadAsGet %v: Expected no body, got '%s'", headAsGet, w.Body.String())
+		}
+		if headAsGet && w.Header().Get("Content-Length") != "5" {
+			t.Errorf("Expected Content-Length of the GET response, got '%s'", w.Header().Get("Content-Length"))
+		}
+	}
+}
+
+func TestHopByHopHeaders(t *testing.T) {
+	var received http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header
+		w.Header().Set("Connection", "X-Backend-Hop")
+		w.Header().Set("X-Backend-Hop", "1")
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.Header().Set("Proxy-Authenticate", "Basic")
+		w.Header().Set("Upgrade", "h2c")
+		w.Header().Set("X-End-To-End", "1")
+	}))
+	defer backend.Close()
+
+	backendUrl, _ := url.Parse(backend.URL)
+	p := NewSingleHostReverseProxy(backendUrl)
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatalf("Could not create request: %v", err)
+	}
+	r.Header.Set("Connection", "keep-alive, X-Client-Hop")
+	r.Header.Set("X-Client-Hop", "1")
+	r.Header.Set("Keep-Alive", "timeout=5")
+	r.Header.Set("Proxy-Connection", "keep-alive")
+	r.Header.Set("Proxy-Authorization", "Basic Zm9vOmJhcg==")
+	r.Header.Set("TE", "gzip")
+	r.Header.Set("Trailer", "X-Checksum")
+	r.Header.Set("Upgrade", "h2c")
+	r.Header.Set("X-End-To-End", "1")
+	w := httptest.NewRecorder()
+	if err := p.ServeHTTP(w, r, nil); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	for _, name := range []string{"Connection", "X-Client-Hop", "Keep-Alive", "Proxy-Connection",
+		"Proxy-Authorization", "Te", "Trailer", "Upgrade"} {
+		if value, ok := received[name]; ok {
+			t.Errorf("Expected %s not to be sent to the backend, got %v", name, value)
+		}
+	}
+	if received.Get("X-End-To-End") != "1" {
+		t.Error("Expected end-to-end request header to be sent to the backend")
+	}
+	if r.Header.Get("X-Client-Hop") != "1" {
+		t.Error("Expected the headers of the client request to be left alone")
+	}
+
+	for _, name := range []string{"Connection", "X-Backend-Hop", "Keep-Alive", "Proxy-Authenticate", "Upgrade"} {
+		if value, ok := w.Header()[name]; ok {
+			t.Errorf("Expected %s not to be passed on to the client, got %v", name, value)
+		}
+	}
+	if w.Header().Get("X-End-To-End") != "1" {
+		t.Error("Expected end-to-end response header to be passed on to the client")
+	}
+}
+
+func TestRequestHeaders(t *testing.T) {
+	var received http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header
+	}))
+	defer backend.Close()
+
+	backendUrl, _ := url.Parse(backend.URL)
+	tests := []struct {
+		allow    []string
+		deny     []string
+		sent     []string
+		withheld []string
+	}{
+		{nil, nil, []string{"Cookie", "Authorization", "Accept"}, nil},
+		{nil, []string{"Cookie"}, []string{"Authorization", "Accept"}, []string{"Cookie"}},
+		{[]string{"Accept", "Cookie"}, nil, []string{"Accept", "Cookie"}, []string{"Authorization"}},
+		{[]string{"Accept", "Cookie"}, []string{"Cookie"}, []string{"Accept"}, []string{"Authorization", "Cookie"}},
+	}
+
+	for i, test := range tests {
+		p := NewSingleHostReverseProxy(backendUrl)
+		p.AllowRequestHeaders = test.allow
+		p.DenyRequestHeaders = test.deny
+
+		r, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatalf("Test %d: Could not create request: %v", i, err)
+		}
+		r.RemoteAddr = "192.0.2.1:1234"
+		r.Header.Set("Cookie", "session=secret")
+		r.Header.Set("Authorization", "Basic Zm9vOmJhcg==")
+		r.Header.Set("Accept", "text/html")
+		extra := http.Header{"X-Extra": {"1"}}
+		if err := p.ServeHTTP(httptest.NewRecorder(), r, extra); err != nil {
+			t.Fatalf("Test %d: Expected no error, got %v", i, err)
+		}
+
+		for _, name := range test.sent {
+			if received.Get(name) == "" {
+				t.Errorf("Test %d: Expected %s to be sent to the backend", i, name)
+			}
+		}
+		for _, name := range test.withheld {
+			if value, ok := received[name]; ok {
+				t.Errorf("Test %d: Expected %s not to be sent to the backend, got %v", i, name, value)
+			}
+		}
+		// headers of the proxy are sent regardless
+		if received.Get("X-Extra") != "1" || received.Get("X-Forwarded-For") != "192.0.2.1" {
+			t.Errorf("Test %d: Expected the headers of the proxy to be sent, got %v", i, received)
+		}
+		if r.Header.Get("Cookie") == "" {
+			t.Errorf("Test %d: Expected the headers of the client request to be left alone", i)
+		}
+	}
+}
+
+func TestBackendErrors(t *testing.T) {
+	closed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	closed.Close()
+	untrusted := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer untrusted.Close()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+	}))
+	defer slow.Close()
+	hangup := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	defer hangup.Close()
+
+	tests := []struct {
+		backend   string
+		kind      FailureKind
+		retryable bool
+	}{
+		{closed.URL, FailureDial, true},
+		{untrusted.URL, FailureTLS, false},
+		{slow.URL, FailureTimeout, true},
+		{hangup.URL, FailureRead, true},
+	}
+
+	for i, test := range tests {
+		backendUrl, _ := url.Parse(test.backend)
+		p := NewSingleHostReverseProxy(backendUrl)
+		p.Transport = &http.Transport{ResponseHeaderTimeout: 100 * time.Millisecond}
+
+		r, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatalf("Test %d: Could not create request: %v", i, err)
+		}
+		err = p.ServeHTTP(httptest.NewRecorder(), r, nil)
+		backendErr, ok := err.(*BackendError)
+		if !ok {
+			t.Errorf("Test %d: Expected a *BackendError, got %T: %v", i, err, err)
+			continue
+		}
+		if backendErr.Kind != test.kind {
+			t.Errorf("Test %d: Expected failure %v, got %v: %v", i, test.kind, backendErr.Kind, backendErr.Err)
+		}
+		if backendErr.Retryable() != test.retryable {
+			t.Errorf("Test %d: Expected retryable %v, got %v", i, test.retryable, backendErr.Retryable())
+		}
+	}
+}
+
+func TestClassifyFailure(t *testing.T) {
+	tests := []struct {
+		err  error
+		kind FailureKind
+	}{
+		{&url.Error{Op: "Get", URL: "https://backend", Err: x509.UnknownAuthorityError{}}, FailureTLS},
+		{&url.Error{Op: "Get", URL: "https://backend", Err: x509.HostnameError{Certificate: &x509.Certificate{}, Host: "backend"}}, FailureTLS},
+		{fmt.Errorf("handshake: %w", tls.AlertError(40)), FailureTLS},
+		{tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}, FailureTLS},
+		// only the types of errors tell, not what they say
+		{errors.New("backend said: tls: not today"), FailureOther},
+		{&net.OpError{Op: "dial", Err: errors.New("tls: in the name")}, FailureDial},
+		{io.ErrUnexpectedEOF, FailureRead},
+	}
+	for i, test := range tests {
+		if kind := classifyFailure(test.err); kind != test.kind {
+			t.Errorf("Test %d: Expected failure %v for %v, got %v", i, test.kind, test.err, kind)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+var errShed = errors.New("Too many requests in flight")
+
+// LoadShedder limits the requests in flight to an upstream. Those
+// over the limit are rejected right away, rather than queued for a
+// host, so that under overload the requests which are let through
+// are still served in time and the backends are not swamped.
+type LoadShedder struct {
+	// Requests which may be in flight at once
+	Max int64
+
+	inFlight int64 // access atomically
+}
+
+// admit returns whether another request may be proxied, and
+// counts it in flight if so. Each request admitted must be
+// followed by a call to done.
+func (s *LoadShedder) admit() bool {
+	if atomic.AddInt64(&s.inFlight, 1) > s.Max {
+		atomic.AddInt64(&s.inFlight, -1)
+		return false
+	}
+	return true
+}
+
+// done records that an admitted request is no longer in flight.
+func (s *LoadShedder) done() {
+	atomic.AddInt64(&s.inFlight, -1)
+}
+
+// InFlight returns the number of requests in flight.
+func (s *LoadShedder) InFlight() int64 {
+	return atomic.LoadInt64(&s.inFlight)
+}
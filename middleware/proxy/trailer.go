@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// trailerBody reads the body of a response being passed on to
+// the client, keeping count and a hash of it for the trailers.
+type trailerBody struct {
+	r    io.Reader
+	size int64
+	sum  hash.Hash
+}
+
+func newTrailerBody(r io.Reader) *trailerBody {
+	return &trailerBody{r: r, sum: sha256.New()}
+}
+
+func (b *trailerBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	b.size += int64(n)
+	b.sum.Write(p[:n])
+	return n, err
+}
+
+// streamedTrailers returns whether the Trailers are sent with
+// res, which they are if its length is not known up front, so
+// that it is sent chunked, or over HTTP/2, either of which may
+// end with trailers.
+func (p *ReverseProxy) streamedTrailers(res *http.Response) bool {
+	return len(p.Trailers) > 0 && res.ContentLength < 0
+}
+
+// announceTrailers declares the Trailers in the Trailer header
+// of a response, which must be done before it is written.
+func (p *ReverseProxy) announceTrailers(header http.Header) {
+	for name := range p.Trailers {
+		header.Add("Trailer", name)
+	}
+}
+
+// setTrailers sets the Trailers after body was passed on,
+// replacing the placeholders {body_size}, the size of the
+// body in bytes, and {body_sha256}, its hex SHA-256 hash.
+func (p *ReverseProxy) setTrailers(header http.Header, body *trailerBody) {
+	replacer := strings.NewReplacer(
+		"{body_size}", strconv.FormatInt(body.size, 10),
+		"{body_sha256}", hex.EncodeToString(body.sum.Sum(nil)),
+	)
+	for name, values := range p.Trailers {
+		for _, value := range values {
+			header.Add(name, replacer.Replace(value))
+		}
+	}
+}
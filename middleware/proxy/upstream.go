@@ -1,30 +1,105 @@
 package proxy
 
 import (
+	"crypto/tls"
 	"github.com/mholt/caddy/middleware"
 	"io"
 	"io/ioutil"
+	"log"
+	"math/rand"
+	"mime"
+	"net"
 	"net/http"
 	"net/url"
+	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
+// HeaderRoute sends the requests which have Header set to Value
+// to a pool of Hosts of their own, rather than the hosts of the
+// upstream. The hosts of a route share the policy and the other
+// settings of the upstream.
+type HeaderRoute struct {
+	Header string
+	Value  string
+	Hosts  HostPool
+}
+
 type staticUpstream struct {
 	from   string
 	Hosts  HostPool
 	Policy Policy
 
-	FailTimeout time.Duration
-	MaxFails    int32
-	HealthCheck struct {
+	FailTimeout          time.Duration
+	MaxFails             int32
+	ResetFails           bool
+	KeepFails            bool
+	ForwardedHost        bool
+	ForwardedPort        bool
+	Forwarded            bool
+	SlowStart            time.Duration
+	MaxLatency           time.Duration
+	CaseInsensitive      bool
+	FailFast             bool
+	OutageCooldown       time.Duration
+	MaxConns             int64
+	LoadShedder          *LoadShedder
+	RetryBudget          *RetryBudget
+	RetryDelay           time.Duration
+	TryLimit             int
+	TryDuration          time.Duration
+	WebSocketIdleTimeout time.Duration
+	ProxyProtocol        int
+	CookieDomains        []CookieRewrite
+	CookiePaths          []CookieRewrite
+	AllowContentTypes    []string
+	DenyContentTypes     []string
+	AllowRequestHeaders  []string
+	Trailers             http.Header
+	DenyRequestHeaders   []string
+	Via                  string
+	ViaRequest           bool
+	ViaResponse          bool
+	Cache                *Cache
+	CacheStatusHeader    string
+	HeadAsGet            bool
+	DropInformational    bool
+	Methods              []string
+	TLSConfig            *tls.Config
+	InsecureHosts        []string
+	Routes               []HeaderRoute
+	Canary               *Canary
+	LocalAddr            net.Addr
+	ResolveInterval      time.Duration
+	Fallback             *Fallback
+	Maintenance          *Maintenance
+	Log                  *UpstreamLog
+	outageUntil          int64 // end of the outage cooldown in Unix nanoseconds; access atomically
+	HealthCheck          struct {
 		Path     string
+		TCP      bool // only connect to the hosts, instead of requesting Path
 		Interval time.Duration
+		Timeout  time.Duration
+		Body     *regexp.Regexp
 	}
 }
 
-func newStaticUpstreams(c middleware.Controller) ([]Upstream, error) {
+// maxHealthCheckBody is how much of a health check
+// response body is matched against HealthCheck.Body.
+const maxHealthCheckBody = 64 * 1024
+
+// DefaultTCPHealthCheckTimeout is how long a TCP health check
+// waits for a connection to a host if no timeout is configured.
+const DefaultTCPHealthCheckTimeout = 5 * time.Second
+
+// newStaticUpstreams parses the upstreams configured in c. With
+// dryRun, they are only validated: no health checks are started
+// and no startup functions are registered.
+func newStaticUpstreams(c middleware.Controller, dryRun bool) ([]Upstream, error) {
 	var upstreams []Upstream
 
 	for c.Next() {
@@ -36,13 +111,24 @@ func newStaticUpstreams(c middleware.Controller) ([]Upstream, error) {
 			MaxFails:    1,
 		}
 		var proxyHeaders http.Header
+		var hostHeader string
+		var pathRewrites []PathRewrite
+		var hashKey KeyFunc
 		if !c.Args(&upstream.from) {
 			return upstreams, c.ArgErr()
 		}
-		to := c.RemainingArgs()
+		to, err := expandHosts(c.RemainingArgs())
+		if err != nil {
+			return upstreams, c.Err(err.Error())
+		}
 		if len(to) == 0 {
 			return upstreams, c.ArgErr()
 		}
+		allHosts := to
+		var routeHosts [][]string
+		var canaryHosts []string
+		var canaryKey KeyFunc
+		var canaryFile string
 
 		for c.NextBlock() {
 			switch c.Val() {
@@ -57,6 +143,36 @@ func newStaticUpstreams(c middleware.Controller) ([]Upstream, error) {
 					upstream.Policy = &RoundRobin{}
 				case "least_conn":
 					upstream.Policy = &LeastConn{}
+				case "ip_hash", "consistent_hash":
+					name := c.Val()
+					hash := DefaultHash
+					if c.NextArg() {
+						var ok bool
+						if hash, ok = Hashes[c.Val()]; !ok {
+							return upstreams, c.Err("Unknown hash " + c.Val())
+						}
+					}
+					if name == "ip_hash" {
+						upstream.Policy = &IPHash{Hash: hash}
+					} else {
+						upstream.Policy = &ConsistentHash{Hash: hash}
+					}
+				default:
+					return upstreams, c.ArgErr()
+				}
+			case "hash_key":
+				// hash_key header name
+				// hash_key jwt claim [header]
+				args := c.RemainingArgs()
+				switch {
+				case len(args) == 2 && args[0] == "header":
+					hashKey = HeaderKey(args[1])
+				case (len(args) == 2 || len(args) == 3) && args[0] == "jwt":
+					header := "Authorization"
+					if len(args) == 3 {
+						header = args[2]
+					}
+					hashKey = JWTClaimKey(header, args[1])
 				default:
 					return upstreams, c.ArgErr()
 				}
@@ -66,6 +182,8 @@ func newStaticUpstreams(c middleware.Controller) ([]Upstream, error) {
 				}
 				if dur, err := time.ParseDuration(c.Val()); err == nil {
 					upstream.FailTimeout = dur
+					// fail_timeout 0 means failed hosts stay down
+					upstream.KeepFails = dur == 0
 				} else {
 					return upstreams, err
 				}
@@ -78,6 +196,384 @@ func newStaticUpstreams(c middleware.Controller) ([]Upstream, error) {
 				} else {
 					return upstreams, err
 				}
+			case "reset_fails_on_success":
+				upstream.ResetFails = true
+			case "max_conns":
+				if !c.NextArg() {
+					return upstreams, c.ArgErr()
+				}
+				if n, err := strconv.ParseInt(c.Val(), 10, 64); err == nil {
+					upstream.MaxConns = n
+				} else {
+					return upstreams, err
+				}
+			case "max_in_flight":
+				if !c.NextArg() {
+					return upstreams, c.ArgErr()
+				}
+				n, err := strconv.ParseInt(c.Val(), 10, 64)
+				if err != nil || n <= 0 {
+					return upstreams, c.Err("Invalid max_in_flight " + c.Val())
+				}
+				upstream.LoadShedder = &LoadShedder{Max: n}
+			case "slow_start":
+				if !c.NextArg() {
+					return upstreams, c.ArgErr()
+				}
+				if dur, err := time.ParseDuration(c.Val()); err == nil {
+					upstream.SlowStart = dur
+				} else {
+					return upstreams, err
+				}
+			case "case_insensitive":
+				upstream.CaseInsensitive = true
+			case "fail_fast":
+				upstream.FailFast = true
+			case "outage_cooldown":
+				upstream.OutageCooldown = DefaultOutageCooldown
+				if c.NextArg() {
+					dur, err := time.ParseDuration(c.Val())
+					if err != nil || dur <= 0 {
+						return upstreams, c.Err("Invalid outage cooldown " + c.Val())
+					}
+					upstream.OutageCooldown = dur
+				}
+			case "resolve_interval":
+				if !c.NextArg() {
+					return upstreams, c.ArgErr()
+				}
+				dur, err := time.ParseDuration(c.Val())
+				if err != nil || dur <= 0 {
+					return upstreams, c.Err("Invalid resolve_interval " + c.Val())
+				}
+				upstream.ResolveInterval = dur
+			case "max_latency":
+				if !c.NextArg() {
+					return upstreams, c.ArgErr()
+				}
+				dur, err := time.ParseDuration(c.Val())
+				if err != nil || dur <= 0 {
+					return upstreams, c.Err("Invalid max_latency " + c.Val())
+				}
+				upstream.MaxLatency = dur
+			case "retry_budget":
+				args := c.RemainingArgs()
+				if len(args) == 0 || len(args) > 3 {
+					return upstreams, c.ArgErr()
+				}
+				percent, err := strconv.ParseFloat(strings.TrimSuffix(args[0], "%"), 64)
+				if err != nil || percent < 0 {
+					return upstreams, c.Err("Invalid retry budget percentage " + args[0])
+				}
+				window, minRetries := 10*time.Second, 10
+				if len(args) > 1 {
+					if window, err = time.ParseDuration(args[1]); err != nil {
+						return upstreams, err
+					}
+				}
+				if len(args) > 2 {
+					if minRetries, err = strconv.Atoi(args[2]); err != nil {
+						return upstreams, err
+					}
+				}
+				upstream.RetryBudget = NewRetryBudget(percent/100, minRetries, window)
+			case "retry_delay":
+				if !c.NextArg() {
+					return upstreams, c.ArgErr()
+				}
+				if dur, err := time.ParseDuration(c.Val()); err == nil {
+					upstream.RetryDelay = dur
+				} else {
+					return upstreams, err
+				}
+			case "websocket_idle_timeout":
+				if !c.NextArg() {
+					return upstreams, c.ArgErr()
+				}
+				if dur, err := time.ParseDuration(c.Val()); err == nil {
+					upstream.WebSocketIdleTimeout = dur
+				} else {
+					return upstreams, err
+				}
+			case "proxy_protocol":
+				if !c.NextArg() {
+					return upstreams, c.ArgErr()
+				}
+				switch c.Val() {
+				case "v1":
+					upstream.ProxyProtocol = 1
+				case "v2":
+					upstream.ProxyProtocol = 2
+				default:
+					return upstreams, c.Err("Unknown PROXY protocol version " + c.Val())
+				}
+			case "try_limit":
+				if !c.NextArg() {
+					return upstreams, c.ArgErr()
+				}
+				n, err := strconv.Atoi(c.Val())
+				if err != nil || n < 1 {
+					return upstreams, c.Err("Invalid try limit " + c.Val())
+				}
+				upstream.TryLimit = n
+			case "try_duration":
+				if !c.NextArg() {
+					return upstreams, c.ArgErr()
+				}
+				dur, err := time.ParseDuration(c.Val())
+				if err != nil || dur <= 0 {
+					return upstreams, c.Err("Invalid try duration " + c.Val())
+				}
+				upstream.TryDuration = dur
+			case "no_retry":
+				upstream.TryLimit = 1
+			case "cookie_domain", "cookie_path":
+				attr := c.Val()
+				var rw CookieRewrite
+				if !c.Args(&rw.From, &rw.To) {
+					return upstreams, c.ArgErr()
+				}
+				if attr == "cookie_domain" {
+					upstream.CookieDomains = append(upstream.CookieDomains, rw)
+				} else {
+					upstream.CookiePaths = append(upstream.CookiePaths, rw)
+				}
+			case "allow_content_type", "deny_content_type":
+				attr := c.Val()
+				types := c.RemainingArgs()
+				if len(types) == 0 {
+					return upstreams, c.ArgErr()
+				}
+				for _, t := range types {
+					if _, _, err := mime.ParseMediaType(t); err != nil {
+						return upstreams, c.Err("Invalid content type " + t)
+					}
+				}
+				if attr == "allow_content_type" {
+					upstream.AllowContentTypes = append(upstream.AllowContentTypes, types...)
+				} else {
+					upstream.DenyContentTypes = append(upstream.DenyContentTypes, types...)
+				}
+			case "allow_request_header", "deny_request_header":
+				attr := c.Val()
+				names := c.RemainingArgs()
+				if len(names) == 0 {
+					return upstreams, c.ArgErr()
+				}
+				for i, name := range names {
+					names[i] = http.CanonicalHeaderKey(name)
+				}
+				if attr == "allow_request_header" {
+					upstream.AllowRequestHeaders = append(upstream.AllowRequestHeaders, names...)
+				} else {
+					upstream.DenyRequestHeaders = append(upstream.DenyRequestHeaders, names...)
+				}
+			case "trailer":
+				// trailer name value
+				var name, value string
+				if !c.Args(&name, &value) {
+					return upstreams, c.ArgErr()
+				}
+				if upstream.Trailers == nil {
+					upstream.Trailers = make(http.Header)
+				}
+				upstream.Trailers.Add(name, value)
+			case "via":
+				// via [name] [request|response]
+				args := c.RemainingArgs()
+				if len(args) > 2 {
+					return upstreams, c.ArgErr()
+				}
+				upstream.Via = DefaultVia
+				if len(args) > 0 {
+					upstream.Via = args[0]
+				}
+				where := "both"
+				if len(args) > 1 {
+					where = args[1]
+				}
+				switch where {
+				case "both":
+					upstream.ViaRequest, upstream.ViaResponse = true, true
+				case "request":
+					upstream.ViaRequest = true
+				case "response":
+					upstream.ViaResponse = true
+				default:
+					return upstreams, c.Err("Invalid via direction " + where)
+				}
+			case "cache":
+				// cache max_size [max_age]
+				args := c.RemainingArgs()
+				if len(args) == 0 || len(args) > 2 {
+					return upstreams, c.ArgErr()
+				}
+				size, err := strconv.ParseInt(args[0], 10, 64)
+				if err != nil || size < 1 {
+					return upstreams, c.Err("Invalid cache size " + args[0])
+				}
+				var maxAge time.Duration
+				if len(args) > 1 {
+					if maxAge, err = time.ParseDuration(args[1]); err != nil {
+						return upstreams, err
+					}
+				}
+				upstream.Cache = NewCache(size, maxAge)
+			case "cache_status":
+				upstream.CacheStatusHeader = DefaultCacheStatusHeader
+				if c.NextArg() {
+					upstream.CacheStatusHeader = c.Val()
+				}
+			case "head_as_get":
+				upstream.HeadAsGet = true
+			case "drop_informational":
+				upstream.DropInformational = true
+			case "log":
+				// log file [format]
+				args := c.RemainingArgs()
+				if len(args) == 0 || len(args) > 2 {
+					return upstreams, c.ArgErr()
+				}
+				upstreamLog := &UpstreamLog{OutputFile: args[0], Format: DefaultLogFormat}
+				if len(args) > 1 {
+					switch args[1] {
+					case "{common}":
+						upstreamLog.Format = CommonLogFormat
+					case "{combined}":
+						upstreamLog.Format = CombinedLogFormat
+					default:
+						upstreamLog.Format = args[1]
+					}
+				}
+				// opened when the server starts, like other logs
+				if !dryRun {
+					c.Startup(upstreamLog.open)
+				}
+				upstream.Log = upstreamLog
+			case "source_address":
+				if !c.NextArg() {
+					return upstreams, c.ArgErr()
+				}
+				ip := net.ParseIP(c.Val())
+				if ip == nil {
+					return upstreams, c.Err("Invalid source address " + c.Val())
+				}
+				upstream.LocalAddr = &net.TCPAddr{IP: ip}
+			case "forwarded_host":
+				upstream.ForwardedHost = true
+			case "forwarded_port":
+				upstream.ForwardedPort = true
+			case "forwarded":
+				upstream.Forwarded = true
+			case "methods":
+				methods := c.RemainingArgs()
+				if len(methods) == 0 {
+					return upstreams, c.ArgErr()
+				}
+				for _, method := range methods {
+					upstream.Methods = append(upstream.Methods, strings.ToUpper(method))
+				}
+			case "tls_client_cert":
+				var certFile, keyFile string
+				if !c.Args(&certFile, &keyFile) {
+					return upstreams, c.ArgErr()
+				}
+				cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+				if err != nil {
+					return upstreams, c.Err("Could not load client certificate " + certFile + ": " + err.Error())
+				}
+				if upstream.TLSConfig == nil {
+					upstream.TLSConfig = &tls.Config{}
+				}
+				upstream.TLSConfig.Certificates = append(upstream.TLSConfig.Certificates, cert)
+			case "header_upstream":
+				// header_upstream name value host [host...]
+				args := c.RemainingArgs()
+				if len(args) < 3 {
+					return upstreams, c.ArgErr()
+				}
+				upstream.Routes = append(upstream.Routes, HeaderRoute{
+					Header: http.CanonicalHeaderKey(args[0]),
+					Value:  args[1],
+				})
+				routeHosts = append(routeHosts, args[2:])
+				allHosts = append(allHosts, args[2:]...)
+			case "canary":
+				// canary percent host [host...]
+				args := c.RemainingArgs()
+				if len(args) < 2 {
+					return upstreams, c.ArgErr()
+				}
+				percent, err := parsePercent(args[0])
+				if err != nil {
+					return upstreams, c.Err(err.Error())
+				}
+				upstream.Canary = &Canary{}
+				upstream.Canary.SetPercent(percent)
+				canaryHosts = args[1:]
+				allHosts = append(allHosts, canaryHosts...)
+			case "canary_key":
+				// canary_key header name
+				// canary_key jwt claim [header]
+				args := c.RemainingArgs()
+				switch {
+				case len(args) == 2 && args[0] == "header":
+					canaryKey = HeaderKey(args[1])
+				case (len(args) == 2 || len(args) == 3) && args[0] == "jwt":
+					header := "Authorization"
+					if len(args) == 3 {
+						header = args[2]
+					}
+					canaryKey = JWTClaimKey(header, args[1])
+				default:
+					return upstreams, c.ArgErr()
+				}
+			case "canary_file":
+				if !c.NextArg() {
+					return upstreams, c.ArgErr()
+				}
+				canaryFile = c.Val()
+			case "insecure_skip_verify":
+				// insecure_skip_verify host [host...]
+				hosts := c.RemainingArgs()
+				if len(hosts) == 0 {
+					return upstreams, c.ArgErr()
+				}
+				upstream.InsecureHosts = append(upstream.InsecureHosts, hosts...)
+			case "fallback":
+				args := c.RemainingArgs()
+				if len(args) == 0 || len(args) > 2 {
+					return upstreams, c.ArgErr()
+				}
+				fallback := &Fallback{Path: args[0], Status: http.StatusServiceUnavailable}
+				if !filepath.IsAbs(fallback.Path) {
+					fallback.Path = filepath.Join(c.Root(), fallback.Path)
+				}
+				if len(args) > 1 {
+					status, err := strconv.Atoi(args[1])
+					if err != nil || status < 100 || status > 999 {
+						return upstreams, c.Err("Invalid fallback status code " + args[1])
+					}
+					fallback.Status = status
+				}
+				upstream.Fallback = fallback
+			case "maintenance":
+				// maintenance file [page]
+				args := c.RemainingArgs()
+				if len(args) == 0 || len(args) > 2 {
+					return upstreams, c.ArgErr()
+				}
+				maintenance := &Maintenance{File: args[0]}
+				if !filepath.IsAbs(maintenance.File) {
+					maintenance.File = filepath.Join(c.Root(), maintenance.File)
+				}
+				if len(args) > 1 {
+					maintenance.Page = &Fallback{Path: args[1], Status: http.StatusServiceUnavailable}
+					if !filepath.IsAbs(maintenance.Page.Path) {
+						maintenance.Page.Path = filepath.Join(c.Root(), maintenance.Page.Path)
+					}
+				}
+				upstream.Maintenance = maintenance
 			case "health_check":
 				if !c.NextArg() {
 					return upstreams, c.ArgErr()
@@ -91,6 +587,40 @@ func newStaticUpstreams(c middleware.Controller) ([]Upstream, error) {
 						return upstreams, err
 					}
 				}
+			case "health_check_tcp":
+				upstream.HealthCheck.TCP = true
+				upstream.HealthCheck.Interval = 30 * time.Second
+				if c.NextArg() {
+					dur, err := time.ParseDuration(c.Val())
+					if err != nil || dur <= 0 {
+						return upstreams, c.Err("Invalid health_check_tcp interval " + c.Val())
+					}
+					upstream.HealthCheck.Interval = dur
+				}
+			case "health_check_timeout":
+				if !c.NextArg() {
+					return upstreams, c.ArgErr()
+				}
+				dur, err := time.ParseDuration(c.Val())
+				if err != nil || dur <= 0 {
+					return upstreams, c.Err("Invalid health_check_timeout " + c.Val())
+				}
+				upstream.HealthCheck.Timeout = dur
+			case "health_check_body":
+				if !c.NextArg() {
+					return upstreams, c.ArgErr()
+				}
+				re, err := regexp.Compile(c.Val())
+				if err != nil {
+					return upstreams, c.Err("Invalid health_check_body pattern: " + err.Error())
+				}
+				upstream.HealthCheck.Body = re
+			case "host_header":
+				// host_header host, e.g. app.internal or {host}
+				if !c.NextArg() {
+					return upstreams, c.ArgErr()
+				}
+				hostHeader = c.Val()
 			case "proxy_header":
 				var header, value string
 				if !c.Args(&header, &value) {
@@ -100,27 +630,89 @@ func newStaticUpstreams(c middleware.Controller) ([]Upstream, error) {
 					proxyHeaders = make(map[string][]string)
 				}
 				proxyHeaders.Add(header, value)
+			case "rewrite_path":
+				var pattern, replacement string
+				if !c.Args(&pattern, &replacement) {
+					return upstreams, c.ArgErr()
+				}
+				re, err := regexp.Compile(pattern)
+				if err != nil {
+					return upstreams, c.Err("Invalid rewrite_path pattern: " + err.Error())
+				}
+				pathRewrites = append(pathRewrites, PathRewrite{
+					Pattern:     re,
+					Replacement: replacement,
+				})
 			}
 		}
 
-		upstream.Hosts = make([]*UpstreamHost, len(to))
-		for i, host := range to {
-			if !strings.HasPrefix(host, "http") {
-				host = "http://" + host
+		if upstream.Canary == nil && (canaryKey != nil || canaryFile != "") {
+			return upstreams, c.Err("canary_key and canary_file require canary")
+		}
+		if upstream.Canary != nil {
+			upstream.Canary.Key = canaryKey
+			upstream.Canary.PercentFile = canaryFile
+		}
+
+		if hashKey != nil {
+			switch policy := upstream.Policy.(type) {
+			case *IPHash:
+				policy.Key = hashKey
+			case *ConsistentHash:
+				policy.Key = hashKey
+			default:
+				return upstreams, c.Err("hash_key requires the ip_hash or consistent_hash policy")
 			}
+		}
+
+		// newUpstreamTransport creates a transport with
+		// tlsConfig and the settings of the upstream
+		newUpstreamTransport := func(tlsConfig *tls.Config) *http.Transport {
+			t := newTransport(tlsConfig, upstream.ProxyProtocol, upstream.LocalAddr)
+			if upstream.ResolveInterval > 0 && t.IdleConnTimeout > upstream.ResolveInterval {
+				// busy connections to old addresses are not kept for long either
+				t.IdleConnTimeout = upstream.ResolveInterval
+			}
+			return t
+		}
+
+		var transport http.RoundTripper
+		if upstream.TLSConfig != nil || upstream.ProxyProtocol != 0 || upstream.LocalAddr != nil || upstream.ResolveInterval > 0 {
+			// the connections of the default transport cannot
+			// be closed without those of everything else
+			transport = newUpstreamTransport(upstream.TLSConfig)
+		}
+
+		for _, insecure := range upstream.InsecureHosts {
+			if insecureHost(allHosts, insecure) == -1 {
+				return upstreams, c.Err("insecure_skip_verify host " + insecure + " is not an upstream host")
+			}
+		}
+
+		// newHost creates the host given as host in pool,
+		// which is "" for Hosts, with the settings of the upstream
+		newHost := func(host, pool string) (*UpstreamHost, error) {
 			uh := &UpstreamHost{
-				Name:         host,
-				Conns:        0,
-				Fails:        0,
-				FailTimeout:  upstream.FailTimeout,
-				Unhealthy:    false,
-				ExtraHeaders: proxyHeaders,
+				Name:                upstreamName(host),
+				Conns:               0,
+				Fails:               0,
+				FailTimeout:         upstream.FailTimeout,
+				ResetFailsOnSuccess: upstream.ResetFails,
+				KeepFails:           upstream.KeepFails,
+				ForwardedHost:       upstream.ForwardedHost,
+				ForwardedPort:       upstream.ForwardedPort,
+				Forwarded:           upstream.Forwarded,
+				MaxLatency:          upstream.MaxLatency,
+				MaxConns:            upstream.MaxConns,
+				HostHeader:          hostHeader,
+				ExtraHeaders:        proxyHeaders,
+				PathRewrites:        pathRewrites,
 				CheckDown: func(upstream *staticUpstream) UpstreamHostDownFunc {
 					return func(uh *UpstreamHost) bool {
-						if uh.Unhealthy {
+						if uh.IsUnhealthy() || uh.Slow() {
 							return true
 						}
-						if uh.Fails >= upstream.MaxFails &&
+						if atomic.LoadInt32(&uh.Fails) >= upstream.MaxFails &&
 							upstream.MaxFails != 0 {
 							return true
 						}
@@ -130,33 +722,272 @@ func newStaticUpstreams(c middleware.Controller) ([]Upstream, error) {
 			}
 			if baseUrl, err := url.Parse(uh.Name); err == nil {
 				uh.ReverseProxy = NewSingleHostReverseProxy(baseUrl)
+				uh.ReverseProxy.Transport = transport
+				if upstream.insecure(host) {
+					// a transport of its own, so that no other
+					// host is ever connected to without verifying
+					tlsConfig := &tls.Config{}
+					if upstream.TLSConfig != nil {
+						tlsConfig = upstream.TLSConfig.Clone()
+					}
+					tlsConfig.InsecureSkipVerify = true
+					uh.ReverseProxy.Transport = newUpstreamTransport(tlsConfig)
+					if !dryRun {
+						log.Printf("[WARNING] Not verifying the TLS certificate of upstream host %s", uh.Name)
+					}
+				}
+				uh.ReverseProxy.WebSocketIdleTimeout = upstream.WebSocketIdleTimeout
+				uh.ReverseProxy.ProxyProtocol = upstream.ProxyProtocol
+				uh.ReverseProxy.CookieDomains = upstream.CookieDomains
+				uh.ReverseProxy.CookiePaths = upstream.CookiePaths
+				uh.ReverseProxy.AllowContentTypes = upstream.AllowContentTypes
+				uh.ReverseProxy.DenyContentTypes = upstream.DenyContentTypes
+				uh.ReverseProxy.AllowRequestHeaders = upstream.AllowRequestHeaders
+				uh.ReverseProxy.DenyRequestHeaders = upstream.DenyRequestHeaders
+				uh.ReverseProxy.Via = upstream.Via
+				uh.ReverseProxy.ViaRequest = upstream.ViaRequest
+				uh.ReverseProxy.ViaResponse = upstream.ViaResponse
+				uh.ReverseProxy.Cache = upstream.Cache
+				uh.ReverseProxy.CacheStatusHeader = upstream.CacheStatusHeader
+				uh.ReverseProxy.CachePool = pool
+				uh.ReverseProxy.HeadAsGet = upstream.HeadAsGet
+				uh.ReverseProxy.DropInformational = upstream.DropInformational
+				uh.ReverseProxy.Trailers = upstream.Trailers
+				if uh.MaxLatency > 0 {
+					uh.ReverseProxy.ResponseTime = uh.observeLatency
+				}
 			} else {
+				return nil, err
+			}
+			return uh, nil
+		}
+
+		upstream.Hosts = make([]*UpstreamHost, len(to))
+		for i, host := range to {
+			uh, err := newHost(host, "")
+			if err != nil {
 				return upstreams, err
 			}
 			upstream.Hosts[i] = uh
 		}
+		for i, hosts := range routeHosts {
+			for _, host := range hosts {
+				uh, err := newHost(host, "route "+strconv.Itoa(i))
+				if err != nil {
+					return upstreams, err
+				}
+				upstream.Routes[i].Hosts = append(upstream.Routes[i].Hosts, uh)
+			}
+		}
+		for _, host := range canaryHosts {
+			uh, err := newHost(host, "canary")
+			if err != nil {
+				return upstreams, err
+			}
+			upstream.Canary.Hosts = append(upstream.Canary.Hosts, uh)
+		}
+		if upstream.Canary != nil && upstream.Canary.PercentFile != "" && !dryRun {
+			go upstream.Canary.watchPercentFile()
+		}
 
-		if upstream.HealthCheck.Path != "" {
+		if upstream.Maintenance != nil && !dryRun {
+			go upstream.Maintenance.watchFile()
+		}
+
+		if upstream.HealthCheck.TCP && upstream.HealthCheck.Path != "" {
+			return upstreams, c.Err("health_check and health_check_tcp cannot be used together")
+		}
+		if (upstream.HealthCheck.Path != "" || upstream.HealthCheck.TCP) && !dryRun {
 			go upstream.healthCheckWorker(nil)
 		}
+		if upstream.ResolveInterval > 0 && !dryRun {
+			go upstream.resolveWorker()
+		}
 		upstreams = append(upstreams, upstream)
 	}
 	return upstreams, nil
 }
 
+// insecureHost returns the index of the host in to which is
+// named by insecure, as given or by its host name, or -1.
+func insecureHost(to []string, insecure string) int {
+	for i, host := range to {
+		if host == insecure || upstreamName(host) == upstreamName(insecure) {
+			return i
+		}
+		if u, err := url.Parse(upstreamName(host)); err == nil && u.Hostname() == insecure {
+			return i
+		}
+	}
+	return -1
+}
+
+// insecure returns whether the certificate of
+// host, as given in to, is not to be verified.
+func (u *staticUpstream) insecure(host string) bool {
+	for _, insecure := range u.InsecureHosts {
+		if insecureHost([]string{host}, insecure) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// upstreamName returns the name of the upstream host given
+// as host, which may leave out the scheme, like backend:8080,
+// in which case it defaults to http. IPv6 addresses may be
+// given without the brackets if there is no port.
+func upstreamName(host string) string {
+	if strings.Contains(host, "://") {
+		return host
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		host = "[" + host + "]"
+	}
+	return "http://" + host
+}
+
+// newTransport returns a transport like http.DefaultTransport
+// which uses tlsConfig for connections to https upstreams, makes
+// connections from localAddr, unless it is nil, and starts them
+// with a PROXY protocol header of the given version, unless it is
+// 0. Since the header is only sent once per connection, connections
+// are then not reused for other requests.
+func newTransport(tlsConfig *tls.Config, proxyProtocol int, localAddr net.Addr) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	dialer := newDialer(localAddr)
+	transport.DialContext = dialer.DialContext
+	if proxyProtocol != 0 {
+		transport.DialContext = proxyProtocolDialer(proxyProtocol, dialer)
+		transport.DisableKeepAlives = true
+	}
+	return transport
+}
+
+// newDialer returns a dialer like that of http.DefaultTransport
+// which makes connections from localAddr, unless it is nil.
+func newDialer(localAddr net.Addr) *net.Dialer {
+	return &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		LocalAddr: localAddr,
+	}
+}
+
+// pools returns the hosts of u and those of its routes and canary.
+func (u *staticUpstream) pools() []HostPool {
+	pools := []HostPool{u.Hosts}
+	for _, route := range u.Routes {
+		pools = append(pools, route.Hosts)
+	}
+	if u.Canary != nil {
+		pools = append(pools, u.Canary.Hosts)
+	}
+	return pools
+}
+
+// pool returns the pool of hosts to select from for r, which
+// is that of the first route r matches, if any, or else that
+// of the canary if it selects r and has a host available, or
+// else the hosts of u. Hosts of routes and canaries are never
+// selected without r.
+func (u *staticUpstream) pool(r *http.Request) HostPool {
+	if r != nil {
+		for _, route := range u.Routes {
+			if r.Header.Get(route.Header) == route.Value {
+				return route.Hosts
+			}
+		}
+		if u.Canary != nil {
+			key := ""
+			if u.Canary.Key != nil {
+				key = u.Canary.Key(r)
+			}
+			if u.Canary.selects(key) && u.Canary.Hosts.available() {
+				return u.Canary.Hosts
+			}
+		}
+	}
+	return u.Hosts
+}
+
 func (u *staticUpstream) healthCheck() {
-	for _, host := range u.Hosts {
+	for _, pool := range u.pools() {
+		u.healthCheckPool(pool)
+	}
+}
+
+func (u *staticUpstream) healthCheckPool(pool HostPool) {
+	for _, host := range pool {
+		if u.HealthCheck.TCP {
+			u.healthCheckTCP(host)
+			continue
+		}
 		hostUrl := host.Name + u.HealthCheck.Path
-		if r, err := http.Get(hostUrl); err == nil {
+		client := &http.Client{Timeout: u.HealthCheck.Timeout}
+		if host.ReverseProxy != nil {
+			client.Transport = host.ReverseProxy.Transport
+		}
+		start := time.Now()
+		if r, err := client.Get(hostUrl); err == nil {
+			host.observeLatency(time.Since(start))
+			unhealthy := r.StatusCode < 200 || r.StatusCode >= 400
+			if !unhealthy && u.HealthCheck.Body != nil {
+				body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxHealthCheckBody))
+				unhealthy = err != nil || !u.HealthCheck.Body.Match(body)
+			}
 			io.Copy(ioutil.Discard, r.Body)
 			r.Body.Close()
-			host.Unhealthy = r.StatusCode < 200 || r.StatusCode >= 400
+			host.SetUnhealthy(unhealthy)
+			if !unhealthy && host.KeepFails {
+				atomic.StoreInt32(&host.Fails, 0)
+			}
 		} else {
-			host.Unhealthy = true
+			host.SetUnhealthy(true)
 		}
 	}
 }
 
+// healthCheckTCP marks host unhealthy if no TCP connection to it
+// can be made within the health check timeout, and healthy if one
+// can. The connection is closed right away.
+func (u *staticUpstream) healthCheckTCP(host *UpstreamHost) {
+	timeout := u.HealthCheck.Timeout
+	if timeout == 0 {
+		timeout = DefaultTCPHealthCheckTimeout
+	}
+	dialer := &net.Dialer{Timeout: timeout, LocalAddr: u.LocalAddr}
+	conn, err := dialer.Dial("tcp", hostAddr(host.Name))
+	if err != nil {
+		host.SetUnhealthy(true)
+		return
+	}
+	conn.Close()
+	host.SetUnhealthy(false)
+	if host.KeepFails {
+		atomic.StoreInt32(&host.Fails, 0)
+	}
+}
+
+// hostAddr returns the address to connect to for the host
+// name, a URL, with the default port of its scheme if it has
+// none. Names which are not URLs are taken as the address.
+func hostAddr(name string) string {
+	hostUrl, err := url.Parse(name)
+	if err != nil || hostUrl.Host == "" {
+		return name
+	}
+	if hostUrl.Port() != "" {
+		return hostUrl.Host
+	}
+	port := "80"
+	if hostUrl.Scheme == "https" {
+		port = "443"
+	}
+	return net.JoinHostPort(hostUrl.Hostname(), port)
+}
+
 func (u *staticUpstream) healthCheckWorker(stop chan struct{}) {
 	ticker := time.NewTicker(u.HealthCheck.Interval)
 	u.healthCheck()
@@ -176,28 +1007,97 @@ func (u *staticUpstream) From() string {
 	return u.from
 }
 
+func (u *staticUpstream) Options() UpstreamOptions {
+	opts := UpstreamOptions{
+		CaseInsensitive: u.CaseInsensitive,
+		Methods:         u.Methods,
+		RetryBudget:     u.RetryBudget,
+		RetryDelay:      u.RetryDelay,
+		TryLimit:        u.TryLimit,
+		TryDuration:     u.TryDuration,
+		FailFast:        u.FailFast,
+		Fallback:        u.Fallback,
+		Log:             u.Log,
+		LoadShedder:     u.LoadShedder,
+		Maintenance:     u.Maintenance,
+	}
+	if u.ViaRequest {
+		opts.Via = u.Via
+	}
+	return opts
+}
+
 func (u *staticUpstream) Select() *UpstreamHost {
-	pool := u.Hosts
+	host, _ := u.SelectHost(nil)
+	return host
+}
+
+func (u *staticUpstream) SelectHost(r *http.Request) (*UpstreamHost, error) {
+	pool := u.pool(r)
+	if len(pool) == 0 {
+		return nil, ErrNoHosts
+	}
+	// only an outage of the hosts of u itself is cooled down
+	// from, not of those of its routes or canary
+	own := len(u.Hosts) > 0 && &pool[0] == &u.Hosts[0]
+	if own && u.coolingDown() {
+		return nil, ErrOutage
+	}
 	if len(pool) == 1 {
 		if pool[0].Down() {
-			return nil
+			if own {
+				u.noteOutage()
+			}
+			return nil, ErrAllDown
 		}
-		return pool[0]
+		if pool[0].Full() {
+			return nil, ErrAllBusy
+		}
+		return pool[0], nil
 	}
-	allDown := true
+	allDown, allFull := true, true
 	for _, host := range pool {
+		if u.SlowStart > 0 {
+			// every host needs to be looked at to notice recoveries
+			host.observe()
+		}
 		if !host.Down() {
 			allDown = false
-			break
+			if !host.Full() {
+				allFull = false
+				if u.SlowStart == 0 {
+					break
+				}
+			}
 		}
 	}
 	if allDown {
-		return nil
+		if own {
+			u.noteOutage()
+		}
+		return nil, ErrAllDown
+	}
+	if allFull {
+		return nil, ErrAllBusy
 	}
 
-	if u.Policy == nil {
-		return (&Random{}).Select(pool)
-	} else {
-		return u.Policy.Select(pool)
+	policy := u.Policy
+	if policy == nil {
+		policy = &Random{}
+	}
+	host := selectFor(policy, pool, r)
+
+	// A host that is still warming up after coming back up only
+	// keeps its selection with a probability proportional to how
+	// far along it is; otherwise we give the request to another.
+	if host != nil && u.SlowStart > 0 && rand.Float64() >= host.warmth(u.SlowStart) {
+		if other := selectFor(policy, pool.without(host), r); other != nil {
+			return other, nil
+		}
+	}
+	if host == nil {
+		// hosts became unavailable while selecting
+		return nil, ErrAllBusy
 	}
+	return host, nil
 }
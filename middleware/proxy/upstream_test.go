@@ -1,6 +1,14 @@
 package proxy
 
 import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
 	"testing"
 	"time"
 )
@@ -22,6 +30,37 @@ func TestHealthCheck(t *testing.T) {
 	}
 }
 
+// TestHealthCheckRace selects hosts while they are health checked.
+// Run it with -race to check that the health checks do not race
+// with the selection.
+func TestHealthCheckRace(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	upstream := newTestUpstream(backend.URL)
+	upstream.Hosts = append(upstream.Hosts, &UpstreamHost{Name: "http://127.0.0.1:1"})
+	upstream.HealthCheck.Path = "/"
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 5; i++ {
+			upstream.healthCheck()
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			if upstream.Hosts[0].IsUnhealthy() || !upstream.Hosts[1].IsUnhealthy() {
+				t.Error("Expected only the second host to fail its health check")
+			}
+			return
+		default:
+			upstream.Select()
+		}
+	}
+}
+
 func TestSelect(t *testing.T) {
 	upstream := &staticUpstream{
 		from:        "",
@@ -30,14 +69,456 @@ func TestSelect(t *testing.T) {
 		FailTimeout: 10 * time.Second,
 		MaxFails:    1,
 	}
-	upstream.Hosts[0].Unhealthy = true
-	upstream.Hosts[1].Unhealthy = true
-	upstream.Hosts[2].Unhealthy = true
+	upstream.Hosts[0].SetUnhealthy(true)
+	upstream.Hosts[1].SetUnhealthy(true)
+	upstream.Hosts[2].SetUnhealthy(true)
 	if h := upstream.Select(); h != nil {
 		t.Error("Expected select to return nil as all host are down")
 	}
-	upstream.Hosts[2].Unhealthy = false
+	upstream.Hosts[2].SetUnhealthy(false)
 	if h := upstream.Select(); h == nil {
 		t.Error("Expected select to not return nil")
 	}
 }
+
+func TestSlowStart(t *testing.T) {
+	upstream := &staticUpstream{
+		from:        "",
+		Hosts:       testPool()[:2],
+		Policy:      &RoundRobin{},
+		FailTimeout: 10 * time.Second,
+		MaxFails:    1,
+		SlowStart:   time.Hour,
+	}
+	upstream.Hosts[0].SetUnhealthy(true)
+	upstream.Select()
+	upstream.Hosts[0].SetUnhealthy(false)
+
+	warming := 0
+	for i := 0; i < 1000; i++ {
+		if upstream.Select() == upstream.Hosts[0] {
+			warming++
+		}
+	}
+	if warming > 50 {
+		t.Errorf("Expected recovered host to rarely be selected during slow start, got %d of 1000", warming)
+	}
+
+	upstream.SlowStart = time.Nanosecond
+	if h := upstream.Hosts[0].warmth(upstream.SlowStart); h != 1 {
+		t.Errorf("Expected host to be fully warmed up after slow start, got %f", h)
+	}
+}
+
+func TestHealthCheckBody(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status": "` + r.URL.Query().Get("status") + `"}`))
+	}))
+	defer backend.Close()
+
+	upstream := newTestUpstream(backend.URL)
+	upstream.HealthCheck.Body = regexp.MustCompile(`"status": "ok"`)
+
+	upstream.HealthCheck.Path = "/health?status=ok"
+	upstream.healthCheck()
+	if upstream.Hosts[0].Down() {
+		t.Error("Expected host with matching health check body to be up")
+	}
+
+	upstream.HealthCheck.Path = "/health?status=degraded"
+	upstream.healthCheck()
+	if !upstream.Hosts[0].Down() {
+		t.Error("Expected host with mismatching health check body to be down")
+	}
+}
+
+func TestHealthCheckTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	upstream := newTestUpstream("http://" + listener.Addr().String())
+	upstream.HealthCheck.TCP = true
+	upstream.HealthCheck.Timeout = time.Second
+
+	upstream.healthCheck()
+	if upstream.Hosts[0].Down() {
+		t.Error("Expected host accepting connections to be up")
+	}
+
+	listener.Close()
+	upstream.healthCheck()
+	if !upstream.Hosts[0].Down() {
+		t.Error("Expected host refusing connections to be down")
+	}
+}
+
+func TestHostAddr(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"http://localhost:8080", "localhost:8080"},
+		{"http://localhost", "localhost:80"},
+		{"https://[::1]", "[::1]:443"},
+		{"localhost:9000", "localhost:9000"},
+	}
+	for i, test := range tests {
+		if addr := hostAddr(test.name); addr != test.expected {
+			t.Errorf("Test %d: Expected address %s, got %s", i, test.expected, addr)
+		}
+	}
+}
+
+func TestSelectHostReason(t *testing.T) {
+	upstream := &staticUpstream{
+		from:        "",
+		Hosts:       testPool()[:2],
+		Policy:      &Random{},
+		FailTimeout: 10 * time.Second,
+		MaxFails:    1,
+	}
+	upstream.Hosts[0].MaxConns = 1
+	upstream.Hosts[1].MaxConns = 1
+
+	if h, err := upstream.SelectHost(nil); h == nil || err != nil {
+		t.Errorf("Expected a host and no error, got %v and %v", h, err)
+	}
+
+	upstream.Hosts[0].Conns = 1
+	upstream.Hosts[1].Conns = 1
+	if _, err := upstream.SelectHost(nil); err != ErrAllBusy {
+		t.Errorf("Expected %v when all hosts are full, got %v", ErrAllBusy, err)
+	}
+
+	upstream.Hosts[0].SetUnhealthy(true)
+	upstream.Hosts[1].SetUnhealthy(true)
+	if _, err := upstream.SelectHost(nil); err != ErrAllDown {
+		t.Errorf("Expected %v when all hosts are down, got %v", ErrAllDown, err)
+	}
+
+	upstream.Hosts = nil
+	if _, err := upstream.SelectHost(nil); err != ErrNoHosts {
+		t.Errorf("Expected %v without hosts, got %v", ErrNoHosts, err)
+	}
+}
+
+func TestUpstreamName(t *testing.T) {
+	tests := []struct {
+		host     string
+		expected string
+	}{
+		{"localhost", "http://localhost"},
+		{"backend:8080", "http://backend:8080"},
+		{"httpbin:80", "http://httpbin:80"},
+		{"10.0.0.1:8080", "http://10.0.0.1:8080"},
+		{"http://backend:8080", "http://backend:8080"},
+		{"https://backend", "https://backend"},
+		{"[::1]:8080", "http://[::1]:8080"},
+		{"::1", "http://[::1]"},
+		{"http://[2001:db8::1]:8080", "http://[2001:db8::1]:8080"},
+	}
+
+	for i, test := range tests {
+		name := upstreamName(test.host)
+		if name != test.expected {
+			t.Errorf("Test %d: Expected %s, got %s", i, test.expected, name)
+		}
+		if _, err := url.Parse(name); err != nil {
+			t.Errorf("Test %d: Expected %s to parse, got %v", i, name, err)
+		}
+	}
+}
+
+func TestSourceAddress(t *testing.T) {
+	var remote string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remote, _, _ = net.SplitHostPort(r.RemoteAddr)
+	}))
+	defer backend.Close()
+
+	upstream := newTestUpstream(backend.URL)
+	backendUrl, _ := url.Parse(backend.URL)
+	host := upstream.Hosts[0]
+	host.ReverseProxy = NewSingleHostReverseProxy(backendUrl)
+	host.ReverseProxy.Transport = newTransport(nil, 0, &net.TCPAddr{IP: net.ParseIP("127.0.0.2")})
+	p := Proxy{Upstreams: []Upstream{upstream}}
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatalf("Could not create request: %v", err)
+	}
+	if _, err := p.ServeHTTP(httptest.NewRecorder(), r); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if remote != "127.0.0.2" {
+		t.Errorf("Expected connection from 127.0.0.2, got %s", remote)
+	}
+}
+
+func TestInsecureHost(t *testing.T) {
+	to := []string{"https://secure.example.com", "internal:8443", "https://10.0.0.5"}
+	tests := []struct {
+		insecure string
+		expected int
+	}{
+		{"internal:8443", 1},
+		{"internal", 1},
+		{"http://internal:8443", 1},
+		{"10.0.0.5", 2},
+		{"https://10.0.0.5", 2},
+		{"example.com", -1},
+		{"internal:9443", -1},
+	}
+
+	for i, test := range tests {
+		if actual := insecureHost(to, test.insecure); actual != test.expected {
+			t.Errorf("Test %d: Expected host %d for %s, got %d", i, test.expected, test.insecure, actual)
+		}
+	}
+
+	upstream := &staticUpstream{InsecureHosts: []string{"internal"}}
+	if upstream.insecure(to[0]) || !upstream.insecure(to[1]) {
+		t.Error("Expected only the named host to be insecure")
+	}
+}
+
+func TestHeaderRoutes(t *testing.T) {
+	upstream := newTestUpstream("http://stable")
+	upstream.Routes = []HeaderRoute{
+		{Header: "X-Group", Value: "beta", Hosts: HostPool{&UpstreamHost{Name: "http://beta"}}},
+	}
+
+	tests := []struct {
+		group    string
+		expected string
+	}{
+		{"beta", "http://beta"},
+		{"", "http://stable"},
+		{"alpha", "http://stable"},
+	}
+
+	for i, test := range tests {
+		r, _ := http.NewRequest("GET", "/", nil)
+		if test.group != "" {
+			r.Header.Set("X-Group", test.group)
+		}
+		host, err := upstream.SelectHost(r)
+		if err != nil {
+			t.Fatalf("Test %d: Expected no error, got %v", i, err)
+		}
+		if host.Name != test.expected {
+			t.Errorf("Test %d: Expected host %s, got %s", i, test.expected, host.Name)
+		}
+	}
+
+	// the hosts of the route are not selected for the others
+	upstream.Hosts[0].SetUnhealthy(true)
+	if host := upstream.Select(); host != nil {
+		t.Errorf("Expected no host, got %s", host.Name)
+	}
+}
+
+func TestExpandHosts(t *testing.T) {
+	os.Setenv("TEST_UPSTREAMS", "host1:8080, host2:8080,https://host3")
+	os.Setenv("TEST_UPSTREAMS_EMPTY", " , ")
+	os.Setenv("TEST_UPSTREAMS_BAD_PORT", "host1:8080,host2:80a")
+	os.Setenv("TEST_UPSTREAMS_BAD_SCHEME", "ftp://host1")
+	os.Setenv("TEST_UPSTREAMS_PATH", "host1:8080/api")
+	os.Unsetenv("TEST_UPSTREAMS_UNSET")
+
+	tests := []struct {
+		hosts    []string
+		expected []string
+		err      bool
+	}{
+		{[]string{"{env.TEST_UPSTREAMS}"}, []string{"host1:8080", "host2:8080", "https://host3"}, false},
+		{[]string{"localhost:80", "{env.TEST_UPSTREAMS}"}, []string{"localhost:80", "host1:8080", "host2:8080", "https://host3"}, false},
+		{[]string{"localhost:80"}, []string{"localhost:80"}, false},
+		{[]string{"{env.TEST_UPSTREAMS_UNSET}"}, nil, true},
+		{[]string{"{env.TEST_UPSTREAMS_EMPTY}"}, nil, true},
+		{[]string{"{env.TEST_UPSTREAMS_BAD_PORT}"}, nil, true},
+		{[]string{"{env.TEST_UPSTREAMS_BAD_SCHEME}"}, nil, true},
+		{[]string{"{env.TEST_UPSTREAMS_PATH}"}, nil, true},
+	}
+	for i, test := range tests {
+		hosts, err := expandHosts(test.hosts)
+		if (err != nil) != test.err {
+			t.Errorf("Test %d: Expected error %v, got %v", i, test.err, err)
+			continue
+		}
+		if !reflect.DeepEqual(hosts, test.expected) {
+			t.Errorf("Test %d: Expected hosts %v, got %v", i, test.expected, hosts)
+		}
+	}
+}
+
+func TestOutageCooldown(t *testing.T) {
+	upstream := newTestUpstream("http://down")
+	upstream.Hosts[0].SetUnhealthy(true)
+	upstream.OutageCooldown = 50 * time.Millisecond
+	upstream.Routes = []HeaderRoute{
+		{Header: "X-Group", Value: "beta", Hosts: HostPool{&UpstreamHost{Name: "http://beta"}}},
+	}
+	r, _ := http.NewRequest("GET", "/", nil)
+
+	if _, err := upstream.SelectHost(r); err != ErrAllDown {
+		t.Errorf("Expected %v finding the outage, got %v", ErrAllDown, err)
+	}
+	// the host is not looked at again during the cooldown
+	upstream.Hosts[0].SetUnhealthy(false)
+	if _, err := upstream.SelectHost(r); err != ErrOutage {
+		t.Errorf("Expected %v during the cooldown, got %v", ErrOutage, err)
+	}
+	// the hosts of routes are not affected
+	beta, _ := http.NewRequest("GET", "/", nil)
+	beta.Header.Set("X-Group", "beta")
+	if host, err := upstream.SelectHost(beta); err != nil {
+		t.Errorf("Expected a route host during the cooldown, got %v", err)
+	} else if host.Name != "http://beta" {
+		t.Errorf("Expected host http://beta, got %s", host.Name)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if host, err := upstream.SelectHost(r); err != nil || host.Name != "http://down" {
+		t.Errorf("Expected the host to be selected after the cooldown, got %v", err)
+	}
+
+	// requests during the cooldown fail right away
+	p := Proxy{Upstreams: []Upstream{upstream}}
+	upstream.Hosts[0].SetUnhealthy(true)
+	upstream.SelectHost(r)
+	if status, err := p.ServeHTTP(httptest.NewRecorder(), r); status != http.StatusServiceUnavailable || err != ErrOutage {
+		t.Errorf("Expected status %d and %v, got %d and %v", http.StatusServiceUnavailable, ErrOutage, status, err)
+	}
+}
+
+func TestCanary(t *testing.T) {
+	upstream := newTestUpstream("http://stable")
+	upstream.Canary = &Canary{Hosts: HostPool{&UpstreamHost{Name: "http://canary"}}, Key: HeaderKey("X-User")}
+
+	canaries := func(users int) int {
+		n := 0
+		for i := 0; i < users; i++ {
+			r, _ := http.NewRequest("GET", "/", nil)
+			r.Header.Set("X-User", strconv.Itoa(i))
+			if host, _ := upstream.SelectHost(r); host.Name == "http://canary" {
+				n++
+			}
+		}
+		return n
+	}
+
+	tests := []struct {
+		percent  float64
+		min, max int
+	}{
+		{0, 0, 0},
+		{10, 50, 150},
+		{50, 400, 600},
+		{100, 1000, 1000},
+	}
+	for i, test := range tests {
+		upstream.Canary.SetPercent(test.percent)
+		if n := canaries(1000); n < test.min || n > test.max {
+			t.Errorf("Test %d: Expected %d to %d of 1000 requests to the canary, got %d", i, test.min, test.max, n)
+		}
+	}
+
+	// requests with the same key go to the same host
+	upstream.Canary.SetPercent(50)
+	if canaries(1000) != canaries(1000) {
+		t.Error("Expected the same requests to go to the canary each time")
+	}
+
+	// without a canary host available, requests go to the others
+	upstream.Canary.SetPercent(100)
+	upstream.Canary.Hosts[0].SetUnhealthy(true)
+	if n := canaries(10); n != 0 {
+		t.Errorf("Expected no requests to an unavailable canary, got %d", n)
+	}
+}
+
+func TestMaxLatency(t *testing.T) {
+	host := &UpstreamHost{
+		Name:        "http://slow",
+		MaxLatency:  10 * time.Millisecond,
+		FailTimeout: 50 * time.Millisecond,
+	}
+
+	host.observeLatency(5 * time.Millisecond)
+	if host.Down() {
+		t.Fatal("Expected a fast host to be up")
+	}
+	host.observeLatency(100 * time.Millisecond)
+	if !host.Slow() || !host.Down() {
+		t.Fatalf("Expected the host to be down with an average of %v", host.Latency())
+	}
+
+	// a single fast response does not make up for it...
+	host.observeLatency(time.Millisecond)
+	if !host.Slow() {
+		t.Errorf("Expected the host to stay down with an average of %v", host.Latency())
+	}
+
+	// ...but once tried again after the fail timeout, it starts afresh
+	time.Sleep(60 * time.Millisecond)
+	if host.Down() {
+		t.Error("Expected the host to be tried again after the fail timeout")
+	}
+	host.observeLatency(time.Millisecond)
+	if host.Slow() || host.Latency() != time.Millisecond {
+		t.Errorf("Expected the host to be up with an average of 1ms, got %v", host.Latency())
+	}
+}
+
+// idleCloser is a transport which counts
+// how often its idle connections are closed.
+type idleCloser struct {
+	http.Transport
+	closed int
+}
+
+func (t *idleCloser) CloseIdleConnections() {
+	t.closed++
+}
+
+func TestResolve(t *testing.T) {
+	resolved := map[string][]string{"backend.test": {"192.0.2.1", "192.0.2.2"}}
+	defer func(lookup func(string) ([]string, error)) { lookupHost = lookup }(lookupHost)
+	lookupHost = func(name string) ([]string, error) {
+		if ips, ok := resolved[name]; ok {
+			return ips, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+
+	upstream := newTestUpstream("http://backend.test:8080")
+	hostUrl, _ := url.Parse(upstream.Hosts[0].Name)
+	upstream.Hosts[0].ReverseProxy = NewSingleHostReverseProxy(hostUrl)
+	transport := &idleCloser{}
+	upstream.Hosts[0].ReverseProxy.Transport = transport
+
+	addrs := make(map[string]string)
+	tests := []struct {
+		ips    []string
+		closed int
+	}{
+		{[]string{"192.0.2.1", "192.0.2.2"}, 0},
+		{[]string{"192.0.2.2", "192.0.2.1"}, 0},
+		{[]string{"192.0.2.3"}, 1},
+		{nil, 1}, // not resolving keeps the connections
+		{[]string{"192.0.2.3"}, 1},
+	}
+	for i, test := range tests {
+		if test.ips == nil {
+			delete(resolved, "backend.test")
+		} else {
+			resolved["backend.test"] = test.ips
+		}
+		upstream.resolve(addrs)
+		if transport.closed != test.closed {
+			t.Errorf("Test %d: Expected idle connections to be closed %d times, got %d", i, test.closed, transport.closed)
+		}
+	}
+}
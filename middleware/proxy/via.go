@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// DefaultVia is the name the proxy identifies
+// itself with in Via headers if none is given.
+// Proxies which forward to each other need names
+// of their own, as a request which already passed
+// a proxy of the same name is taken to be a loop.
+const DefaultVia = "caddy"
+
+// viaValue returns the Via header entry for a message
+// received with the given HTTP version, like 1.1 caddy.
+// HTTP/2 and later are given by their major version only.
+func viaValue(major, minor int, name string) string {
+	version := strconv.Itoa(major)
+	if major < 2 {
+		version += "." + strconv.Itoa(minor)
+	}
+	return version + " " + name
+}
+
+// hasVia returns whether one of the entries of the Via
+// header in h was added by a proxy called name.
+func hasVia(h http.Header, name string) bool {
+	for _, header := range h["Via"] {
+		for _, entry := range strings.Split(header, ",") {
+			// protocol, name and an optional comment
+			fields := strings.Fields(entry)
+			if len(fields) > 1 && strings.EqualFold(fields[1], name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// addVia appends value to the Via header in h, folding
+// the entries of prior proxies into a single header.
+func addVia(h http.Header, value string) {
+	if prior, ok := h["Via"]; ok {
+		value = strings.Join(prior, ", ") + ", " + value
+	}
+	h.Set("Via", value)
+}
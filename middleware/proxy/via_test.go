@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestVia(t *testing.T) {
+	var via string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		via = r.Header.Get("Via")
+		w.Header().Set("Via", "1.1 backend-cache")
+	}))
+	defer backend.Close()
+
+	backendUrl, _ := url.Parse(backend.URL)
+	p := NewSingleHostReverseProxy(backendUrl)
+	p.Via = DefaultVia
+	p.ViaRequest = true
+	p.ViaResponse = true
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatalf("Could not create request: %v", err)
+	}
+	r.Header.Set("Via", "1.0 edge")
+	for try := 0; try < 2; try++ {
+		w := httptest.NewRecorder()
+		if err := p.ServeHTTP(w, r, nil); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if via != "1.0 edge, 1.1 caddy" {
+			t.Errorf("Try %d: Expected Via '1.0 edge, 1.1 caddy' at the backend, got '%s'", try, via)
+		}
+		if v := w.Header().Get("Via"); v != "1.1 backend-cache, 1.1 caddy" {
+			t.Errorf("Try %d: Expected Via '1.1 backend-cache, 1.1 caddy' in the response, got '%s'", try, v)
+		}
+	}
+	if v := r.Header.Get("Via"); v != "1.0 edge" {
+		t.Errorf("Expected the Via header of the request to be left alone, got '%s'", v)
+	}
+
+	// opt-in only
+	p.ViaRequest, p.ViaResponse = false, false
+	w := httptest.NewRecorder()
+	if err := p.ServeHTTP(w, r, nil); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if via != "1.0 edge" {
+		t.Errorf("Expected Via to be passed on unchanged, got '%s'", via)
+	}
+	if v := w.Header().Get("Via"); v != "1.1 backend-cache" {
+		t.Errorf("Expected Via of the backend only, got '%s'", v)
+	}
+}
+
+func TestViaValue(t *testing.T) {
+	tests := []struct {
+		major, minor int
+		expected     string
+	}{
+		{1, 0, "1.0 caddy"},
+		{1, 1, "1.1 caddy"},
+		{2, 0, "2 caddy"},
+	}
+	for i, test := range tests {
+		if v := viaValue(test.major, test.minor, "caddy"); v != test.expected {
+			t.Errorf("Test %d: Expected %s, got %s", i, test.expected, v)
+		}
+	}
+}
+
+func TestProxyLoop(t *testing.T) {
+	var p Proxy
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the backend is misconfigured to proxy back to us
+		status, _ := p.ServeHTTP(w, r)
+		if status != 0 {
+			w.WriteHeader(status)
+		}
+	}))
+	defer backend.Close()
+
+	backendUrl, _ := url.Parse(backend.URL)
+	upstream := newTestUpstream(backend.URL)
+	upstream.Via = DefaultVia
+	upstream.ViaRequest = true
+	upstream.Hosts[0].ReverseProxy = NewSingleHostReverseProxy(backendUrl)
+	upstream.Hosts[0].ReverseProxy.Via = DefaultVia
+	upstream.Hosts[0].ReverseProxy.ViaRequest = true
+	p = Proxy{Upstreams: []Upstream{upstream}}
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatalf("Could not create request: %v", err)
+	}
+	r.Header.Set("Via", "1.1 other")
+	w := httptest.NewRecorder()
+	status, err := p.ServeHTTP(w, r)
+	if status != 0 || err != nil {
+		t.Fatalf("Expected the response of the backend to be written, got %d %v", status, err)
+	}
+	if w.Code != http.StatusLoopDetected {
+		t.Errorf("Expected status %d from the looping request, got %d", http.StatusLoopDetected, w.Code)
+	}
+
+	r.Header.Set("Via", "1.0 edge, 1.1 CADDY (Caddy)")
+	if status, err := p.ServeHTTP(httptest.NewRecorder(), r); status != http.StatusLoopDetected || err != errLoop {
+		t.Errorf("Expected status %d and %v, got %d and %v", http.StatusLoopDetected, errLoop, status, err)
+	}
+}
@@ -0,0 +1,209 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultWebSocketIdleTimeout is how long no data may flow over a
+// proxied WebSocket connection before it is closed, if not configured.
+const DefaultWebSocketIdleTimeout = 10 * time.Minute
+
+var errNotHijackable = errors.New("Response writer does not support hijacking")
+
+// isWebSocket returns whether r asks to upgrade the
+// connection to the WebSocket protocol.
+func isWebSocket(r *http.Request) bool {
+	return strings.ToLower(r.Header.Get("Upgrade")) == "websocket" &&
+		strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade")
+}
+
+// serveWebSocket sends the upgrade request outreq to the backend. If
+// the backend switches protocols, it then copies data between the
+// client and the backend until either closes the connection, or no
+// data flows for p.WebSocketIdleTimeout. Once the client connection
+// is hijacked, no error is returned, since the request can no longer
+// be retried. If the backend refuses to upgrade, its response is
+// passed on like any other.
+func (p *ReverseProxy) serveWebSocket(rw http.ResponseWriter, outreq *http.Request) error {
+	hj, ok := rw.(http.Hijacker)
+	if !ok {
+		return errNotHijackable
+	}
+
+	backendConn, err := p.dial(outreq.Context(), outreq.URL)
+	if err != nil {
+		return err
+	}
+	defer backendConn.Close()
+	if err := outreq.Write(backendConn); err != nil {
+		return err
+	}
+	backendReader := bufio.NewReader(backendConn)
+	res, err := http.ReadResponse(backendReader, outreq)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		removeHopHeaders(res.Header)
+		p.rewriteCookies(res.Header)
+		if p.ViaResponse {
+			addVia(res.Header, viaValue(res.ProtoMajor, res.ProtoMinor, p.Via))
+		}
+		copyHeader(rw.Header(), res.Header)
+		rw.WriteHeader(res.StatusCode)
+		p.copyResponse(rw, res.Body)
+		return nil
+	}
+
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	brw.WriteString("HTTP/1.1 " + res.Status + "\r\n")
+	res.Header.Write(brw)
+	brw.WriteString("\r\n")
+	if err := brw.Flush(); err != nil {
+		// the client is gone
+		return nil
+	}
+
+	timeout := p.WebSocketIdleTimeout
+	if timeout == 0 {
+		timeout = DefaultWebSocketIdleTimeout
+	}
+	active := &activity{}
+	active.touch()
+	stop := make(chan struct{})
+	defer close(stop)
+	go closeIdle(active, timeout, stop, func() {
+		conn.Close()
+		backendConn.Close()
+	})
+
+	done := make(chan struct{}, 2)
+	go func() {
+		copyActive(backendConn, brw, active)
+		done <- struct{}{}
+	}()
+	go func() {
+		copyActive(conn, backendReader, active)
+		done <- struct{}{}
+	}()
+	// once one side is done, the deferred closes end the other
+	<-done
+	return nil
+}
+
+// activity records when data last flowed over a proxied
+// connection, so that it can be closed once idle.
+type activity struct {
+	last int64 // Unix nanoseconds; access atomically
+}
+
+// touch records that data flows now.
+func (a *activity) touch() {
+	atomic.StoreInt64(&a.last, time.Now().UnixNano())
+}
+
+// idle returns how long no data has flowed.
+func (a *activity) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&a.last)))
+}
+
+// closeIdle calls closeConns once no data has flowed for timeout
+// according to a, unless stop is closed first. It alone owns the
+// timer, so the copies only need to touch a.
+func closeIdle(a *activity, timeout time.Duration, stop <-chan struct{}, closeConns func()) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-timer.C:
+			idle := a.idle()
+			if idle >= timeout {
+				closeConns()
+				return
+			}
+			timer.Reset(timeout - idle)
+		}
+	}
+}
+
+// copyActive copies from src to dst until either
+// fails, touching a whenever data is copied.
+func copyActive(dst io.Writer, src io.Reader, a *activity) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			a.touch()
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// dial connects to the backend at u, using the TLS
+// configuration of p.Transport for https backends.
+// The PROXY protocol header, if any, is written to
+// the connection before the TLS handshake.
+func (p *ReverseProxy) dial(ctx context.Context, u *url.URL) (net.Conn, error) {
+	host := u.Host
+	if u.Scheme == "https" {
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			host += ":443"
+		}
+		var config *tls.Config
+		if t, ok := p.Transport.(*http.Transport); ok {
+			config = t.TLSClientConfig
+		}
+		if config == nil {
+			config = &tls.Config{}
+		}
+		if config.ServerName == "" {
+			config = config.Clone()
+			config.ServerName = u.Hostname()
+		}
+		conn, err := p.dialTCP(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		return tls.Client(conn, config), nil
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host += ":80"
+	}
+	return p.dialTCP(ctx, host)
+}
+
+// dialTCP connects to addr the way the transport of p does,
+// or else starting the connection with a PROXY protocol
+// header if p.ProxyProtocol is set.
+func (p *ReverseProxy) dialTCP(ctx context.Context, addr string) (net.Conn, error) {
+	// dial like the transport does, e.g. from a source address
+	if t, ok := p.Transport.(*http.Transport); ok && t.DialContext != nil {
+		return t.DialContext(ctx, "tcp", addr)
+	}
+	if p.ProxyProtocol != 0 {
+		return proxyProtocolDialer(p.ProxyProtocol, newDialer(nil))(ctx, "tcp", addr)
+	}
+	return net.Dial("tcp", addr)
+}
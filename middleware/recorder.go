@@ -1,6 +1,9 @@
 package middleware
 
 import (
+	"bufio"
+	"errors"
+	"net"
 	"net/http"
 	"time"
 )
@@ -48,3 +51,21 @@ func (r *responseRecorder) Write(buf []byte) (int, error) {
 	}
 	return n, err
 }
+
+// Hijack hijacks the connection of the underlying ResponseWriter,
+// so that recording a response does not keep, e.g., the proxy from
+// passing on a WebSocket upgrade.
+func (r *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("Response writer does not support hijacking")
+	}
+	return hj.Hijack()
+}
+
+// Flush flushes the underlying ResponseWriter if it can be.
+func (r *responseRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -14,6 +14,9 @@ import (
 // NewReplacer to get one of these.
 type Replacer interface {
 	Replace(string) string
+	// Set sets the value of the placeholder {key}, e.g.
+	// for values only known to a certain middleware.
+	Set(key, value string)
 }
 
 type replacer map[string]string
@@ -96,6 +99,11 @@ func (r replacer) Replace(s string) string {
 	return s
 }
 
+// Set sets the value of the placeholder {key} to value.
+func (r replacer) Set(key, value string) {
+	r["{"+key+"}"] = value
+}
+
 const (
 	timeFormat          = "02/Jan/2006:15:04:05 -0700"
 	headerReplacer      = "{>"